@@ -0,0 +1,186 @@
+package java
+
+import (
+	"fmt"
+)
+
+// SetAccessChecks controls whether the VM enforces access control, throwing
+// IllegalAccessError when code uses a class, field or method it may not.
+// Turning them off can help when debugging.
+func (vm *VM) SetAccessChecks(on bool) {
+	vm.accessChecks = on
+}
+
+// accessingClass is the class whose access rights the code of d has. Classes
+// the VM spins up act with the rights of the class they were made for.
+func accessingClass(d *Class) *Class {
+	for d.host != nil {
+		d = d.host
+	}
+	return d
+}
+
+// samePackage reports whether c and d are in the same run-time package.
+func (vm *VM) samePackage(c, d *Class) bool {
+	return packageName(c.Name()) == packageName(d.Name()) && vm.moduleOf(c) == vm.moduleOf(d)
+}
+
+// nestHost returns the host of the nest c belongs to. A class is its own host
+// unless its NestHost attribute names a class in the same package that lists
+// it among its NestMembers.
+func (vm *VM) nestHost(c *Class) *Class {
+	c = accessingClass(c)
+	if c.nestHost != nil {
+		return c.nestHost
+	}
+	c.nestHost = c
+	if c.nestHostName == "" || packageName(c.nestHostName) != packageName(c.Name()) {
+		return c
+	}
+	host := vm.findClass(c.nestHostName)
+	if host == nil || !vm.samePackage(host, c) {
+		return c
+	}
+	for _, name := range host.nestMembers {
+		if name == c.Name() {
+			c.nestHost = host
+		}
+	}
+	return c.nestHost
+}
+
+// checkClassAccess makes sure code in d may refer to class c (JVMS §5.4.4). c
+// has to be public or in the same package as d, and d's module has to be able
+// to see it.
+func (vm *VM) checkClassAccess(d, c *Class) error {
+	if !vm.accessChecks || d == nil {
+		return nil
+	}
+	d = accessingClass(d)
+	if c.AccessFlags&Public == 0 && !vm.samePackage(c, d) {
+		return linkageError{"java/lang/IllegalAccessError", fmt.Sprintf("failed to access class %s from class %s",
+			javaName("L"+c.Name()+";"), javaName("L"+d.Name()+";"))}
+	}
+	return vm.checkModuleAccess(d, c)
+}
+
+// memberAccessible reports whether code in d may use a member of class decl
+// with the given flags (JVMS §5.4.4). Private members are shared by the nest,
+// protected ones with subclasses and the rest with the package.
+func (vm *VM) memberAccessible(d, decl *Class, flags accessFlags) bool {
+	switch {
+	case flags&Public != 0:
+		return true
+	case flags&Private != 0:
+		return vm.nestHost(d) == vm.nestHost(decl)
+	case flags&Protected != 0 && vm.implements(d, decl):
+		return true
+	}
+	return vm.samePackage(d, decl)
+}
+
+func accessName(flags accessFlags) string {
+	switch {
+	case flags&Private != 0:
+		return "private "
+	case flags&Protected != 0:
+		return "protected "
+	}
+	return ""
+}
+
+// checkMethodAccess makes sure code in d may call m.
+func (vm *VM) checkMethodAccess(d *Class, m *Method) error {
+	if !vm.accessChecks || d == nil {
+		return nil
+	}
+	d = accessingClass(d)
+	if vm.memberAccessible(d, m.Class(), m.accessFlags) {
+		return nil
+	}
+	return linkageError{"java/lang/IllegalAccessError", fmt.Sprintf("class %s tried to access %smethod '%s'",
+		javaName("L"+d.Name()+";"), accessName(m.accessFlags), methodSignature(m.Class().Name(), m.Name(), m.RawSigniture))}
+}
+
+// checkFieldAccess makes sure code in d may use f.
+func (vm *VM) checkFieldAccess(d *Class, f *field) error {
+	if !vm.accessChecks || d == nil {
+		return nil
+	}
+	d = accessingClass(d)
+	if vm.memberAccessible(d, f.class, f.accessFlags) {
+		return nil
+	}
+	return linkageError{"java/lang/IllegalAccessError", fmt.Sprintf("class %s tried to access %sfield %s.%s",
+		javaName("L"+d.Name()+";"), accessName(f.accessFlags), javaName("L"+f.class.Name()+";"), f.name())}
+}
+
+// checkProtectedReceiver applies the rule for the protected instance members
+// of a class in another package: code in d may only use them on instances of
+// d and its subclasses.
+func (vm *VM) checkProtectedReceiver(d, decl *Class, flags accessFlags, member string, receiver javaValue) error {
+	if !vm.accessChecks || d == nil || flags&Protected == 0 || flags&Static != 0 {
+		return nil
+	}
+	d = accessingClass(d)
+	if vm.samePackage(d, decl) {
+		return nil
+	}
+	o, ok := receiver.(javaObject)
+	if !ok || o.isNull() || vm.implements(o.class(), d) {
+		return nil
+	}
+	return linkageError{"java/lang/IllegalAccessError", fmt.Sprintf("class %s tried to access protected %s of an instance of %s",
+		javaName("L"+d.Name()+";"), member, javaName("L"+o.class().Name()+";"))}
+}
+
+// resolveField finds the field a reference to name and descriptor in c
+// resolves to (JVMS §5.4.3.2): one c declares, or else one of its
+// superinterfaces or superclasses does.
+func (vm *VM) resolveField(c *Class, name, descriptor string) *field {
+	if f := c.findField(name, descriptor); f != nil {
+		return f
+	}
+	for _, i := range c.interfaces {
+		if f := vm.resolveField(vm.resolveClass(c.getClassInfoAt(i).className()), name, descriptor); f != nil {
+			return f
+		}
+	}
+	if super := vm.superclass(c); super != nil {
+		return vm.resolveField(super, name, descriptor)
+	}
+	return nil
+}
+
+// resolveFieldRef resolves the field reference at index in the constant pool
+// of current, checking that current may use it.
+func (vm *VM) resolveFieldRef(current *Class, index uint16) (*field, error) {
+	if f := current.resolvedFields[index]; f != nil {
+		return f, nil
+	}
+	ref := current.getFieldRefAt(index)
+	class, err := vm.resolveClassFrom(current, ref.className())
+	if err != nil {
+		return nil, err
+	}
+	f := vm.resolveField(class, ref.fieldName(), ref.fieldDescriptor())
+	if f == nil {
+		return nil, linkageError{"java/lang/NoSuchFieldError", fmt.Sprintf("Class %s does not have member field '%s %s'",
+			javaName("L"+class.Name()+";"), typeName(ref.fieldDescriptor()), ref.fieldName())}
+	}
+	if err := vm.checkFieldAccess(current, f); err != nil {
+		return nil, err
+	}
+	if current.resolvedFields == nil {
+		current.resolvedFields = make(map[uint16]*field)
+	}
+	current.resolvedFields[index] = f
+	return f, nil
+}
+
+// throwLinkageError throws the exception err describes from the instruction
+// executing in f.
+func (vm *VM) throwLinkageError(f *Frame, err error) *Frame {
+	e := err.(linkageError)
+	return vm.throw(f, e.class, e.message)
+}
@@ -0,0 +1,104 @@
+package java
+
+import (
+	"testing"
+)
+
+// accessClasses builds classes that use private and protected members,
+// with a main that prints what the uses throw.
+func accessClasses() []*testClass {
+	outer := newTestClass(Public|Super, "Outer", "java/lang/Object")
+	outer.field(Private|Static, "secret", "I")
+	outer.code(Private|Static, "tell", "()V", 0, func(a *assembler) {
+		a.ldc("told\n")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.op("return")
+	})
+	outer.attribute("NestMembers", u2s(1, outer.class("Outer$Inner")))
+
+	// Inner is a member of the nest of Outer and Stranger only claims to be.
+	nested := func(name string) *testClass {
+		c := newTestClass(Super, name, "java/lang/Object")
+		c.attribute("NestHost", u2s(c.class("Outer")))
+		c.code(Static, "peek", "()V", 0, func(a *assembler) {
+			a.field("getstatic", "Outer", "secret", "I")
+			a.invoke("invokestatic", "Main", "printInt", "(I)V")
+			a.invoke("invokestatic", "Outer", "tell", "()V")
+			a.op("return")
+		})
+		return c
+	}
+	inner, stranger := nested("Outer$Inner"), nested("Stranger")
+
+	base := newTestClass(Public|Super, "shapes/Base", "java/lang/Object")
+	base.field(Protected, "sides", "I")
+	base.constructor("java/lang/Object", "()V")
+	base.code(Protected, "describe", "()V", 1, func(a *assembler) {
+		a.ldc("described\n")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.op("return")
+	})
+	// Square and Circle are subclasses of Base in another package, so Square
+	// can only use the protected members of Base on Squares.
+	square := newTestClass(Public|Super, "Square", "shapes/Base")
+	square.constructor("shapes/Base", "()V")
+	square.code(Public|Static, "look", "(Lshapes/Base;)V", 1, func(a *assembler) {
+		a.op("aload_0")
+		a.field("getfield", "shapes/Base", "sides", "I")
+		a.invoke("invokestatic", "Main", "printInt", "(I)V")
+		a.op("aload_0")
+		a.invoke("invokevirtual", "shapes/Base", "describe", "()V")
+		a.op("return")
+	})
+	circle := newTestClass(Public|Super, "Circle", "shapes/Base")
+	circle.constructor("shapes/Base", "()V")
+
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 1, func(a *assembler) {
+		look := func(class string) {
+			a.class("new", class)
+			a.op("dup")
+			a.invoke("invokespecial", class, "<init>", "()V")
+			a.invoke("invokestatic", "Square", "look", "(Lshapes/Base;)V")
+		}
+		a.invoke("invokestatic", "Outer$Inner", "peek", "()V")
+		look("Square")
+		a.printThrows(
+			func() {
+				a.field("getstatic", "Outer", "secret", "I")
+				a.invoke("invokestatic", "Main", "printInt", "(I)V")
+			},
+			func() { a.invoke("invokestatic", "Outer", "tell", "()V") },
+			func() { a.invoke("invokestatic", "Stranger", "peek", "()V") },
+			func() { look("Circle") },
+		)
+		a.op("return")
+	})
+	return []*testClass{outer, inner, stranger, base, square, circle, main}
+}
+
+func TestAccessChecks(t *testing.T) {
+	got := run(newTestVM(t, accessClasses()...), "Main")
+	want := "0\ntold\n0\ndescribed\n" +
+		"java.lang.IllegalAccessError: class Main tried to access private field Outer.secret\n" +
+		"java.lang.IllegalAccessError: class Main tried to access private method 'void Outer.tell()'\n" +
+		"java.lang.IllegalAccessError: class Stranger tried to access private field Outer.secret\n" +
+		"java.lang.IllegalAccessError: class Square tried to access protected field sides of an instance of Circle\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNoAccessChecks(t *testing.T) {
+	vm := newTestVM(t, accessClasses()...)
+	vm.SetAccessChecks(false)
+	got := run(vm, "Main")
+	want := "0\ntold\n0\ndescribed\n" +
+		"0\n" +
+		"told\n" +
+		"0\ntold\n" +
+		"0\ndescribed\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
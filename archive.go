@@ -0,0 +1,364 @@
+package java
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// archiveMagic identifies a class data archive and the version of its layout.
+// Bump the version whenever the archived structures change.
+const archiveMagic = "TVMCDS\x00\x07"
+
+// ErrArchiveVersion is returned by ReadArchive for a file that isn't a class
+// data archive or was written with another version of the layout. Such an
+// archive is out of date rather than broken, and can be written again.
+var ErrArchiveVersion = errors.New("Not a class data archive or unsupported version")
+
+// An Archive caches parsed classes so that later runs can skip parsing the
+// class files again. Each class is keyed by the path it was loaded from and
+// is only used while the file at that path still has the same hash, so the
+// files are still read and hashed. Classes are linked again on every run.
+type Archive struct {
+	classes map[string]archivedClass
+	// stale is set once a class was looked up that the archive has no up to
+	// date copy of.
+	stale bool
+}
+
+// ArchiveEntry describes a single class held in an Archive.
+type ArchiveEntry struct {
+	Path      string
+	Name      string
+	Hash      string
+	Constants int
+	Fields    int
+	Methods   int
+}
+
+type archivedClass struct {
+	Path         string
+	Hash         [sha256.Size]byte
+	MinorVersion uint16
+	MajorVersion uint16
+	Constants    []archivedConstant
+	AccessFlags  uint16
+	ThisClass    uint16
+	SuperClass   uint16
+	Interfaces   []uint16
+	Fields       []archivedField
+	Methods      []archivedMethod
+	Attributes   []archivedAttribute
+}
+
+type archivedAttribute struct {
+	Name string
+	Data []byte
+}
+
+// archivedConstant is a flattened constant pool item. Tag is the class file
+// tag of the item and is zero for the second half of a long or double.
+type archivedConstant struct {
+	Tag    uint8
+	Kind   uint8
+	A      uint16
+	B      uint16
+	Int    int64
+	Float  float64
+	String string
+}
+
+type archivedField struct {
+	AccessFlags     uint16
+	NameIndex       uint16
+	DescriptorIndex uint16
+	Attributes      []archivedAttribute
+}
+
+type archivedMethod struct {
+	AccessFlags       uint16
+	NameIndex         uint16
+	DescriptorIndex   uint16
+	Signiture         []string
+	RawSigniture      string
+	MaxStack          uint16
+	MaxLocals         uint16
+	Instructions      []byte
+	ExceptionHandlers []ExceptionHandler
+	LocalVariables    []LocalVariable
+}
+
+func NewArchive() *Archive {
+	return &Archive{classes: make(map[string]archivedClass)}
+}
+
+func ReadArchive(r io.Reader) (*Archive, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != archiveMagic {
+		return nil, ErrArchiveVersion
+	}
+	var classes []archivedClass
+	if err := gob.NewDecoder(br).Decode(&classes); err != nil {
+		return nil, err
+	}
+	a := NewArchive()
+	for _, c := range classes {
+		a.classes[c.Path] = c
+	}
+	return a, nil
+}
+
+func (a *Archive) Write(w io.Writer) error {
+	if _, err := io.WriteString(w, archiveMagic); err != nil {
+		return err
+	}
+	classes := make([]archivedClass, 0, len(a.classes))
+	for _, path := range a.paths() {
+		classes = append(classes, a.classes[path])
+	}
+	return gob.NewEncoder(w).Encode(classes)
+}
+
+// Add stores a class in the archive. Only classes that were loaded from a
+// file can be archived since there is nothing to check them against otherwise.
+func (a *Archive) Add(c *Class) error {
+	if c.path == "" {
+		return fmt.Errorf("Class %s was not loaded from a file", c.Name())
+	}
+	ac, err := archiveClass(c)
+	if err != nil {
+		return err
+	}
+	a.classes[c.path] = ac
+	return nil
+}
+
+// Lookup returns the archived class for path if the archive has one that was
+// built from a file with the given hash.
+func (a *Archive) Lookup(path string, hash [sha256.Size]byte) (*Class, bool) {
+	ac, ok := a.classes[path]
+	if !ok || ac.Hash != hash {
+		a.stale = true
+		return nil, false
+	}
+	return ac.restore(), true
+}
+
+// Stale reports whether Lookup has been asked for a class the archive has no
+// up to date copy of, because the class is new or its file has changed. The
+// archive is then worth writing again.
+func (a *Archive) Stale() bool {
+	return a.stale
+}
+
+func (a *Archive) Entries() []ArchiveEntry {
+	var entries []ArchiveEntry
+	for _, path := range a.paths() {
+		ac := a.classes[path]
+		c := ac.restore()
+		entries = append(entries, ArchiveEntry{
+			Path:      ac.Path,
+			Name:      c.Name(),
+			Hash:      fmt.Sprintf("%x", ac.Hash),
+			Constants: len(ac.Constants),
+			Fields:    len(ac.Fields),
+			Methods:   len(ac.Methods),
+		})
+	}
+	return entries
+}
+
+func (a *Archive) paths() []string {
+	var paths []string
+	for path := range a.classes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func archiveClass(c *Class) (archivedClass, error) {
+	ac := archivedClass{
+		Path:         c.path,
+		Hash:         c.hash,
+		MinorVersion: c.MinorVersion,
+		MajorVersion: c.MajorVersion,
+		AccessFlags:  uint16(c.AccessFlags),
+		ThisClass:    c.thisClass,
+		SuperClass:   c.superClass,
+		Interfaces:   c.interfaces,
+	}
+	for _, item := range c.ConstantPoolItems {
+		constant, err := archiveConstant(item)
+		if err != nil {
+			return archivedClass{}, fmt.Errorf("Class %s: %v", c.Name(), err)
+		}
+		ac.Constants = append(ac.Constants, constant)
+	}
+	for _, f := range c.fields {
+		af := archivedField{AccessFlags: uint16(f.accessFlags), NameIndex: f.nameIndex, DescriptorIndex: f.descriptorIndex}
+		for _, attr := range f.attributes {
+			af.Attributes = append(af.Attributes, archivedAttribute{attr.name, attr.data})
+		}
+		ac.Fields = append(ac.Fields, af)
+	}
+	for _, attr := range c.attributes {
+		ac.Attributes = append(ac.Attributes, archivedAttribute{attr.name, attr.data})
+	}
+	for _, m := range c.methods {
+		ac.Methods = append(ac.Methods, archivedMethod{
+			AccessFlags:       uint16(m.accessFlags),
+			NameIndex:         m.nameIndex,
+			DescriptorIndex:   m.descriptorIndex,
+			Signiture:         m.Signiture,
+			RawSigniture:      m.RawSigniture,
+			MaxStack:          m.Code.maxStack,
+			MaxLocals:         m.Code.maxLocals,
+			Instructions:      m.Code.Instructions,
+			ExceptionHandlers: m.Code.ExceptionHandlers,
+			LocalVariables:    m.Code.LocalVariables,
+		})
+	}
+	return ac, nil
+}
+
+func (ac archivedClass) restore() *Class {
+	c := &Class{
+		MinorVersion: ac.MinorVersion,
+		MajorVersion: ac.MajorVersion,
+		AccessFlags:  accessFlags(ac.AccessFlags),
+		thisClass:    ac.ThisClass,
+		superClass:   ac.SuperClass,
+		interfaces:   ac.Interfaces,
+		path:         ac.Path,
+		hash:         ac.Hash,
+	}
+	c.ConstantPoolItems = make([]ConstantPoolItem, len(ac.Constants))
+	for i, constant := range ac.Constants {
+		c.ConstantPoolItems[i] = constant.restore(c)
+	}
+	for _, attr := range ac.Attributes {
+		a := attribute{attr.Name, attr.Data}
+		parseClassAttribute(c, a)
+		c.attributes = append(c.attributes, a)
+	}
+	c.fields = make([]field, len(ac.Fields))
+	for i, f := range ac.Fields {
+		c.fields[i] = field{class: c, accessFlags: accessFlags(f.AccessFlags), nameIndex: f.NameIndex, descriptorIndex: f.DescriptorIndex}
+		for _, attr := range f.Attributes {
+			c.fields[i].attributes = append(c.fields[i].attributes, attribute{attr.Name, attr.Data})
+		}
+	}
+	c.methods = make([]Method, len(ac.Methods))
+	for i, m := range ac.Methods {
+		c.methods[i] = Method{
+			class:           c,
+			Signiture:       m.Signiture,
+			RawSigniture:    m.RawSigniture,
+			accessFlags:     accessFlags(m.AccessFlags),
+			nameIndex:       m.NameIndex,
+			descriptorIndex: m.DescriptorIndex,
+			Code: Code{
+				maxStack:          m.MaxStack,
+				maxLocals:         m.MaxLocals,
+				Instructions:      m.Instructions,
+				ExceptionHandlers: m.ExceptionHandlers,
+				LocalVariables:    m.LocalVariables,
+			},
+		}
+	}
+	return c
+}
+
+// archiveConstant flattens a constant pool item, failing for kinds of item
+// the archive can't restore.
+func archiveConstant(item ConstantPoolItem) (archivedConstant, error) {
+	switch item := item.(type) {
+	case utf8String:
+		return archivedConstant{Tag: 1, String: item.contents}, nil
+	case intConstant:
+		return archivedConstant{Tag: 3, Int: int64(item.value)}, nil
+	case floatConstant:
+		return archivedConstant{Tag: 4, Int: int64(math.Float32bits(item.value))}, nil
+	case longConstant:
+		return archivedConstant{Tag: 5, Int: item.value}, nil
+	case doubleConstant:
+		return archivedConstant{Tag: 6, Float: item.value}, nil
+	case classInfo:
+		return archivedConstant{Tag: 7, A: item.nameIndex}, nil
+	case stringConstant:
+		return archivedConstant{Tag: 8, A: item.utf8Index}, nil
+	case fieldRef:
+		return archivedConstant{Tag: 9, A: item.classIndex, B: item.nameAndTypeIndex}, nil
+	case methodRef:
+		return archivedConstant{Tag: 10, A: item.classIndex, B: item.nameAndTypeIndex}, nil
+	case interfaceMethodRef:
+		return archivedConstant{Tag: 11, A: item.classIndex, B: item.nameAndTypeIndex}, nil
+	case nameAndType:
+		return archivedConstant{Tag: 12, A: item.nameIndex, B: item.descriptorIndex}, nil
+	case methodHandle:
+		return archivedConstant{Tag: 15, Kind: item.referenceKind, A: item.referenceIndex}, nil
+	case methodType:
+		return archivedConstant{Tag: 16, A: item.descriptorIndex}, nil
+	case dynamicConstant:
+		return archivedConstant{Tag: 17, A: item.bootstrapMethodAttrIndex, B: item.nameAndTypeIndex}, nil
+	case invokeDynamic:
+		return archivedConstant{Tag: 18, A: item.bootstrapMethodAttrIndex, B: item.nameAndTypeIndex}, nil
+	case moduleConstant:
+		return archivedConstant{Tag: 19, A: item.nameIndex}, nil
+	case packageConstant:
+		return archivedConstant{Tag: 20, A: item.nameIndex}, nil
+	case WideConstantPart2:
+		return archivedConstant{}, nil
+	}
+	return archivedConstant{}, fmt.Errorf("cannot archive constant pool item %T", item)
+}
+
+func (ac archivedConstant) restore(c *Class) ConstantPoolItem {
+	switch ac.Tag {
+	case 1:
+		return utf8String{ac.String}
+	case 3:
+		return intConstant{int32(ac.Int)}
+	case 4:
+		return floatConstant{math.Float32frombits(uint32(ac.Int))}
+	case 5:
+		return longConstant{ac.Int}
+	case 6:
+		return doubleConstant{ac.Float}
+	case 7:
+		return classInfo{c, ac.A}
+	case 8:
+		return stringConstant{ac.A}
+	case 9:
+		return fieldRef{c, ac.A, ac.B}
+	case 10:
+		return methodRef{c, ac.A, ac.B}
+	case 11:
+		return interfaceMethodRef{c, ac.A, ac.B}
+	case 12:
+		return nameAndType{ac.A, ac.B}
+	case 15:
+		return methodHandle{c, ac.Kind, ac.A}
+	case 16:
+		return methodType{c, ac.A}
+	case 17:
+		return dynamicConstant{c, ac.A, ac.B}
+	case 18:
+		return invokeDynamic{c, ac.A, ac.B}
+	case 19:
+		return moduleConstant{ac.A}
+	case 20:
+		return packageConstant{ac.A}
+	}
+	return WideConstantPart2{}
+}
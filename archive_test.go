@@ -0,0 +1,130 @@
+package java
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func pointClass() *classWriter {
+	w := newClassWriter(Public|Super, "Point", "java/lang/Object", nil)
+	w.field(Private, "x", "I")
+	w.string("origin")
+	w.utf8("ConstantValue")
+	w.fields = append(w.fields, memberWriter{Public | Static | Final, w.utf8("SIDES"), w.utf8("I"), nil, []attribute{{"ConstantValue", u2s(w.integer(4))}}})
+	code := newCodeWriter(1)
+	code.op(0, opReturn)
+	w.method(Public|Static, "reset", "()V", code)
+	return w
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := writeClass(t, dir, "Point", pointClass())
+	vm := NewVM()
+	if err := vm.LoadClass(path); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := vm.Archive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := archive.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadArchive(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := read.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(data)
+	e := entries[0]
+	if e.Name != "Point" || e.Path != vm.classes[0].path || e.Hash != fmt.Sprintf("%x", hash) || e.Fields != 2 || e.Methods != 1 {
+		t.Errorf("got entry %+v", e)
+	}
+
+	if _, ok := read.Lookup(e.Path, sha256.Sum256(append(data, 0))); ok {
+		t.Error("found a class for a file that has changed")
+	}
+	cached := NewVM()
+	cached.UseArchive(read)
+	if err := cached.LoadClass(path); err != nil {
+		t.Fatal(err)
+	}
+	c := cached.classes[0]
+	if c.Name() != "Point" || c.findField("x", "I") == nil || c.resolveMethod("reset", "()V") == nil {
+		t.Errorf("the class restored from the archive is missing members")
+	}
+	if f := c.findField("SIDES", "I"); f == nil {
+		t.Error("the class restored from the archive is missing SIDES")
+	} else if index, ok := f.constantValue(); !ok || c.getConstantPoolItemAt(index) != (intConstant{4}) {
+		t.Error("the class restored from the archive lost the ConstantValue of SIDES")
+	}
+}
+
+func TestArchiveStale(t *testing.T) {
+	dir := t.TempDir()
+	path := writeClass(t, dir, "Point", pointClass())
+	vm := NewVM()
+	if err := vm.LoadClass(path); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := vm.Archive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cached := NewVM()
+	cached.UseArchive(archive)
+	if err := cached.LoadClass(path); err != nil {
+		t.Fatal(err)
+	}
+	if archive.Stale() {
+		t.Error("the archive is stale although the class file is unchanged")
+	}
+	changed := pointClass()
+	changed.field(Private, "y", "I")
+	if err := cached.LoadClass(writeClass(t, dir, "Point", changed)); err != nil {
+		t.Fatal(err)
+	}
+	if !archive.Stale() {
+		t.Error("the archive is not stale after the class file changed")
+	}
+}
+
+func TestArchiveFromAnotherVersion(t *testing.T) {
+	old := archiveMagic[:len(archiveMagic)-1] + "\x01"
+	if _, err := ReadArchive(strings.NewReader(old)); err != ErrArchiveVersion {
+		t.Errorf("got %v, want ErrArchiveVersion", err)
+	}
+}
+
+type unknownConstant struct{}
+
+func (unknownConstant) isConstantPoolItem() {}
+func (unknownConstant) String() string      { return "unknown" }
+
+func TestArchiveUnknownConstant(t *testing.T) {
+	dir := t.TempDir()
+	vm := NewVM()
+	if err := vm.LoadClass(writeClass(t, dir, "Point", pointClass())); err != nil {
+		t.Fatal(err)
+	}
+	c := vm.classes[0]
+	c.ConstantPoolItems = append(c.ConstantPoolItems, unknownConstant{})
+	if _, err := vm.Archive(); err == nil {
+		t.Error("archived a constant pool item it can't restore")
+	}
+}
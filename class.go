@@ -1,12 +1,15 @@
 package java
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"strings"
 )
 
 type ConstantPoolItem interface {
@@ -17,16 +20,20 @@ type ConstantPoolItem interface {
 type accessFlags uint16
 
 const (
-	Public     accessFlags = 0x0001
-	Static                 = 0x0008
-	Final                  = 0x0010
-	Super                  = 0x0020
-	Native                 = 0x0100
-	Interface              = 0x0200
-	Abstract               = 0x0400
-	Synthetic              = 0x1000
-	Annotation             = 0x2000
-	Enum                   = 0x4000
+	Public       accessFlags = 0x0001
+	Private                  = 0x0002
+	Protected                = 0x0004
+	Static                   = 0x0008
+	Final                    = 0x0010
+	Super                    = 0x0020
+	Synchronized             = 0x0020
+	Varargs                  = 0x0080
+	Native                   = 0x0100
+	Interface                = 0x0200
+	Abstract                 = 0x0400
+	Synthetic                = 0x1000
+	Annotation               = 0x2000
+	Enum                     = 0x4000
 )
 
 type Code struct {
@@ -34,6 +41,7 @@ type Code struct {
 	maxLocals         uint16
 	Instructions      []byte
 	ExceptionHandlers []ExceptionHandler
+	LocalVariables    []LocalVariable
 }
 
 type Class struct {
@@ -48,6 +56,49 @@ type Class struct {
 	fields            []field
 	methods           []Method
 	initialised       bool
+	attributes        []attribute
+	module            *moduleDescriptor
+	modulePackages    []string
+	moduleMainClass   string
+	definingModule    *module
+	bootstrapMethods  []bootstrapMethod
+	resolvedConstants map[uint16]resolvedConstant
+	path              string
+	hash              [sha256.Size]byte
+	// linked is set once the method tables of the class are laid out. The
+	// vtable has a slot for each virtual method, and there is an itable for
+	// each interface the class implements indexed like its methods.
+	linked  bool
+	vtable  []*Method
+	itables map[*Class][]*Method
+	// resolvedMethods and specialMethods cache the methods the method
+	// references in the constant pool resolve to, and which of them
+	// invokespecial selects.
+	resolvedMethods map[uint16]*Method
+	specialMethods  map[uint16]*Method
+	resolvedFields  map[uint16]*field
+	// nestHostName and nestMembers come from the NestHost and NestMembers
+	// attributes, and nestHost is the host once it has been checked.
+	nestHostName string
+	nestMembers  []string
+	nestHost     *Class
+	// host is the class a class the VM spins up is made for. It takes part
+	// in access control as if it were its host.
+	host *Class
+	// layout lists the instance fields objects of the class have, once
+	// laidOut is set.
+	layout  []*field
+	laidOut bool
+	// instanceSize is how many bytes an object of the class takes up, once
+	// it has been laid out.
+	instanceSize int64
+	// reference is how strongly objects of the class hold the referent of a
+	// Reference, once it has been laid out.
+	reference referenceKind
+	// finalizer is set if the class has a finalize method to run, once
+	// finalizerChecked is.
+	finalizer        bool
+	finalizerChecked bool
 }
 
 type ExceptionHandler struct {
@@ -58,6 +109,16 @@ type ExceptionHandler struct {
 	Class     string
 }
 
+// A LocalVariable is an entry of the LocalVariableTable attribute. The
+// variable in slot Index is called Name from byte code Start for Length bytes.
+type LocalVariable struct {
+	Start      uint16
+	Length     uint16
+	Name       string
+	Descriptor string
+	Index      uint16
+}
+
 func parseCode(cr classDecoder, length uint32, method *Method) {
 	var c Code
 	c.maxStack = cr.u2()
@@ -81,8 +142,24 @@ func parseCode(cr classDecoder, length uint32, method *Method) {
 			c.ExceptionHandlers[i].Class = name.contents
 		}
 	}
-	for k := uint32(8) + codeLength + 2 + uint32(numExceptionHandlers)*8; k < length; k++ {
-		_ = cr.u1()
+	numAttributes := cr.u2()
+	for i := uint16(0); i < numAttributes; i++ {
+		name := method.class.getUTF8At(cr.u2())
+		attributeLength := cr.u4()
+		if name != "LocalVariableTable" {
+			cr.bytes(attributeLength)
+			continue
+		}
+		numLocalVariables := cr.u2()
+		for j := uint16(0); j < numLocalVariables; j++ {
+			var v LocalVariable
+			v.Start = cr.u2()
+			v.Length = cr.u2()
+			v.Name = method.class.getUTF8At(cr.u2())
+			v.Descriptor = method.class.getUTF8At(cr.u2())
+			v.Index = cr.u2()
+			c.LocalVariables = append(c.LocalVariables, v)
+		}
 	}
 	method.Code = c
 }
@@ -119,6 +196,14 @@ func (r classDecoder) u2() uint16 {
 	return x
 }
 
+func (r classDecoder) bytes(n uint32) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = r.u1()
+	}
+	return b
+}
+
 func (r classDecoder) u1() uint8 {
 	if r.err != nil {
 		return 0
@@ -172,8 +257,14 @@ func parseConstantPool(c *Class, cr classDecoder, constantPoolCount uint16) []Co
 			items[i] = parseMethodHandle(c, cr)
 		case 16:
 			items[i] = parseMethodType(c, cr)
+		case 17:
+			items[i] = parseDynamicConstant(c, cr)
 		case 18:
 			items[i] = parseInvokeDynamic(c, cr)
+		case 19:
+			items[i] = parseModuleConstant(c, cr)
+		case 20:
+			items[i] = parsePackageConstant(c, cr)
 		default:
 			log.Fatalf("Unknown tag %d\n", tag)
 		}
@@ -181,14 +272,15 @@ func parseConstantPool(c *Class, cr classDecoder, constantPoolCount uint16) []Co
 	return items
 }
 
-func ParseClass(r io.Reader) (c Class, err error) {
+func ParseClass(r io.Reader) (*Class, error) {
+	c := new(Class)
 	cr := newClassDecoder(r)
 	c.MinorVersion = cr.u2() // minor version
 	c.MajorVersion = cr.u2() // major version
 	cpc := cr.u2()
 	constantPoolCount := cpc - 1
 	if cpc != 0 {
-		c.ConstantPoolItems = parseConstantPool(&c, cr, constantPoolCount)
+		c.ConstantPoolItems = parseConstantPool(c, cr, constantPoolCount)
 	}
 
 	c.AccessFlags = accessFlags(cr.u2())
@@ -204,24 +296,24 @@ func ParseClass(r io.Reader) (c Class, err error) {
 	fieldsCount := cr.u2()
 	c.fields = make([]field, fieldsCount)
 	for i := uint16(0); i < fieldsCount; i++ {
+		c.fields[i].class = c
 		c.fields[i].accessFlags = accessFlags(cr.u2())
 		c.fields[i].nameIndex = cr.u2()
 		c.fields[i].descriptorIndex = cr.u2()
 
 		attrCount := cr.u2()
 		for j := uint16(0); j < attrCount; j++ {
-			_ = cr.u2()
+			name := cr.u2()
 			length := cr.u4()
-			for k := uint32(0); k < length; k++ {
-				_ = cr.u1() // throw away bytes
-			}
+			actualName := (c.ConstantPoolItems[name-1]).(utf8String)
+			c.fields[i].attributes = append(c.fields[i].attributes, attribute{actualName.contents, cr.bytes(length)})
 		}
 	}
 
 	methodsCount := cr.u2()
 	c.methods = make([]Method, methodsCount)
 	for i := uint16(0); i < methodsCount; i++ {
-		c.methods[i].class = &c
+		c.methods[i].class = c
 		c.methods[i].accessFlags = accessFlags(cr.u2())
 		c.methods[i].nameIndex = cr.u2()
 		c.methods[i].descriptorIndex = cr.u2()
@@ -247,16 +339,52 @@ func ParseClass(r io.Reader) (c Class, err error) {
 	}
 	attrCount := cr.u2()
 	for j := uint16(0); j < attrCount; j++ {
-		_ = cr.u2()
+		name := cr.u2()
 		length := cr.u4()
-		for k := uint32(0); k < length; k++ {
-			_ = cr.u1() // throw away bytes
+		actualName := (c.ConstantPoolItems[name-1]).(utf8String)
+		attr := attribute{actualName.contents, cr.bytes(length)}
+		if parseClassAttribute(c, attr) {
+			c.attributes = append(c.attributes, attr)
 		}
 	}
 
 	return c, cr.err
 }
 
+type attribute struct {
+	name string
+	data []byte
+}
+
+// parseClassAttribute decodes the class level attributes the VM cares about
+// and reports whether the attribute was one of them.
+func parseClassAttribute(c *Class, attr attribute) bool {
+	cr := classDecoder{bytes.NewReader(attr.data), nil}
+	switch attr.name {
+	case "Module":
+		c.module = parseModuleAttribute(c, cr)
+	case "ModulePackages":
+		count := cr.u2()
+		for i := uint16(0); i < count; i++ {
+			c.modulePackages = append(c.modulePackages, c.getPackageNameAt(cr.u2()))
+		}
+	case "ModuleMainClass":
+		c.moduleMainClass = c.getClassInfoAt(cr.u2()).className()
+	case "BootstrapMethods":
+		c.bootstrapMethods = parseBootstrapMethods(cr)
+	case "NestHost":
+		c.nestHostName = c.getClassInfoAt(cr.u2()).className()
+	case "NestMembers":
+		count := cr.u2()
+		for i := uint16(0); i < count; i++ {
+			c.nestMembers = append(c.nestMembers, c.getClassInfoAt(cr.u2()).className())
+		}
+	default:
+		return false
+	}
+	return true
+}
+
 func (c *Class) hasMethodCalled(name string) bool {
 	for _, m := range c.methods {
 		n := c.ConstantPoolItems[m.nameIndex-1].(utf8String).contents
@@ -289,6 +417,25 @@ func (c *Class) getField(name string) *field {
 	panic(fmt.Sprintf("Could not find field called %v", name))
 }
 
+// findField returns the field of c with name and descriptor, or nil if c
+// doesn't declare one.
+func (c *Class) findField(name, descriptor string) *field {
+	for i, f := range c.fields {
+		if c.getUTF8At(f.nameIndex) == name && c.getUTF8At(f.descriptorIndex) == descriptor {
+			return &c.fields[i]
+		}
+	}
+	return nil
+}
+
+func (c *Class) Methods() []*Method {
+	methods := make([]*Method, len(c.methods))
+	for i := range c.methods {
+		methods[i] = &c.methods[i]
+	}
+	return methods
+}
+
 func (c *Class) Name() string {
 	info := c.ConstantPoolItems[c.thisClass-1].(classInfo)
 	name := c.ConstantPoolItems[info.nameIndex-1].(utf8String)
@@ -309,6 +456,27 @@ func (c *Class) getInterfaceMethodRefAt(index uint16) interfaceMethodRef {
 	return c.ConstantPoolItems[index-1].(interfaceMethodRef)
 }
 
+// methodReference is either a methodRef or an interfaceMethodRef.
+type methodReference interface {
+	className() string
+	methodName() string
+	methodType() string
+}
+
+// getMethodReferenceAt returns the method or interface method reference at
+// index, which is what invokestatic and invokespecial may refer to.
+func (c *Class) getMethodReferenceAt(index uint16) methodReference {
+	return c.ConstantPoolItems[index-1].(methodReference)
+}
+
+func (c *Class) getInvokeDynamicAt(index uint16) invokeDynamic {
+	return c.ConstantPoolItems[index-1].(invokeDynamic)
+}
+
+func (c *Class) getMethodHandleAt(index uint16) methodHandle {
+	return c.ConstantPoolItems[index-1].(methodHandle)
+}
+
 func (c *Class) getFieldRefAt(index uint16) fieldRef {
 	return c.ConstantPoolItems[index-1].(fieldRef)
 }
@@ -317,19 +485,49 @@ func (c *Class) getClassInfoAt(index uint16) classInfo {
 	return c.ConstantPoolItems[index-1].(classInfo)
 }
 
+// resolvedConstant is what resolving a constant pool item came to: its value
+// or the error resolving it failed with.
+type resolvedConstant struct {
+	value javaValue
+	err   error
+}
+
+// resolveConstant returns what the constant at index resolves to, calling
+// resolve the first time it is asked for. Failing to resolve it is
+// remembered too, so that every later attempt fails the same way.
+func (c *Class) resolveConstant(index uint16, resolve func() (javaValue, error)) (javaValue, error) {
+	if r, ok := c.resolvedConstants[index]; ok {
+		return r.value, r.err
+	}
+	if c.resolvedConstants == nil {
+		c.resolvedConstants = make(map[uint16]resolvedConstant)
+	}
+	v, err := resolve()
+	c.resolvedConstants[index] = resolvedConstant{v, err}
+	return v, err
+}
+
 func (c *Class) getConstantPoolItemAt(index uint16) ConstantPoolItem {
 	return c.ConstantPoolItems[index-1]
 }
 
+func (c *Class) getUTF8At(index uint16) string {
+	return c.ConstantPoolItems[index-1].(utf8String).contents
+}
+
+func (c *Class) getModuleNameAt(index uint16) string {
+	return c.getUTF8At(c.ConstantPoolItems[index-1].(moduleConstant).nameIndex)
+}
+
+func (c *Class) getPackageNameAt(index uint16) string {
+	return c.getUTF8At(c.ConstantPoolItems[index-1].(packageConstant).nameIndex)
+}
+
 func (c *Class) getStringAt(index int) utf8String {
 	strRef := c.ConstantPoolItems[index].(stringConstant)
 	return c.ConstantPoolItems[strRef.utf8Index-1].(utf8String)
 }
 
-func (c *Class) getLongAt(index int) longConstant {
-	return c.ConstantPoolItems[index].(longConstant)
-}
-
 func (m methodRef) methodName() string {
 	nt := m.containingClass.ConstantPoolItems[m.nameAndTypeIndex-1].(nameAndType)
 	n := m.containingClass.ConstantPoolItems[nt.nameIndex-1].(utf8String).contents
@@ -389,6 +587,25 @@ func (m fieldRef) className() string {
 	return c
 }
 
+// splitDescriptor splits a method descriptor into the descriptors of its
+// parameters and of its return type.
+func splitDescriptor(descriptor string) ([]string, string) {
+	var params []string
+	i := 1
+	for descriptor[i] != ')' {
+		start := i
+		for descriptor[i] == '[' {
+			i++
+		}
+		if descriptor[i] == 'L' {
+			i = strings.IndexByte(descriptor[i:], ';') + i
+		}
+		i++
+		params = append(params, descriptor[start:i])
+	}
+	return params, descriptor[i+1:]
+}
+
 func parseSigniture(sig string) []string {
 	s := make([]string, 0)
 	className := false
@@ -442,6 +659,7 @@ func parseSigniture(sig string) []string {
 }
 
 type methodType struct {
+	containingClass *Class
 	descriptorIndex uint16
 }
 
@@ -452,12 +670,13 @@ func (n methodType) String() string {
 }
 
 func parseMethodType(c *Class, cr classDecoder) ConstantPoolItem {
-	return methodType{cr.u2()}
+	return methodType{c, cr.u2()}
 }
 
 type methodHandle struct {
-	referenceKind  uint8
-	referenceIndex uint16
+	containingClass *Class
+	referenceKind   uint8
+	referenceIndex  uint16
 }
 
 func (_ methodHandle) isConstantPoolItem() {}
@@ -467,10 +686,16 @@ func (n methodHandle) String() string {
 }
 
 func parseMethodHandle(c *Class, cr classDecoder) ConstantPoolItem {
-	return methodHandle{cr.u1(), cr.u2()}
+	return methodHandle{c, cr.u1(), cr.u2()}
+}
+
+// method is the method a methodHandle of one of the invoke kinds refers to.
+func (n methodHandle) method() methodReference {
+	return n.containingClass.getMethodReferenceAt(n.referenceIndex)
 }
 
 type invokeDynamic struct {
+	containingClass          *Class
 	bootstrapMethodAttrIndex uint16
 	nameAndTypeIndex         uint16
 }
@@ -482,7 +707,73 @@ func (n invokeDynamic) String() string {
 }
 
 func parseInvokeDynamic(c *Class, cr classDecoder) ConstantPoolItem {
-	return invokeDynamic{cr.u2(), cr.u2()}
+	return invokeDynamic{c, cr.u2(), cr.u2()}
+}
+
+func (n invokeDynamic) name() string {
+	nt := n.containingClass.ConstantPoolItems[n.nameAndTypeIndex-1].(nameAndType)
+	return n.containingClass.getUTF8At(nt.nameIndex)
+}
+
+func (n invokeDynamic) descriptor() string {
+	nt := n.containingClass.ConstantPoolItems[n.nameAndTypeIndex-1].(nameAndType)
+	return n.containingClass.getUTF8At(nt.descriptorIndex)
+}
+
+// dynamicConstant is a CONSTANT_Dynamic, a constant whose value comes from
+// running a bootstrap method.
+type dynamicConstant struct {
+	containingClass          *Class
+	bootstrapMethodAttrIndex uint16
+	nameAndTypeIndex         uint16
+}
+
+func (_ dynamicConstant) isConstantPoolItem() {}
+
+func (n dynamicConstant) String() string {
+	return fmt.Sprintf("(Dynamic) bootstrapMethodAttrIndex: %d, nameAndType: %d", n.bootstrapMethodAttrIndex, n.nameAndTypeIndex)
+}
+
+func parseDynamicConstant(c *Class, cr classDecoder) ConstantPoolItem {
+	return dynamicConstant{c, cr.u2(), cr.u2()}
+}
+
+func (n dynamicConstant) name() string {
+	nt := n.containingClass.ConstantPoolItems[n.nameAndTypeIndex-1].(nameAndType)
+	return n.containingClass.getUTF8At(nt.nameIndex)
+}
+
+func (n dynamicConstant) descriptor() string {
+	nt := n.containingClass.ConstantPoolItems[n.nameAndTypeIndex-1].(nameAndType)
+	return n.containingClass.getUTF8At(nt.descriptorIndex)
+}
+
+type moduleConstant struct {
+	nameIndex uint16
+}
+
+func (_ moduleConstant) isConstantPoolItem() {}
+
+func (m moduleConstant) String() string {
+	return fmt.Sprintf("(Module) name: %d", m.nameIndex)
+}
+
+func parseModuleConstant(c *Class, cr classDecoder) ConstantPoolItem {
+	return moduleConstant{cr.u2()}
+}
+
+type packageConstant struct {
+	nameIndex uint16
+}
+
+func (_ packageConstant) isConstantPoolItem() {}
+
+func (p packageConstant) String() string {
+	return fmt.Sprintf("(Package) name: %d", p.nameIndex)
+}
+
+func parsePackageConstant(c *Class, cr classDecoder) ConstantPoolItem {
+	return packageConstant{cr.u2()}
 }
 
 type nameAndType struct {
@@ -677,10 +968,35 @@ func parseDoubleConstant(c *Class, cr classDecoder) ConstantPoolItem {
 }
 
 type field struct {
+	class           *Class
 	accessFlags     accessFlags
 	nameIndex       uint16
 	descriptorIndex uint16
-	value           javaValue
+	attributes      []attribute
+	// value is the value of a static field.
+	value javaValue
+	// slot is where objects keep the value of an instance field, once the
+	// class has been laid out.
+	slot int
+}
+
+// constantValue returns the index of the constant that the ConstantValue
+// attribute of f gives as its value, if it has one.
+func (f *field) constantValue() (uint16, bool) {
+	for _, attr := range f.attributes {
+		if attr.name == "ConstantValue" && len(attr.data) == 2 {
+			return binary.BigEndian.Uint16(attr.data), true
+		}
+	}
+	return 0, false
+}
+
+func (f *field) name() string {
+	return f.class.getUTF8At(f.nameIndex)
+}
+
+func (f *field) descriptor() string {
+	return f.class.getUTF8At(f.descriptorIndex)
 }
 
 type Method struct {
@@ -691,6 +1007,17 @@ type Method struct {
 	nameIndex       uint16
 	descriptorIndex uint16
 	Code            Code
+	// callSites holds the linked invokedynamic instructions of the method
+	// keyed by their byte code index.
+	callSites map[int]*callSite
+	// implementation is the Go function that runs the method if it is
+	// native or one the VM implements itself.
+	implementation         func(*VM, *Frame, io.Writer)
+	implementationResolved bool
+	// tableIndex is the slot of the method in the vtable of its class, or
+	// in the itables for its interface, once the class is linked. It is -1
+	// for methods that aren't dispatched on.
+	tableIndex int
 }
 
 func (m *Method) Name() string {
@@ -709,6 +1036,14 @@ func (m *Method) Native() bool {
 	return m.accessFlags&Native != 0
 }
 
+func (m *Method) Abstract() bool {
+	return m.accessFlags&Abstract != 0
+}
+
+func (m *Method) Private() bool {
+	return m.accessFlags&Private != 0
+}
+
 func (m *Method) numArgs() int {
 	return len(m.Signiture) - 1
 }
@@ -0,0 +1,333 @@
+package java
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+// testClass is a class built for a test, with the name it is written under.
+type testClass struct {
+	*classWriter
+	name string
+	// bootstraps are the entries of the BootstrapMethods attribute, each a
+	// method handle followed by the number of arguments and the arguments.
+	bootstraps [][]uint16
+}
+
+func newTestClass(flags accessFlags, name, super string, interfaces ...string) *testClass {
+	return &testClass{classWriter: newClassWriter(flags, name, super, interfaces), name: name}
+}
+
+// code adds a method whose code body writes, with room for locals local
+// variables.
+func (c *testClass) code(flags accessFlags, name, descriptor string, locals int, body func(a *assembler)) {
+	a := &assembler{w: c.classWriter, c: newCodeWriter(locals), labels: make(map[string]int)}
+	body(a)
+	c.method(flags, name, descriptor, a.done())
+}
+
+// native adds a static native method.
+func (c *testClass) native(name, descriptor string) {
+	c.method(Public|Static|Native, name, descriptor, nil)
+}
+
+// constructor adds a constructor taking the parameters in descriptor and
+// passing them on to the one of super.
+func (c *testClass) constructor(super, descriptor string) {
+	c.code(Public, "<init>", descriptor, argumentsSize(descriptor)+1, func(a *assembler) {
+		a.op("aload_0")
+		params, _ := splitDescriptor(descriptor)
+		slot := 1
+		for _, p := range params {
+			a.c.load(p, slot)
+			slot += descriptorCategory(p)
+		}
+		a.invoke("invokespecial", super, "<init>", descriptor)
+		a.op("return")
+	})
+}
+
+// opcodes are the bytes of the instructions by name.
+var opcodes = func() map[string]byte {
+	out := log.Writer()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(out)
+	m := make(map[string]byte)
+	for b := 0; b < 256; b++ {
+		if b == wideOpCode {
+			continue
+		}
+		func() {
+			defer func() { recover() }()
+			code := make([]byte, 16)
+			code[0] = byte(b)
+			m[bytesToOpcode(code, 0).name] = byte(b)
+		}()
+	}
+	return m
+}()
+
+// assembler writes the code of a test method, with instructions given by
+// name and branches to labels.
+type assembler struct {
+	w      *classWriter
+	c      *codeWriter
+	labels map[string]int
+	jumps  []jump
+	tries  []try
+}
+
+// jump is a branch whose offset, at the index at, is from the instruction at
+// from to label.
+type jump struct {
+	at, from int
+	label    string
+	wide     bool
+}
+
+type try struct {
+	start, end, handler string
+	class               uint16
+}
+
+func (a *assembler) op(name string, operands ...byte) {
+	opcode, ok := opcodes[name]
+	if !ok {
+		panic("unknown instruction " + name)
+	}
+	a.c.op(0, opcode, operands...)
+}
+
+func (a *assembler) index(name string, index uint16) {
+	a.op(name, byte(index>>8), byte(index))
+}
+
+// ldc pushes the string s.
+func (a *assembler) ldc(s string) {
+	a.index("ldc_w", a.w.string(s))
+}
+
+func (a *assembler) invoke(name, class, method, descriptor string) {
+	if name == "invokeinterface" {
+		index := a.w.interfaceMethodRef(class, method, descriptor)
+		a.op(name, byte(index>>8), byte(index), byte(argumentsSize(descriptor)+1), 0)
+		return
+	}
+	a.index(name, a.w.methodRef(class, method, descriptor))
+}
+
+func (a *assembler) field(name, class, field, descriptor string) {
+	a.index(name, a.w.fieldRef(class, field, descriptor))
+}
+
+// class adds an instruction like new or checkcast that takes a class.
+func (a *assembler) class(name, class string) {
+	a.index(name, a.w.class(class))
+}
+
+func (a *assembler) label(name string) {
+	a.labels[name] = len(a.c.code)
+}
+
+// branch adds a branch instruction to label.
+func (a *assembler) branch(name, label string) {
+	j := jump{at: len(a.c.code) + 1, from: len(a.c.code), label: label, wide: name == "goto_w" || name == "jsr_w"}
+	a.jumps = append(a.jumps, j)
+	if j.wide {
+		a.op(name, 0, 0, 0, 0)
+	} else {
+		a.op(name, 0, 0)
+	}
+}
+
+// catch handles the exceptions of class, or all of them if it is empty,
+// thrown between the labels start and end at the label handler.
+func (a *assembler) catch(start, end, handler, class string) {
+	t := try{start: start, end: end, handler: handler}
+	if class != "" {
+		t.class = a.w.class(class)
+	}
+	a.tries = append(a.tries, t)
+}
+
+// printThrows runs each of steps, which throw, and has Main print the class
+// and message of what they throw.
+func (a *assembler) printThrows(steps ...func()) {
+	print := func() {
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+	}
+	for _, step := range steps {
+		id := len(a.tries)
+		start, end, handler := fmt.Sprint("try", id), fmt.Sprint("end", id), fmt.Sprint("handler", id)
+		a.label(start)
+		step()
+		a.label(end)
+		a.branch("goto", fmt.Sprint("next", id))
+		a.label(handler)
+		a.op("dup")
+		a.invoke("invokevirtual", "java/lang/Object", "toString", "()Ljava/lang/String;")
+		print()
+		a.ldc(": ")
+		print()
+		a.invoke("invokevirtual", "java/lang/Throwable", "getMessage", "()Ljava/lang/String;")
+		print()
+		a.ldc("\n")
+		print()
+		a.catch(start, end, handler, "java/lang/Throwable")
+		a.label(fmt.Sprint("next", id))
+	}
+}
+
+func (a *assembler) done() *codeWriter {
+	for _, j := range a.jumps {
+		offset := a.labels[j.label] - j.from
+		if j.wide {
+			binary.BigEndian.PutUint32(a.c.code[j.at:], uint32(offset))
+		} else {
+			binary.BigEndian.PutUint16(a.c.code[j.at:], uint16(offset))
+		}
+	}
+	for _, t := range a.tries {
+		a.c.handler(a.labels[t.start], a.labels[t.end], a.labels[t.handler], t.class)
+	}
+	a.c.maxStack = 16
+	return a.c
+}
+
+// throwables are the exceptions the tests and the VM throw, with their
+// superclasses.
+var throwables = [][2]string{
+	{"java/lang/Exception", "java/lang/Throwable"},
+	{"java/lang/Error", "java/lang/Throwable"},
+	{"java/lang/RuntimeException", "java/lang/Exception"},
+	{"java/lang/NullPointerException", "java/lang/RuntimeException"},
+	{"java/lang/ClassCastException", "java/lang/RuntimeException"},
+	{"java/lang/IllegalArgumentException", "java/lang/RuntimeException"},
+	{"java/lang/IllegalMonitorStateException", "java/lang/RuntimeException"},
+	{"java/lang/LinkageError", "java/lang/Error"},
+	{"java/lang/IncompatibleClassChangeError", "java/lang/LinkageError"},
+	{"java/lang/AbstractMethodError", "java/lang/IncompatibleClassChangeError"},
+	{"java/lang/IllegalAccessError", "java/lang/IncompatibleClassChangeError"},
+	{"java/lang/NoSuchFieldError", "java/lang/IncompatibleClassChangeError"},
+	{"java/lang/NoSuchMethodError", "java/lang/IncompatibleClassChangeError"},
+	{"java/lang/BootstrapMethodError", "java/lang/LinkageError"},
+	{"java/lang/VirtualMachineError", "java/lang/Error"},
+	{"java/lang/OutOfMemoryError", "java/lang/VirtualMachineError"},
+}
+
+// classLibrary builds the part of the class library the tests need: Object,
+// String and Class, and Throwable with the exceptions the VM throws.
+func classLibrary() []*testClass {
+	object := newTestClass(Public|Super, "java/lang/Object", "java/lang/Object")
+	object.super = 0
+	object.code(Public, "<init>", "()V", 1, func(a *assembler) {
+		a.op("return")
+	})
+	object.method(Public|Native, "hashCode", "()I", nil)
+	object.code(Public, "equals", "(Ljava/lang/Object;)Z", 2, func(a *assembler) {
+		a.op("aload_0")
+		a.op("aload_1")
+		a.branch("if_acmpne", "different")
+		a.op("iconst_1")
+		a.op("ireturn")
+		a.label("different")
+		a.op("iconst_0")
+		a.op("ireturn")
+	})
+	object.method(Public|Final|Native, "getClass", "()Ljava/lang/Class;", nil)
+	object.method(Public|Final|Native, "notify", "()V", nil)
+	object.method(Public|Final|Native, "wait", "(J)V", nil)
+	object.code(Public, "toString", "()Ljava/lang/String;", 1, func(a *assembler) {
+		a.op("aload_0")
+		a.invoke("invokevirtual", "java/lang/Object", "getClass", "()Ljava/lang/Class;")
+		a.invoke("invokevirtual", "java/lang/Class", "getName", "()Ljava/lang/String;")
+		a.op("areturn")
+	})
+
+	str := newTestClass(Public|Final|Super, "java/lang/String", "java/lang/Object")
+	str.field(Private|Final, "value", "[C")
+	str.field(Private|Final, "count", "I")
+	str.constructor("java/lang/Object", "()V")
+	str.code(Public, "toString", "()Ljava/lang/String;", 1, func(a *assembler) {
+		a.op("aload_0")
+		a.op("areturn")
+	})
+
+	class := newTestClass(Public|Final|Super, "java/lang/Class", "java/lang/Object")
+	class.field(Private, "name", "Ljava/lang/String;")
+	class.field(Private, "module", "Ljava/lang/Module;")
+	class.code(Public, "getName", "()Ljava/lang/String;", 1, func(a *assembler) {
+		a.op("aload_0")
+		a.field("getfield", "java/lang/Class", "name", "Ljava/lang/String;")
+		a.op("areturn")
+	})
+
+	throwable := newTestClass(Public|Super, "java/lang/Throwable", "java/lang/Object")
+	throwable.field(Private, "detailMessage", "Ljava/lang/String;")
+	throwable.field(Private, "stackTrace", "[Ljava/lang/StackTraceElement;")
+	throwable.constructor("java/lang/Object", "()V")
+	throwable.code(Public, "<init>", "(Ljava/lang/String;)V", 2, func(a *assembler) {
+		a.op("aload_0")
+		a.invoke("invokespecial", "java/lang/Object", "<init>", "()V")
+		a.op("aload_0")
+		a.op("aload_1")
+		a.field("putfield", "java/lang/Throwable", "detailMessage", "Ljava/lang/String;")
+		a.op("return")
+	})
+	throwable.code(Public, "getMessage", "()Ljava/lang/String;", 1, func(a *assembler) {
+		a.op("aload_0")
+		a.field("getfield", "java/lang/Throwable", "detailMessage", "Ljava/lang/String;")
+		a.op("areturn")
+	})
+
+	classes := []*testClass{object, str, class, throwable}
+	for _, t := range throwables {
+		c := newTestClass(Public|Super, t[0], t[1])
+		c.constructor(t[1], "()V")
+		c.constructor(t[1], "(Ljava/lang/String;)V")
+		classes = append(classes, c)
+	}
+	return classes
+}
+
+// newTestVM makes a VM with the class library and classes on its class path.
+func newTestVM(t *testing.T, classes ...*testClass) *VM {
+	t.Helper()
+	dir := t.TempDir()
+	for _, c := range append(classLibrary(), classes...) {
+		if len(c.bootstraps) > 0 {
+			data := u2s(uint16(len(c.bootstraps)))
+			for _, b := range c.bootstraps {
+				data = append(data, u2s(b...)...)
+			}
+			c.attribute("BootstrapMethods", data)
+		}
+		writeClass(t, dir, c.name, c.classWriter)
+	}
+	vm := NewVM()
+	vm.AddDirectory(dir)
+	return &vm
+}
+
+// run runs the main method of the class called main and returns what it
+// printed. Exceptions main doesn't catch are dropped.
+func run(vm *VM, main string) string {
+	var out bytes.Buffer
+	vm.stdout = &out
+	frame := newRootFrame()
+	frame.dropExceptions = true
+	frame.push(nil)
+	vm.execute(main, "main", "([Ljava/lang/String;)V", &frame, false, true)
+	return out.String()
+}
+
+// printer adds the natives the tests print with to c.
+func printer(c *testClass) *testClass {
+	c.native("print", "(Ljava/lang/String;)V")
+	c.native("printInt", "(I)V")
+	return c
+}
@@ -0,0 +1,346 @@
+package java
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Opcodes used by the code the VM generates for classes it spins up itself.
+const (
+	opSipush          = 17
+	opLdcW            = 19
+	opIload           = 21
+	opLload           = 22
+	opFload           = 23
+	opDload           = 24
+	opAload           = 25
+	opAload0          = 42
+	opAastore         = 83
+	opPop             = 87
+	opPop2            = 88
+	opDup             = 89
+	opI2l             = 133
+	opI2f             = 134
+	opI2d             = 135
+	opL2f             = 137
+	opL2d             = 138
+	opF2d             = 141
+	opIreturn         = 172
+	opLreturn         = 173
+	opFreturn         = 174
+	opDreturn         = 175
+	opAreturn         = 176
+	opReturn          = 177
+	opGetstatic       = 178
+	opPutstatic       = 179
+	opGetfield        = 180
+	opPutfield        = 181
+	opInvokevirtual   = 182
+	opInvokespecial   = 183
+	opInvokestatic    = 184
+	opInvokeinterface = 185
+	opNew             = 187
+	opAnewarray       = 189
+	opCheckcast       = 192
+)
+
+// Tags of the constant pool items a classWriter writes.
+const (
+	utf8Tag               = 1
+	classTag              = 7
+	stringTag             = 8
+	fieldRefTag           = 9
+	methodRefTag          = 10
+	interfaceMethodRefTag = 11
+	nameAndTypeTag        = 12
+)
+
+// classWriter builds the class file of a class made up at run time, so that
+// it can be parsed and run like any other.
+type classWriter struct {
+	constants  bytes.Buffer
+	count      uint16
+	indexes    map[string]uint16
+	flags      accessFlags
+	this       uint16
+	super      uint16
+	interfaces []uint16
+	fields     []memberWriter
+	methods    []memberWriter
+	attributes []attribute
+}
+
+type memberWriter struct {
+	flags      accessFlags
+	name       uint16
+	descriptor uint16
+	code       *codeWriter
+	attributes []attribute
+}
+
+func newClassWriter(flags accessFlags, name, super string, interfaces []string) *classWriter {
+	w := &classWriter{count: 1, indexes: make(map[string]uint16), flags: flags}
+	w.this = w.class(name)
+	w.super = w.class(super)
+	for _, i := range interfaces {
+		w.interfaces = append(w.interfaces, w.class(i))
+	}
+	return w
+}
+
+// constant adds the constant pool item written by write, unless an identical
+// one described by key is already there, and returns its index.
+func (w *classWriter) constant(key string, write func()) uint16 {
+	if index, ok := w.indexes[key]; ok {
+		return index
+	}
+	write()
+	index := w.count
+	w.indexes[key] = index
+	w.count++
+	return index
+}
+
+func (w *classWriter) u1(v uint8) {
+	w.constants.WriteByte(v)
+}
+
+func (w *classWriter) u2(v uint16) {
+	binary.Write(&w.constants, binary.BigEndian, v)
+}
+
+func (w *classWriter) utf8(s string) uint16 {
+	return w.constant("utf8 "+s, func() {
+		w.u1(utf8Tag)
+		w.u2(uint16(len(s)))
+		w.constants.WriteString(s)
+	})
+}
+
+func (w *classWriter) class(name string) uint16 {
+	n := w.utf8(name)
+	return w.constant("class "+name, func() {
+		w.u1(classTag)
+		w.u2(n)
+	})
+}
+
+func (w *classWriter) string(s string) uint16 {
+	u := w.utf8(s)
+	return w.constant("string "+s, func() {
+		w.u1(stringTag)
+		w.u2(u)
+	})
+}
+
+func (w *classWriter) nameAndType(name, descriptor string) uint16 {
+	n, d := w.utf8(name), w.utf8(descriptor)
+	return w.constant("nameAndType "+name+" "+descriptor, func() {
+		w.u1(nameAndTypeTag)
+		w.u2(n)
+		w.u2(d)
+	})
+}
+
+func (w *classWriter) reference(tag uint8, class, name, descriptor string) uint16 {
+	c, nt := w.class(class), w.nameAndType(name, descriptor)
+	return w.constant(fmt.Sprintf("ref%d %s.%s%s", tag, class, name, descriptor), func() {
+		w.u1(tag)
+		w.u2(c)
+		w.u2(nt)
+	})
+}
+
+func (w *classWriter) fieldRef(class, name, descriptor string) uint16 {
+	return w.reference(fieldRefTag, class, name, descriptor)
+}
+
+func (w *classWriter) methodRef(class, name, descriptor string) uint16 {
+	return w.reference(methodRefTag, class, name, descriptor)
+}
+
+func (w *classWriter) interfaceMethodRef(class, name, descriptor string) uint16 {
+	return w.reference(interfaceMethodRefTag, class, name, descriptor)
+}
+
+func (w *classWriter) field(flags accessFlags, name, descriptor string) {
+	w.fields = append(w.fields, memberWriter{flags, w.utf8(name), w.utf8(descriptor), nil, nil})
+}
+
+func (w *classWriter) method(flags accessFlags, name, descriptor string, code *codeWriter) {
+	w.methods = append(w.methods, memberWriter{flags, w.utf8(name), w.utf8(descriptor), code, nil})
+}
+
+// attribute adds a class attribute with the given contents.
+func (w *classWriter) attribute(name string, data []byte) {
+	w.utf8(name)
+	w.attributes = append(w.attributes, attribute{name, data})
+}
+
+// bytes returns the class file.
+func (w *classWriter) bytes() []byte {
+	codeName := w.utf8("Code")
+	var b bytes.Buffer
+	u2 := func(v uint16) { binary.Write(&b, binary.BigEndian, v) }
+	u4 := func(v uint32) { binary.Write(&b, binary.BigEndian, v) }
+	u4(0xCAFEBABE)
+	u2(0)
+	u2(52)
+	u2(w.count)
+	b.Write(w.constants.Bytes())
+	u2(uint16(w.flags))
+	u2(w.this)
+	u2(w.super)
+	u2(uint16(len(w.interfaces)))
+	for _, i := range w.interfaces {
+		u2(i)
+	}
+	for _, members := range [][]memberWriter{w.fields, w.methods} {
+		u2(uint16(len(members)))
+		for _, m := range members {
+			u2(uint16(m.flags))
+			u2(m.name)
+			u2(m.descriptor)
+			count := len(m.attributes)
+			if m.code != nil {
+				count++
+			}
+			u2(uint16(count))
+			for _, a := range m.attributes {
+				u2(w.utf8(a.name))
+				u4(uint32(len(a.data)))
+				b.Write(a.data)
+			}
+			if m.code == nil {
+				continue
+			}
+			u2(codeName)
+			u4(uint32(12 + len(m.code.code) + 8*len(m.code.handlers)))
+			u2(m.code.maxStack)
+			u2(m.code.maxLocals)
+			u4(uint32(len(m.code.code)))
+			b.Write(m.code.code)
+			u2(uint16(len(m.code.handlers)))
+			for _, h := range m.code.handlers {
+				u2(h.Start)
+				u2(h.End)
+				u2(h.Handler)
+				u2(h.CatchType)
+			}
+			u2(0) // attributes
+		}
+	}
+	u2(uint16(len(w.attributes)))
+	for _, a := range w.attributes {
+		u2(w.utf8(a.name))
+		u4(uint32(len(a.data)))
+		b.Write(a.data)
+	}
+	return b.Bytes()
+}
+
+// spinName returns a name for a class the VM makes up, starting with prefix.
+func (vm *VM) spinName(prefix string) string {
+	vm.spunClasses++
+	return prefix + strconv.Itoa(vm.spunClasses-1)
+}
+
+// defineClass loads the class w has built into vm on behalf of host. It is a
+// member of the module of host and has the same access.
+func (vm *VM) defineClass(w *classWriter, host *Class) (*Class, error) {
+	class, err := ParseClass(bytes.NewReader(w.bytes()))
+	if err != nil {
+		return nil, err
+	}
+	class.definingModule = host.definingModule
+	class.host = host
+	vm.classes = append(vm.classes, class)
+	return class, nil
+}
+
+// codeWriter builds the Code attribute of a generated method. It keeps track
+// of how deep the operand stack gets as instructions are added.
+type codeWriter struct {
+	code      []byte
+	maxStack  uint16
+	maxLocals uint16
+	depth     int
+	handlers  []ExceptionHandler
+}
+
+func newCodeWriter(maxLocals int) *codeWriter {
+	return &codeWriter{maxLocals: uint16(maxLocals)}
+}
+
+// op adds an instruction that changes the depth of the stack by effect words.
+func (c *codeWriter) op(effect int, opcode byte, operands ...byte) {
+	c.code = append(c.code, opcode)
+	c.code = append(c.code, operands...)
+	c.depth += effect
+	if c.depth > int(c.maxStack) {
+		c.maxStack = uint16(c.depth)
+	}
+}
+
+func (c *codeWriter) opIndex(effect int, opcode byte, index uint16) {
+	c.op(effect, opcode, byte(index>>8), byte(index))
+}
+
+// handler adds an exception handler at handler for the code from start up to
+// end. It catches the class at catchType in the constant pool, or everything
+// if that is 0.
+func (c *codeWriter) handler(start, end, handler int, catchType uint16) {
+	c.handlers = append(c.handlers, ExceptionHandler{Start: uint16(start), End: uint16(end), Handler: uint16(handler), CatchType: catchType})
+}
+
+// load pushes the local variable of type descriptor from slot.
+func (c *codeWriter) load(descriptor string, slot int) {
+	opcode := byte(opAload)
+	switch descriptor[0] {
+	case 'Z', 'B', 'C', 'S', 'I':
+		opcode = opIload
+	case 'J':
+		opcode = opLload
+	case 'F':
+		opcode = opFload
+	case 'D':
+		opcode = opDload
+	}
+	size := descriptorCategory(descriptor)
+	if slot > 0xff {
+		c.op(size, wideOpCode, opcode, byte(slot>>8), byte(slot))
+		return
+	}
+	c.op(size, opcode, byte(slot))
+}
+
+// ret returns a value of type descriptor, or nothing for V.
+func (c *codeWriter) ret(descriptor string) {
+	switch descriptor[0] {
+	case 'V':
+		c.op(0, opReturn)
+	case 'Z', 'B', 'C', 'S', 'I':
+		c.op(-1, opIreturn)
+	case 'J':
+		c.op(-2, opLreturn)
+	case 'F':
+		c.op(-1, opFreturn)
+	case 'D':
+		c.op(-2, opDreturn)
+	default:
+		c.op(-1, opAreturn)
+	}
+}
+
+// argumentsSize is the number of words the parameters of a method with the
+// given descriptor take up.
+func argumentsSize(descriptor string) int {
+	params, _ := splitDescriptor(descriptor)
+	size := 0
+	for _, p := range params {
+		size += descriptorCategory(p)
+	}
+	return size
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/trentsummerfield/tvm"
+)
+
+const usage = `usage:
+  class-archive create <archive> <class file or directory>...
+  class-archive inspect <archive>`
+
+func main() {
+	if len(os.Args) < 3 {
+		log.Fatal(usage)
+	}
+	path := os.Args[2]
+	switch os.Args[1] {
+	case "create":
+		create(path, os.Args[3:])
+	case "inspect":
+		inspect(path)
+	default:
+		log.Fatal(usage)
+	}
+}
+
+func create(path string, sources []string) {
+	vm := java.NewVM()
+	for _, source := range sources {
+		err := filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(p, ".class") {
+				return nil
+			}
+			if err := vm.LoadClass(p); err != nil {
+				return fmt.Errorf("unable to load %s: %v", p, err)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	archive, err := vm.Archive()
+	if err != nil {
+		log.Fatalf("unable to archive the classes: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("unable to create %s: %v", path, err)
+	}
+	defer f.Close()
+	err = archive.Write(f)
+	if err != nil {
+		log.Fatalf("unable to write %s: %v", path, err)
+	}
+	fmt.Printf("Archived %d classes to %s\n", len(vm.LoadedClasses()), path)
+}
+
+func inspect(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("unable to open %s: %v", path, err)
+	}
+	defer f.Close()
+	archive, err := java.ReadArchive(f)
+	if err != nil {
+		log.Fatalf("unable to read %s: %v", path, err)
+	}
+
+	entries := archive.Entries()
+	fmt.Printf("Archive %s\n", path)
+	fmt.Printf("  %d classes\n", len(entries))
+	for _, e := range entries {
+		fmt.Printf("%s\n", e.Name)
+		fmt.Printf("  path: %s\n", e.Path)
+		fmt.Printf("  sha256: %s\n", e.Hash)
+		fmt.Printf("  constants: %d, fields: %d, methods: %d\n", e.Constants, e.Fields, e.Methods)
+	}
+}
@@ -16,7 +16,7 @@ func main() {
 	}
 	class, err := tvm.ParseClass(file)
 	if err != nil {
-		log.Panicf("unable to parse %s: %v", file, err)
+		log.Panicf("unable to parse %s: %v", path, err)
 	}
 
 	fmt.Printf("Classfile %s\n", path)
@@ -38,4 +38,37 @@ func main() {
 		name := cp.String()
 		fmt.Printf("  %4s = %s\n", index, name)
 	}
+
+	fmt.Printf("{\n")
+	for _, m := range class.Methods() {
+		fmt.Printf("  %s%s;\n", m.Name(), m.RawSigniture)
+		if len(m.Code.Instructions) == 0 {
+			fmt.Printf("\n")
+			continue
+		}
+		fmt.Printf("    Code:\n")
+		ops, offsets := tvm.Disassemble(m.Code.Instructions)
+		for i, op := range ops {
+			printInstruction(op, offsets[i])
+		}
+		fmt.Printf("\n")
+	}
+	fmt.Printf("}\n")
+}
+
+func printInstruction(op tvm.OpCode, offset int) {
+	cases := op.SwitchCases()
+	if cases == nil {
+		fmt.Printf("    %5d: %s\n", offset, op)
+		return
+	}
+	fmt.Printf("    %5d: %s {\n", offset, op.Name())
+	for _, c := range cases {
+		match := fmt.Sprintf("%d", c.Match)
+		if c.Default {
+			match = "default"
+		}
+		fmt.Printf("    %20s: %d\n", match, offset+int(c.Offset))
+	}
+	fmt.Printf("           }\n")
 }
@@ -48,6 +48,11 @@ func main() {
 				log.Fatal(err)
 			}
 			var tvmOpts []string
+			if flags, err := ioutil.ReadFile(filepath.Join("tests", test.Name(), "flags")); err == nil {
+				tvmOpts = append(tvmOpts, strings.Fields(string(flags))...)
+			} else if !os.IsNotExist(err) {
+				log.Fatal("unable to load tvm flags", err)
+			}
 			tvmOpts = append(tvmOpts, "stdlib")
 			tvmOpts = append(tvmOpts, files...)
 			tvm := exec.Command("tvm", tvmOpts...)
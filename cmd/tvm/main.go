@@ -1,21 +1,205 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/trentsummerfield/tvm"
 )
 
 func main() {
+	archive := flag.String("archive", "", "load parsed classes from the class data archive `file` when their class files are unchanged, writing it again after the run if it is missing, from another version or out of date")
+	dumpArchive := flag.String("dump-archive", "", "write every loaded class to the class data archive `file` after the run")
+	modulePath := flag.String("module-path", "", "`list` of directories holding exploded modules")
+	mainModule := flag.String("m", "", "run the main class of `module[/class]`")
+	helpfulNPE := flag.Bool("helpful-npe", true, "describe what was null in NullPointerException messages")
+	accessChecks := flag.Bool("access-checks", true, "throw IllegalAccessError when code uses a class, field or method it may not")
+	maxHeap := flag.String("Xmx", "", "limit the heap to `size` bytes, or kilobytes, megabytes or gigabytes with a k, m or g after it (default 1g)")
+	gcStats := flag.Bool("gc-stats", false, "print what the garbage collector did after the run")
+	finalization := flag.Bool("finalization", true, "run the finalize methods of objects the garbage collector finds unreachable")
+	heapDumpPath := flag.String("heap-dump-path", fmt.Sprintf("tvm_pid%d.hprof", os.Getpid()), "write heap dumps to `file`, numbering the ones after the first")
+	heapDumpOnOOM := flag.Bool("heap-dump-on-oom", false, "dump the heap the first time the VM runs out of memory")
+	heapDumpOnSignal := flag.Bool("heap-dump-on-signal", false, "dump the heap whenever the process gets "+heapDumpSignalName)
+	flag.CommandLine.Parse(javaStyleFlags(os.Args[1:]))
+
 	vm := java.NewVM()
-	for _, arg := range os.Args[1:] {
+	vm.SetHelpfulNullPointers(*helpfulNPE)
+	vm.SetAccessChecks(*accessChecks)
+	vm.SetFinalization(*finalization)
+	if *maxHeap != "" {
+		size, err := parseSize(*maxHeap)
+		if err != nil {
+			log.Fatalf("invalid maximum heap size %s: %v", *maxHeap, err)
+		}
+		vm.SetMaxHeap(size)
+	}
+	dumps := &heapDumpFiles{path: *heapDumpPath}
+	if *heapDumpOnOOM {
+		vm.SetHeapDumpOnOutOfMemory(dumps.create)
+	}
+	if *heapDumpOnSignal {
+		dumpHeapOnSignal(&vm, dumps)
+	}
+	var cached *java.Archive
+	if *archive != "" {
+		cached = useArchive(&vm, *archive)
+	}
+	for _, arg := range flag.Args() {
 		if isDirectory(arg) {
 			vm.AddDirectory(arg)
 		} else {
 			vm.LoadClass(arg)
 		}
 	}
+	if *modulePath != "" {
+		for _, dir := range filepath.SplitList(*modulePath) {
+			if err := vm.AddModulePath(dir); err != nil {
+				log.Fatalf("unable to load modules from %s: %v", dir, err)
+			}
+		}
+	}
+	if *mainModule != "" {
+		name, class := *mainModule, ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, class = name[:i], name[i+1:]
+		}
+		if err := vm.SetMainModule(name, class); err != nil {
+			log.Fatal(err)
+		}
+	}
 	vm.Run()
+	if *archive != "" && *dumpArchive == "" && (cached == nil || cached.Stale()) {
+		*dumpArchive = *archive
+	}
+	if *dumpArchive != "" {
+		writeArchive(&vm, *dumpArchive)
+	}
+	if *gcStats {
+		printHeapStats(vm.HeapStats())
+	}
+}
+
+// javaStyleFlags lets the sizes of flags like -Xmx follow them straight away
+// the way java takes them, as in -Xmx64m.
+func javaStyleFlags(args []string) []string {
+	flags := make([]string, len(args))
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-Xmx") && len(arg) > 4 && arg[4] != '=' {
+			arg = "-Xmx=" + arg[4:]
+		}
+		flags[i] = arg
+	}
+	return flags
+}
+
+// parseSize reads a number of bytes, which a k, m or g after it multiplies by
+// 1024 once, twice or three times.
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'g', 'G':
+		multiplier <<= 10
+		fallthrough
+	case 'm', 'M':
+		multiplier <<= 10
+		fallthrough
+	case 'k', 'K':
+		multiplier <<= 10
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("the size must be positive")
+	}
+	return n * multiplier, nil
+}
+
+func printHeapStats(stats java.HeapStats) {
+	fmt.Fprintf(os.Stderr, "heap: %d bytes in %d objects of at most %d bytes\n", stats.Used, stats.Objects, stats.Limit)
+	fmt.Fprintf(os.Stderr, "allocated: %d bytes\n", stats.Allocated)
+	fmt.Fprintf(os.Stderr, "collections: %d freeing %d bytes in %d objects, taking %v\n", stats.Collections, stats.Freed, stats.FreedObjects, stats.Pause)
+}
+
+// heapDumpFiles makes the files heap dumps are written to. The first goes to
+// path, and the ones after it have their number put after it, as in
+// tvm_pid42.hprof.1.
+type heapDumpFiles struct {
+	sync.Mutex
+	path  string
+	count int
+}
+
+func (d *heapDumpFiles) create() (io.WriteCloser, error) {
+	d.Lock()
+	path := d.path
+	if d.count > 0 {
+		path = fmt.Sprintf("%s.%d", d.path, d.count)
+	}
+	d.count++
+	d.Unlock()
+	log.Printf("Dumping heap to %s", path)
+	return os.Create(path)
+}
+
+// dumpHeap has vm dump its heap to the next of dumps once it gets to the next
+// instruction or finishes running.
+func dumpHeap(vm *java.VM, dumps *heapDumpFiles) {
+	done := vm.RequestHeapDump(dumps.create)
+	go func() {
+		if err := <-done; err != nil {
+			log.Printf("Unable to dump the heap: %v", err)
+		}
+	}()
+}
+
+// useArchive makes vm take classes from the archive at path and returns it. It
+// returns nil if there is no archive there or it was written by another
+// version of tvm, in which case it needs writing again.
+func useArchive(vm *java.VM, path string) *java.Archive {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatalf("unable to open archive %s: %v", path, err)
+	}
+	defer f.Close()
+	a, err := java.ReadArchive(f)
+	if err == java.ErrArchiveVersion {
+		log.Printf("ignoring archive %s from another version of tvm", path)
+		return nil
+	}
+	if err != nil {
+		log.Fatalf("unable to read archive %s: %v", path, err)
+	}
+	vm.UseArchive(a)
+	return a
+}
+
+func writeArchive(vm *java.VM, path string) {
+	archive, err := vm.Archive()
+	if err != nil {
+		log.Fatalf("unable to archive the classes: %v", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("unable to create archive %s: %v", path, err)
+	}
+	defer f.Close()
+	err = archive.Write(f)
+	if err != nil {
+		log.Fatalf("unable to write archive %s: %v", path, err)
+	}
 }
 
 func isDirectory(arg string) bool {
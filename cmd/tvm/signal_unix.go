@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/trentsummerfield/tvm"
+)
+
+const heapDumpSignalName = "SIGUSR1"
+
+// dumpHeapOnSignal dumps the heap of vm each time the process gets SIGUSR1.
+func dumpHeapOnSignal(vm *java.VM, dumps *heapDumpFiles) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			dumpHeap(vm, dumps)
+		}
+	}()
+}
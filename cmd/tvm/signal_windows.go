@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+
+	"github.com/trentsummerfield/tvm"
+)
+
+const heapDumpSignalName = "a signal, which Windows doesn't support"
+
+// dumpHeapOnSignal can't dump the heap on a signal, since Windows doesn't
+// have SIGUSR1.
+func dumpHeapOnSignal(vm *java.VM, dumps *heapDumpFiles) {
+	log.Fatal("-heap-dump-on-signal is not supported on Windows")
+}
@@ -114,7 +114,19 @@ func drawFrame(x, y int, frame *java.Frame) int {
 			} else if offset == 1 {
 				continue
 			}
-			drawString(x+xoffset, y+offset+yoffset, b.Name(), fg)
+			name := b.Name()
+			if b.Wide() {
+				name = "wide " + name
+			}
+			drawString(x+xoffset, y+offset+yoffset, name, fg)
+			// A switch spans many byte codes so there is room to list its cases.
+			for j, c := range b.SwitchCases() {
+				match := fmt.Sprintf("%d", c.Match)
+				if c.Default {
+					match = "default"
+				}
+				drawString(x+xoffset+2, y+offset+yoffset+1+j, fmt.Sprintf("%s: %+d", match, c.Offset), fg)
+			}
 			yoffset += b.Width() - 1
 			offset++
 		}
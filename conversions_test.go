@@ -0,0 +1,103 @@
+package java
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func (w *classWriter) float(v float32) uint16 {
+	return w.constant(fmt.Sprintf("float %x", math.Float32bits(v)), func() {
+		w.u1(4)
+		binary.Write(&w.constants, binary.BigEndian, math.Float32bits(v))
+	})
+}
+
+// wide adds a CONSTANT_Long or, with a tag of 6, a CONSTANT_Double holding
+// bits. Both take up two entries of the constant pool.
+func (w *classWriter) wide(tag uint8, bits uint64) uint16 {
+	count := w.count
+	index := w.constant(fmt.Sprintf("wide%d %x", tag, bits), func() {
+		w.u1(tag)
+		binary.Write(&w.constants, binary.BigEndian, bits)
+	})
+	if w.count != count {
+		w.count++
+	}
+	return index
+}
+
+func TestConversions(t *testing.T) {
+	type conversion struct {
+		push func(a *assembler)
+		op   string
+		want string
+	}
+	pushInt := func(v int32) func(a *assembler) {
+		return func(a *assembler) { a.index("ldc_w", a.w.integer(v)) }
+	}
+	pushLong := func(v int64) func(a *assembler) {
+		return func(a *assembler) { a.index("ldc2_w", a.w.wide(5, uint64(v))) }
+	}
+	pushFloat := func(v float32) func(a *assembler) {
+		return func(a *assembler) { a.index("ldc_w", a.w.float(v)) }
+	}
+	pushDouble := func(v float64) func(a *assembler) {
+		return func(a *assembler) { a.index("ldc2_w", a.w.wide(6, math.Float64bits(v))) }
+	}
+	nan, inf := math.NaN(), math.Inf(1)
+	conversions := []conversion{
+		{pushFloat(float32(nan)), "f2i", "0"},
+		{pushFloat(float32(inf)), "f2i", "2147483647"},
+		{pushFloat(-1e10), "f2i", "-2147483648"},
+		{pushFloat(-1.9), "f2i", "-1"},
+		{pushFloat(float32(nan)), "f2l", "0"},
+		{pushFloat(1e30), "f2l", "9223372036854775807"},
+		{pushFloat(float32(-inf)), "f2l", "-9223372036854775808"},
+		{pushFloat(2.5), "f2l", "2"},
+		{pushDouble(nan), "d2i", "0"},
+		{pushDouble(1e100), "d2i", "2147483647"},
+		{pushDouble(-inf), "d2i", "-2147483648"},
+		{pushDouble(-7.9), "d2i", "-7"},
+		{pushDouble(nan), "d2l", "0"},
+		{pushDouble(inf), "d2l", "9223372036854775807"},
+		{pushDouble(-1e100), "d2l", "-9223372036854775808"},
+		{pushDouble(1e18), "d2l", "1000000000000000000"},
+		{pushInt(200), "i2b", "-56"},
+		{pushInt(-129), "i2b", "127"},
+		{pushInt(-1), "i2c", "65535"},
+		{pushInt(0x12345), "i2c", "9029"},
+		{pushInt(40000), "i2s", "-25536"},
+		{pushInt(-32769), "i2s", "32767"},
+		{pushLong(0x100000005), "l2i", "5"},
+		{pushLong(0xffffffff), "l2i", "-1"},
+		{pushLong(1 << 31), "l2i", "-2147483648"},
+	}
+
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.native("printLong", "(J)V")
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 1, func(a *assembler) {
+		for _, c := range conversions {
+			c.push(a)
+			a.op(c.op)
+			if strings.HasSuffix(c.op, "l") {
+				a.invoke("invokestatic", "Main", "printLong", "(J)V")
+			} else {
+				a.invoke("invokestatic", "Main", "printInt", "(I)V")
+			}
+		}
+		a.op("return")
+	})
+
+	got := strings.Split(strings.TrimSuffix(run(newTestVM(t, main), "Main"), "\n"), "\n")
+	if len(got) != len(conversions) {
+		t.Fatalf("printed %d lines, want %d", len(got), len(conversions))
+	}
+	for i, c := range conversions {
+		if got[i] != c.want {
+			t.Errorf("conversion %d, %s, printed %s, want %s", i, c.op, got[i], c.want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package java
+
+import (
+	"fmt"
+)
+
+// resolveDynamicConstant runs the bootstrap method of a CONSTANT_Dynamic to
+// find out its value.
+func (vm *VM) resolveDynamicConstant(constant dynamicConstant) (javaValue, error) {
+	call, bsm, err := newBootstrapCall(constant.containingClass, constant.bootstrapMethodAttrIndex, constant.name(), constant.descriptor())
+	if err != nil {
+		return nil, err
+	}
+	if bootstrap := vm.constantBootstraps[bsm.class+"."+bsm.name]; bootstrap != nil {
+		return bootstrap(vm, call)
+	}
+	return vm.invokeBootstrap(bsm, call)
+}
+
+// invokeBootstrap runs a bootstrap method the VM doesn't implement itself. It
+// is passed a Lookup on the caller, the name and type being resolved and then
+// the static arguments.
+func (vm *VM) invokeBootstrap(bsm handleTarget, call bootstrapCall) (javaValue, error) {
+	types := []string{"Ljava/lang/invoke/MethodHandles$Lookup;", "Ljava/lang/String;", "Ljava/lang/Class;"}
+	args := []javaValue{vm.lookupObject(call.caller), nativeStringToJavaString(vm, call.name), vm.classMirror(call.descriptor)}
+	for i, item := range call.arguments {
+		v, err := call.argument(vm, i)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, constantType(item))
+		args = append(args, v)
+	}
+	if params, _ := splitDescriptor(bsm.methodType()); len(params) != len(args) {
+		return nil, fmt.Errorf("Bootstrap method %v cannot take %d static arguments", bsm, len(call.arguments))
+	}
+	return vm.callHandle(bsm, types, args, call.descriptor)
+}
+
+// constantType is the descriptor of the type of the value a loadable constant
+// pool item resolves to.
+func constantType(item ConstantPoolItem) string {
+	switch item := item.(type) {
+	case intConstant:
+		return "I"
+	case floatConstant:
+		return "F"
+	case longConstant:
+		return "J"
+	case doubleConstant:
+		return "D"
+	case stringConstant:
+		return "Ljava/lang/String;"
+	case classInfo:
+		return "Ljava/lang/Class;"
+	case methodType:
+		return "Ljava/lang/invoke/MethodType;"
+	case methodHandle:
+		return "Ljava/lang/invoke/MethodHandle;"
+	case dynamicConstant:
+		return item.descriptor()
+	}
+	return "Ljava/lang/Object;"
+}
+
+func isReferenceType(descriptor string) bool {
+	return descriptor[0] == 'L' || descriptor[0] == '['
+}
+
+// constantNull implements ConstantBootstraps.nullConstant.
+func constantNull(vm *VM, call bootstrapCall) (javaValue, error) {
+	if !isReferenceType(call.descriptor) {
+		return nil, fmt.Errorf("not reference: %s", typeName(call.descriptor))
+	}
+	return javaObject{}, nil
+}
+
+// constantPrimitiveClass implements ConstantBootstraps.primitiveClass, which
+// is named after the descriptor of the primitive type.
+func constantPrimitiveClass(vm *VM, call bootstrapCall) (javaValue, error) {
+	if call.descriptor != "Ljava/lang/Class;" {
+		return nil, fmt.Errorf("primitiveClass must be a Class, not %s", typeName(call.descriptor))
+	}
+	if len(call.name) != 1 || primitiveDescriptors[typeName(call.name)] != call.name {
+		return nil, fmt.Errorf("not a primitive type descriptor: %s", call.name)
+	}
+	return vm.classMirror(call.name), nil
+}
+
+// constantEnum implements ConstantBootstraps.enumConstant.
+func constantEnum(vm *VM, call bootstrapCall) (javaValue, error) {
+	if call.descriptor[0] != 'L' {
+		return nil, fmt.Errorf("%s is not an enum", typeName(call.descriptor))
+	}
+	class, err := vm.resolveClassFrom(call.caller, internalName(call.descriptor))
+	if err != nil {
+		return nil, err
+	}
+	if class.AccessFlags&Enum == 0 {
+		return nil, fmt.Errorf("%s is not an enum", typeName(call.descriptor))
+	}
+	vm.initClass(class)
+	f := class.findField(call.name, call.descriptor)
+	if f == nil || f.accessFlags&(Static|Enum) != Static|Enum {
+		return nil, fmt.Errorf("No enum constant %s.%s", typeName(call.descriptor), call.name)
+	}
+	return f.value, nil
+}
+
+// constantStaticFinal implements ConstantBootstraps.getStaticFinal. The field
+// is in the class given as the static argument, or else in the class of its
+// type or the wrapper class of its primitive type.
+func constantStaticFinal(vm *VM, call bootstrapCall) (javaValue, error) {
+	declaringClass := internalName(call.descriptor)
+	if box, ok := primitiveBoxes[call.descriptor[0]]; ok && len(call.descriptor) == 1 {
+		declaringClass = box.class
+	}
+	if len(call.arguments) > 0 {
+		c, ok := call.arguments[0].(classInfo)
+		if !ok {
+			return nil, fmt.Errorf("getStaticFinal expected a class, not %v", call.arguments[0])
+		}
+		declaringClass = c.className()
+	}
+	class, err := vm.resolveClassFrom(call.caller, declaringClass)
+	if err != nil {
+		return nil, err
+	}
+	f := vm.resolveField(class, call.name, call.descriptor)
+	if f == nil || f.accessFlags&Static == 0 {
+		return nil, fmt.Errorf("no such field: %s.%s/%s/getStatic", typeName(classDescriptor(declaringClass)), call.name, simpleTypeName(call.descriptor))
+	}
+	if f.accessFlags&Final == 0 {
+		return nil, fmt.Errorf("Field %s.%s is not final", typeName(classDescriptor(declaringClass)), call.name)
+	}
+	vm.initClass(f.class)
+	return f.value, nil
+}
+
+// constantInvoke implements ConstantBootstraps.invoke, which calls the method
+// handle given as the first static argument with the others.
+func constantInvoke(vm *VM, call bootstrapCall) (javaValue, error) {
+	if len(call.arguments) == 0 {
+		return nil, fmt.Errorf("invoke needs a method handle")
+	}
+	var types []string
+	var args []javaValue
+	for i, item := range call.arguments {
+		v, err := call.argument(vm, i)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, constantType(item))
+		args = append(args, v)
+	}
+	handle, ok := args[0].(javaObject)
+	if !ok || handle.isNull() {
+		return nil, fmt.Errorf("invoke needs a method handle, not %v", call.arguments[0])
+	}
+	target, ok := handle.hidden.(handleTarget)
+	if !ok {
+		return nil, fmt.Errorf("invoke needs a method handle, not %v", handle)
+	}
+	return vm.callHandle(target, types[1:], args[1:], call.descriptor)
+}
@@ -0,0 +1,139 @@
+package java
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func (w *classWriter) integer(v int32) uint16 {
+	return w.constant(fmt.Sprintf("int %d", v), func() {
+		w.u1(3)
+		binary.Write(&w.constants, binary.BigEndian, v)
+	})
+}
+
+// constantField adds a static final field whose ConstantValue attribute gives
+// it the constant at index value.
+func (c *testClass) constantField(name, descriptor string, value uint16) {
+	c.field(Public|Static|Final, name, descriptor)
+	c.utf8("ConstantValue")
+	f := &c.fields[len(c.fields)-1]
+	f.attributes = append(f.attributes, attribute{"ConstantValue", u2s(value)})
+}
+
+const (
+	lookupDescriptor   = "Ljava/lang/invoke/MethodHandles$Lookup;"
+	bootstrapArguments = "(" + lookupDescriptor + "Ljava/lang/String;Ljava/lang/Class;"
+)
+
+func TestDynamicConstants(t *testing.T) {
+	lookup := newTestClass(Public|Final|Super, "java/lang/invoke/MethodHandles$Lookup", "java/lang/Object")
+	handle := newTestClass(Public|Abstract|Super, "java/lang/invoke/MethodHandle", "java/lang/Object")
+
+	colour := newTestClass(Public|Final|Super|Enum, "Colour", "java/lang/Object")
+	colour.field(Public|Static|Final|Enum, "RED", "LColour;")
+	colour.field(Public|Static|Final, "GREEN", "LColour;")
+	colour.constructor("java/lang/Object", "()V")
+	colour.code(Static, "<clinit>", "()V", 0, func(a *assembler) {
+		a.class("new", "Colour")
+		a.op("dup")
+		a.invoke("invokespecial", "Colour", "<init>", "()V")
+		a.field("putstatic", "Colour", "RED", "LColour;")
+		a.op("return")
+	})
+
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.constantField("ANSWER", "I", main.integer(42))
+	main.constantField("GREETING", "Ljava/lang/String;", main.string("hi\n"))
+	main.code(Static, "twice", "(I)I", 1, func(a *assembler) {
+		a.op("iload_0")
+		a.op("iconst_2")
+		a.op("imul")
+		a.op("ireturn")
+	})
+	main.code(Static, "named", bootstrapArguments+")Ljava/lang/String;", 3, func(a *assembler) {
+		a.op("aload_1")
+		a.op("areturn")
+	})
+	throws := func(name, class string) {
+		main.code(Static, name, bootstrapArguments+")Ljava/lang/String;", 3, func(a *assembler) {
+			a.class("new", class)
+			a.op("dup")
+			a.ldc(name)
+			a.invoke("invokespecial", class, "<init>", "(Ljava/lang/String;)V")
+			a.op("athrow")
+		})
+	}
+	throws("fails", "java/lang/IllegalArgumentException")
+	throws("breaks", "java/lang/NoSuchFieldError")
+
+	constants := "java/lang/invoke/ConstantBootstraps"
+	nullConstant := main.bootstrap(constants, "nullConstant", bootstrapArguments+")Ljava/lang/Object;")
+	primitiveClass := main.bootstrap(constants, "primitiveClass", bootstrapArguments+")Ljava/lang/Class;")
+	enumConstant := main.bootstrap(constants, "enumConstant", bootstrapArguments+")Ljava/lang/Enum;")
+	getStaticFinal := main.bootstrap(constants, "getStaticFinal", bootstrapArguments+"Ljava/lang/Class;)Ljava/lang/Object;",
+		main.class("Main"))
+	invoke := main.bootstrap(constants, "invoke", bootstrapArguments+"Ljava/lang/invoke/MethodHandle;[Ljava/lang/Object;)Ljava/lang/Object;",
+		main.methodHandle(refInvokeStatic, "Main", "twice", "(I)I"), main.integer(21))
+	named := main.bootstrap("Main", "named", bootstrapArguments+")Ljava/lang/String;")
+	fails := main.bootstrap("Main", "fails", bootstrapArguments+")Ljava/lang/String;")
+	breaks := main.bootstrap("Main", "breaks", bootstrapArguments+")Ljava/lang/String;")
+
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 2, func(a *assembler) {
+		print := func() {
+			a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		}
+		ldc := func(bsm uint16, name, descriptor string) {
+			a.index("ldc_w", a.w.dynamic(dynamicTag, bsm, name, descriptor))
+		}
+
+		ldc(nullConstant, "_", "Ljava/lang/Object;")
+		a.branch("ifnonnull", "notNull")
+		a.ldc("null\n")
+		print()
+		a.label("notNull")
+
+		ldc(primitiveClass, "I", "Ljava/lang/Class;")
+		a.invoke("invokevirtual", "java/lang/Class", "getName", "()Ljava/lang/String;")
+		print()
+
+		ldc(enumConstant, "RED", "LColour;")
+		a.field("getstatic", "Colour", "RED", "LColour;")
+		a.branch("if_acmpne", "notRed")
+		a.ldc("\nred\n")
+		print()
+		a.label("notRed")
+
+		ldc(getStaticFinal, "ANSWER", "I")
+		a.invoke("invokestatic", "Main", "printInt", "(I)V")
+		ldc(getStaticFinal, "GREETING", "Ljava/lang/String;")
+		print()
+		ldc(invoke, "_", "I")
+		a.invoke("invokestatic", "Main", "printInt", "(I)V")
+		ldc(named, "hello", "Ljava/lang/String;")
+		print()
+		a.ldc("\n")
+		print()
+
+		a.printThrows(
+			func() { ldc(enumConstant, "BLUE", "LColour;") },
+			func() { ldc(enumConstant, "GREEN", "LColour;") },
+			func() { ldc(enumConstant, "RED", "Ljava/lang/String;") },
+			func() { ldc(fails, "_", "Ljava/lang/String;") },
+			func() { ldc(breaks, "_", "Ljava/lang/String;") },
+		)
+		a.op("return")
+	})
+
+	got := run(newTestVM(t, lookup, handle, colour, main), "Main")
+	want := "null\nint\nred\n42\nhi\n42\nhello\n" +
+		"java.lang.BootstrapMethodError: No enum constant Colour.BLUE\n" +
+		"java.lang.BootstrapMethodError: No enum constant Colour.GREEN\n" +
+		"java.lang.BootstrapMethodError: java.lang.String is not an enum\n" +
+		"java.lang.BootstrapMethodError: bootstrap method initialization exception: java.lang.IllegalArgumentException\n" +
+		"java.lang.NoSuchFieldError: breaks\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,428 @@
+package java
+
+import (
+	"io"
+	"log"
+	"time"
+	"unsafe"
+)
+
+// minHeap is how big the heap may grow before it is first collected.
+const minHeap = 4 << 20
+
+// DefaultMaxHeap is the most the objects on the heap may take up unless
+// SetMaxHeap says otherwise.
+const DefaultMaxHeap = 1 << 30
+
+// heap keeps account of the objects and arrays the VM allocates. It knows
+// every one of them, so that the collector can let go of those nothing
+// reaches any more, and it caps the memory they take up when the VM has a
+// maximum heap size.
+type heap struct {
+	// objects are the objects and arrays allocated and not yet collected.
+	objects []javaReference
+	// used is the size of objects in bytes, and limit the most it may come
+	// to.
+	used, limit int64
+	// next is how big used may get before the heap is collected again.
+	next int64
+	// handles hold on to what the Go code of the VM is working with until
+	// it has stored it somewhere the collector looks.
+	handles []javaValue
+	// stacks are the frames being run by each call of execute.
+	stacks []**Frame
+	// referentSlot is the slot of the referent of a Reference.
+	referentSlot int
+	// finalizable are the objects whose finalizers are to run once they are
+	// unreachable. The collector doesn't count them as reachable from here.
+	finalizable []javaObject
+	// finalizing are the objects found unreachable whose finalizers haven't
+	// run yet, and pending the references cleared but not yet enqueued.
+	// blocked are the objects whose finalizers had to wait for the main
+	// thread, to be finalized the next time round.
+	finalizing []javaObject
+	pending    []javaObject
+	blocked    []javaObject
+	// processing is set while the pending references and finalizers are
+	// being dealt with.
+	processing bool
+	stats      HeapStats
+}
+
+// HeapStats describes the heap and the work the garbage collector has done.
+type HeapStats struct {
+	// Used is the size in bytes of the objects on the heap and Limit the
+	// most it may grow to.
+	Used, Limit int64
+	// Objects is the number of objects and arrays on the heap.
+	Objects int
+	// Allocated is the size of all the objects ever allocated.
+	Allocated int64
+	// Collections is how many times the heap has been collected, freeing
+	// FreedObjects objects that took up Freed bytes.
+	Collections  int
+	FreedObjects int
+	Freed        int64
+	// Pause is the time spent collecting.
+	Pause time.Duration
+}
+
+// SetMaxHeap limits the size of the objects on the heap to bytes, or to
+// DefaultMaxHeap if bytes isn't positive. Allocating more than that throws
+// OutOfMemoryError.
+func (vm *VM) SetMaxHeap(bytes int64) {
+	if bytes <= 0 {
+		bytes = DefaultMaxHeap
+	}
+	vm.heap.limit = bytes
+}
+
+// HeapStats returns how big the heap is and what the collector has done.
+func (vm *VM) HeapStats() HeapStats {
+	stats := vm.heap.stats
+	stats.Used = vm.heap.used
+	stats.Limit = vm.heap.limit
+	stats.Objects = len(vm.heap.objects)
+	return stats
+}
+
+// allocate puts r, which takes up size bytes, on the heap.
+func (vm *VM) allocate(r javaReference, size int64) {
+	vm.heap.objects = append(vm.heap.objects, r)
+	vm.heap.used += size
+	vm.heap.stats.Allocated += size
+	vm.heap.handles = append(vm.heap.handles, r.(javaValue))
+}
+
+// keep holds on to values while the Go code of the VM works with them.
+func (vm *VM) keep(values ...javaValue) {
+	vm.heap.handles = append(vm.heap.handles, values...)
+}
+
+// reserve makes room for size more bytes of objects, collecting the heap if
+// it is time to. Soft references are only cleared if there isn't room
+// otherwise. It reports false if the objects don't fit under the limit. The
+// caller mustn't hold references the collector can't see, so it keeps what
+// it has taken off the stack first.
+//
+// The instructions that allocate reserve, and so does the VM code that makes
+// objects for the program as it runs: string concatenations, lambdas and the
+// results of the natives of java.lang.invoke. The objects the VM makes for
+// itself don't, and can take the heap over its limit. Those are class
+// mirrors, modules, interned strings, the values of constants, which are
+// only resolved once, and the exceptions the VM throws.
+func (vm *VM) reserve(size int64) bool {
+	h := &vm.heap
+	if h.used+size > h.next || h.full(size) {
+		vm.collect(false)
+		if h.full(size) {
+			vm.collect(true)
+		}
+		vm.processReferences()
+	}
+	return !h.full(size)
+}
+
+// reserveNative reserves size bytes for the objects the native running in f
+// makes, having it throw OutOfMemoryError if they don't fit.
+func (vm *VM) reserveNative(f *Frame, size int64) bool {
+	if vm.reserve(size) {
+		return true
+	}
+	f.thrown = vm.outOfMemoryError()
+	return false
+}
+
+// full reports whether size more bytes would take the heap over its limit.
+func (h *heap) full(size int64) bool {
+	return h.used+size > h.limit
+}
+
+// collect marks the objects the roots reach and sweeps the rest off the heap.
+// Marking clears the references to objects that are no longer strongly
+// reachable as it goes, soft ones too if clearSoft is set.
+func (vm *VM) collect(clearSoft bool) {
+	start := time.Now()
+	h := &vm.heap
+	m := &marker{clearSoft: clearSoft, referentSlot: h.referentSlot}
+	vm.roots(m.visit)
+	m.drain()
+	vm.clearReferences(m.weak)
+	if len(h.finalizable) > 0 {
+		// Objects with finalizers are kept until they have run, along with
+		// everything they reach.
+		finalizable := h.finalizable[:0]
+		for _, o := range h.finalizable {
+			if o.marked {
+				finalizable = append(finalizable, o)
+			} else {
+				h.finalizing = append(h.finalizing, o)
+				m.visit(o)
+			}
+		}
+		for i := len(finalizable); i < len(h.finalizable); i++ {
+			h.finalizable[i] = javaObject{}
+		}
+		h.finalizable = finalizable
+		m.weak = nil
+		m.drain()
+		vm.clearReferences(m.weak)
+	}
+	vm.clearReferences(m.phantom)
+	live := h.objects[:0]
+	for _, r := range h.objects {
+		if o := headerOf(r); o.marked {
+			o.marked = false
+			live = append(live, r)
+			continue
+		}
+		size := sizeOf(r)
+		h.used -= size
+		h.stats.Freed += size
+		h.stats.FreedObjects++
+	}
+	for i := len(live); i < len(h.objects); i++ {
+		h.objects[i] = nil
+	}
+	h.objects = live
+	h.next = 2 * h.used
+	if h.next < minHeap {
+		h.next = minHeap
+	}
+	h.stats.Collections++
+	h.stats.Pause += time.Since(start)
+}
+
+// marker sets the marks of the objects a collection finds reachable. It
+// doesn't follow the referents of references, but keeps the references to
+// clear those of them it doesn't reach some other way.
+type marker struct {
+	gray         []javaReference
+	weak         []javaObject
+	phantom      []javaObject
+	clearSoft    bool
+	referentSlot int
+}
+
+// visit marks the object v refers to, if it isn't marked yet.
+func (m *marker) visit(v javaValue) {
+	r, ok := v.(javaReference)
+	if !ok || r.isNull() {
+		return
+	}
+	if o := headerOf(r); !o.marked {
+		o.marked = true
+		m.gray = append(m.gray, r)
+	}
+}
+
+// drain marks everything the objects marked so far reach.
+func (m *marker) drain() {
+	for len(m.gray) > 0 {
+		r := m.gray[len(m.gray)-1]
+		m.gray = m.gray[:len(m.gray)-1]
+		switch r := r.(type) {
+		case javaObject:
+			kind := r.class().reference
+			for i, v := range r.fields {
+				if i == m.referentSlot && kind != strongReference && (kind != softReference || m.clearSoft) {
+					if kind == phantomReference {
+						m.phantom = append(m.phantom, r)
+					} else {
+						m.weak = append(m.weak, r)
+					}
+					continue
+				}
+				m.visit(v)
+			}
+			for _, v := range r.extraFields {
+				m.visit(v)
+			}
+		case javaArray:
+			if t := r.elementType[0]; t == 'L' || t == '[' {
+				for _, v := range r.contents {
+					m.visit(v)
+				}
+			}
+		}
+	}
+}
+
+// roots calls visit with every value the collector starts from: what the
+// frames being run hold, the static fields and the values the VM holds on to
+// itself.
+func (vm *VM) roots(visit func(javaValue)) {
+	for _, f := range vm.activeFrames() {
+		frameValues(f, visit)
+	}
+	for _, c := range vm.classes {
+		for i := range c.fields {
+			if c.fields[i].value != nil {
+				visit(c.fields[i].value)
+			}
+		}
+	}
+	vm.internalRoots(visit)
+}
+
+// activeFrames lists the frames being run, the one running first, including
+// the root frames the VM calls methods from.
+func (vm *VM) activeFrames() []*Frame {
+	var frames []*Frame
+	seen := make(map[*Frame]bool)
+	add := func(f *Frame) {
+		for ; f != nil && !seen[f]; f = f.PreviousFrame {
+			seen[f] = true
+			frames = append(frames, f)
+		}
+	}
+	for i := len(vm.heap.stacks) - 1; i >= 0; i-- {
+		add(*vm.heap.stacks[i])
+	}
+	add(vm.frame)
+	return frames
+}
+
+// frameValues calls visit with the values in the local variables and on the
+// operand stack of f.
+func frameValues(f *Frame, visit func(javaValue)) {
+	for _, v := range f.Items {
+		visit(v)
+	}
+	for _, v := range f.Variables {
+		visit(v)
+	}
+	visit(f.thrown)
+}
+
+// internalRoots calls visit with the values the VM holds on to for its own
+// use: the ones it keeps for classes, including the exceptions of failed
+// bootstrap methods, the interned strings, the handles and the objects
+// waiting for the reference handler or a finalizer.
+func (vm *VM) internalRoots(visit func(javaValue)) {
+	for _, c := range vm.classes {
+		for _, r := range c.resolvedConstants {
+			if r.value != nil {
+				visit(r.value)
+			}
+			if e, ok := r.err.(thrownError); ok {
+				visit(e.throwable)
+			}
+		}
+		for i := range c.methods {
+			for _, site := range c.methods[i].callSites {
+				visit(site.instance)
+			}
+		}
+	}
+	for _, m := range vm.modules {
+		if m.object != nil {
+			visit(*m.object)
+		}
+	}
+	if vm.unnamedModule.object != nil {
+		visit(*vm.unnamedModule.object)
+	}
+	for _, mirror := range vm.mirrors {
+		visit(mirror)
+	}
+	for _, s := range vm.internedStrings {
+		visit(s)
+	}
+	for _, v := range vm.heap.handles {
+		visit(v)
+	}
+	for _, o := range vm.heap.finalizing {
+		visit(o)
+	}
+	for _, o := range vm.heap.blocked {
+		visit(o)
+	}
+	for _, ref := range vm.heap.pending {
+		visit(ref)
+	}
+}
+
+// headerOf returns the header of the non-null reference r.
+func headerOf(r javaReference) *header {
+	switch r := r.(type) {
+	case javaObject:
+		return &r.header
+	case javaArray:
+		return &r.header
+	}
+	log.Panicf("Unknown reference type %T", r)
+	return nil
+}
+
+// Objects and arrays are charged for the memory the VM holds them in: an
+// object or array struct, and a javaValue for each field or element.
+const (
+	objectHeaderSize = int64(unsafe.Sizeof(object{}))
+	arrayHeaderSize  = int64(unsafe.Sizeof(array{}))
+	valueSize        = int64(unsafe.Sizeof(javaValue(nil)))
+)
+
+// sizeOf is how many bytes the non-null reference r takes up on the heap.
+func sizeOf(r javaReference) int64 {
+	switch r := r.(type) {
+	case javaObject:
+		return r.class().instanceSize
+	case javaArray:
+		return arraySize(int64(len(r.contents)))
+	}
+	log.Panicf("Unknown reference type %T", r)
+	return 0
+}
+
+// stringSize is how many bytes nativeStringToJavaString takes up for s: a
+// String and its array of UTF-16 code units.
+func (vm *VM) stringSize(s string) int64 {
+	units := int64(0)
+	for _, r := range s {
+		units++
+		if r >= 0x10000 {
+			units++
+		}
+	}
+	return vm.instanceSize(vm.resolveClass("java/lang/String")) + arraySize(units)
+}
+
+// arraySize is how many bytes an array of n elements takes up.
+func arraySize(n int64) int64 {
+	return align(arrayHeaderSize + n*valueSize)
+}
+
+// align rounds size up to the 8 bytes objects are aligned to.
+func align(size int64) int64 {
+	return (size + 7) &^ 7
+}
+
+func nativeGC(vm *VM, f *Frame, w io.Writer) {
+	vm.collect(false)
+	vm.processReferences()
+}
+
+func nativeMaxMemory(vm *VM, f *Frame, w io.Writer) {
+	f.PreviousFrame.pushInt64(vm.heap.limit)
+}
+
+func nativeTotalMemory(vm *VM, f *Frame, w io.Writer) {
+	f.PreviousFrame.pushInt64(vm.totalMemory())
+}
+
+func nativeFreeMemory(vm *VM, f *Frame, w io.Writer) {
+	f.PreviousFrame.pushInt64(vm.totalMemory() - vm.heap.used)
+}
+
+// totalMemory is how big the heap is allowed to get before it is collected.
+func (vm *VM) totalMemory() int64 {
+	total := vm.heap.next
+	if total > vm.heap.limit {
+		total = vm.heap.limit
+	}
+	if total < vm.heap.used {
+		total = vm.heap.used
+	}
+	return total
+}
@@ -0,0 +1,31 @@
+package java
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeClass writes the class w builds to its file under dir, the way javac
+// lays out a class path, and returns the path of the file.
+func writeClass(t *testing.T, dir, name string, w *classWriter) string {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(name)+".class")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, w.bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// u2s encodes values the way class files do.
+func u2s(values ...uint16) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, values)
+	return b.Bytes()
+}
@@ -0,0 +1,550 @@
+package java
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The tags of the HPROF records and of the sub-records of heap dump segments.
+const (
+	hprofString          = 0x01
+	hprofLoadClass       = 0x02
+	hprofStackFrame      = 0x04
+	hprofStackTrace      = 0x05
+	hprofHeapDumpSegment = 0x1c
+	hprofHeapDumpEnd     = 0x2c
+
+	hprofRootUnknown     = 0xff
+	hprofRootJNILocal    = 0x02
+	hprofRootJavaFrame   = 0x03
+	hprofRootStickyClass = 0x05
+	hprofClassDump       = 0x20
+	hprofInstanceDump    = 0x21
+	hprofObjectArrayDump = 0x22
+	hprofPrimitiveArray  = 0x23
+)
+
+// Every class and object is put down as allocated at the empty stack trace,
+// and the main thread runs the other one.
+const (
+	hprofNoStackTrace   = 1
+	hprofMainStackTrace = 2
+	hprofMainThread     = 1
+)
+
+// hprofSegmentSize is how big a heap dump segment may grow before a new one
+// is started.
+const hprofSegmentSize = 1 << 20
+
+// hprofTypes are the HPROF basic types of the values of the types whose
+// descriptors start with each letter.
+var hprofTypes = map[byte]uint8{
+	'L': 2, '[': 2, 'Z': 4, 'C': 5, 'F': 6, 'D': 7, 'B': 8, 'S': 9, 'I': 10, 'J': 11,
+}
+
+// heapDumps are the heap dumps asked for by RequestHeapDump, which the VM
+// writes when it next gets to the start of an instruction or Run returns.
+type heapDumps struct {
+	sync.Mutex
+	requested int32
+	queue     []heapDumpRequest
+}
+
+type heapDumpRequest struct {
+	create func() (io.WriteCloser, error)
+	done   chan error
+}
+
+// DumpHeap writes everything on the heap to w in the HPROF format heap
+// analyzers read: the classes with their static fields, the objects and
+// arrays with their contents, and the roots in the frames being run. It
+// mustn't be called while the VM is running on another goroutine, which
+// RequestHeapDump is for.
+func (vm *VM) DumpHeap(w io.Writer) error {
+	d := &heapDumper{
+		vm:       vm,
+		w:        bufio.NewWriter(w),
+		ids:      make(map[*header]uint64),
+		strings:  make(map[string]uint64),
+		classIDs: make(map[string]uint64),
+		mirrors:  make(map[*header]bool),
+	}
+	d.dump()
+	return d.w.Flush()
+}
+
+// RequestHeapDump asks the VM to dump its heap when it gets to the start of
+// the next instruction, or when Run returns if that comes first, to the
+// writer create makes then. It returns the channel the error of the dump is
+// sent on once it has been written. It may be called from any goroutine.
+func (vm *VM) RequestHeapDump(create func() (io.WriteCloser, error)) <-chan error {
+	done := make(chan error, 1)
+	vm.heapDumps.Lock()
+	vm.heapDumps.queue = append(vm.heapDumps.queue, heapDumpRequest{create, done})
+	vm.heapDumps.Unlock()
+	atomic.StoreInt32(&vm.heapDumps.requested, 1)
+	return done
+}
+
+// dumpRequestedHeaps writes the heap dumps that have been asked for.
+func (vm *VM) dumpRequestedHeaps() {
+	vm.heapDumps.Lock()
+	queue := vm.heapDumps.queue
+	vm.heapDumps.queue = nil
+	atomic.StoreInt32(&vm.heapDumps.requested, 0)
+	vm.heapDumps.Unlock()
+	for _, r := range queue {
+		r.done <- vm.dumpHeapTo(r.create)
+	}
+}
+
+// dumpHeapTo dumps the heap to the writer create makes and closes it.
+func (vm *VM) dumpHeapTo(create func() (io.WriteCloser, error)) error {
+	w, err := create()
+	if err != nil {
+		return err
+	}
+	err = vm.DumpHeap(w)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SetHeapDumpOnOutOfMemory makes the VM dump the heap the first time it runs
+// out of memory, to the writer create makes.
+func (vm *VM) SetHeapDumpOnOutOfMemory(create func() (io.WriteCloser, error)) {
+	vm.heapDumpOnOutOfMemory = create
+}
+
+// throwOutOfMemory throws OutOfMemoryError from the instruction executing in
+// f.
+func (vm *VM) throwOutOfMemory(f *Frame) *Frame {
+	return handleException(vm, f, vm.outOfMemoryError())
+}
+
+// outOfMemoryError makes the OutOfMemoryError thrown when the heap is full,
+// dumping the heap first if it should.
+func (vm *VM) outOfMemoryError() javaObject {
+	if create := vm.heapDumpOnOutOfMemory; create != nil {
+		vm.heapDumpOnOutOfMemory = nil
+		if err := vm.dumpHeapTo(create); err != nil {
+			log.Printf("Unable to dump the heap: %v", err)
+		}
+	}
+	return vm.newThrowable("java/lang/OutOfMemoryError", "Java heap space")
+}
+
+// hprofBuffer builds HPROF records, which are big-endian.
+type hprofBuffer struct {
+	bytes.Buffer
+}
+
+func (b *hprofBuffer) u1(v uint8) {
+	b.WriteByte(v)
+}
+
+func (b *hprofBuffer) u2(v uint16) {
+	b.Write([]byte{byte(v >> 8), byte(v)})
+}
+
+func (b *hprofBuffer) u4(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	b.Write(buf[:])
+}
+
+func (b *hprofBuffer) u8(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	b.Write(buf[:])
+}
+
+// heapDumper writes a heap dump. Identifiers are 8 bytes long, and objects
+// and classes get theirs the first time they are written. The class mirrors
+// stand for their classes, so they are written as classes, not objects.
+type heapDumper struct {
+	vm       *VM
+	w        *bufio.Writer
+	lastID   uint64
+	ids      map[*header]uint64
+	strings  map[string]uint64
+	classIDs map[string]uint64
+	mirrors  map[*header]bool
+	// classes are the descriptors of the classes, in the order of their
+	// serial numbers.
+	classes []string
+	segment hprofBuffer
+}
+
+func (d *heapDumper) dump() {
+	vm := d.vm
+	d.w.WriteString("JAVA PROFILE 1.0.2\x00")
+	var header hprofBuffer
+	header.u4(8)
+	header.u8(uint64(time.Now().UnixNano() / int64(time.Millisecond)))
+	d.w.Write(header.Bytes())
+
+	// Laying the classes out can load more of them, which need to be
+	// written too.
+	for i := 0; i < len(vm.classes); i++ {
+		vm.fieldLayout(vm.classes[i])
+	}
+	classes := append([]*Class(nil), vm.classes...)
+	for _, c := range classes {
+		d.classes = append(d.classes, "L"+c.Name()+";")
+	}
+	arrays := make(map[string]bool)
+	for _, r := range vm.heap.objects {
+		if a, ok := r.(javaArray); ok && !arrays[descriptorOf(a)] {
+			arrays[descriptorOf(a)] = true
+			d.classes = append(d.classes, descriptorOf(a))
+		}
+	}
+	for descriptor, mirror := range vm.mirrors {
+		if descriptor[0] == '[' && !arrays[descriptor] {
+			arrays[descriptor] = true
+			d.classes = append(d.classes, descriptor)
+		}
+		if descriptor[0] == 'L' || descriptor[0] == '[' {
+			d.mirrors[&mirror.header] = true
+		}
+	}
+	serials := make(map[string]uint32)
+	for i, descriptor := range d.classes {
+		serials[descriptor] = uint32(i + 1)
+		var b hprofBuffer
+		b.u4(uint32(i + 1))
+		b.u8(d.classID(descriptor))
+		b.u4(hprofNoStackTrace)
+		b.u8(d.str(internalName(descriptor)))
+		d.record(hprofLoadClass, &b)
+	}
+
+	var empty hprofBuffer
+	empty.u4(hprofNoStackTrace)
+	empty.u4(0)
+	empty.u4(0)
+	d.record(hprofStackTrace, &empty)
+	frames := vm.activeFrames()
+	numbers := d.stackTrace(frames, serials)
+
+	for _, f := range frames {
+		tag, number := uint8(hprofRootJavaFrame), numbers[f]
+		if f.Root {
+			tag = hprofRootJNILocal
+		}
+		frameValues(f, func(v javaValue) {
+			if r, ok := v.(javaReference); ok && !r.isNull() {
+				d.segment.u1(tag)
+				d.segment.u8(d.objectID(v))
+				d.segment.u4(hprofMainThread)
+				d.segment.u4(number)
+				d.endSubRecord()
+			}
+		})
+	}
+	for _, descriptor := range d.classes {
+		d.segment.u1(hprofRootStickyClass)
+		d.segment.u8(d.classID(descriptor))
+		d.endSubRecord()
+	}
+	vm.internalRoots(func(v javaValue) {
+		if r, ok := v.(javaReference); ok && !r.isNull() && !d.mirrors[headerOf(r)] {
+			d.segment.u1(hprofRootUnknown)
+			d.segment.u8(d.objectID(v))
+			d.endSubRecord()
+		}
+	})
+
+	for _, c := range classes {
+		d.classDump(c)
+	}
+	for descriptor := range arrays {
+		d.arrayClassDump(descriptor)
+	}
+	for _, r := range vm.heap.objects {
+		switch r := r.(type) {
+		case javaObject:
+			if !d.mirrors[&r.header] {
+				d.instanceDump(r)
+			}
+		case javaArray:
+			d.arrayDump(r)
+		}
+	}
+	d.flushSegment()
+	d.record(hprofHeapDumpEnd, &hprofBuffer{})
+}
+
+// stackTrace writes the frames being run as the stack trace of the main
+// thread. It returns the number of each frame in it. The root frames get the
+// number of the frame the VM was running when it called from them, and
+// native frames have the line number -3.
+func (d *heapDumper) stackTrace(frames []*Frame, serials map[string]uint32) map[*Frame]uint32 {
+	var trace hprofBuffer
+	numbers := make(map[*Frame]uint32)
+	var count uint32
+	for _, f := range frames {
+		if f.Root {
+			continue
+		}
+		numbers[f] = count
+		count++
+		id := d.newID()
+		var b hprofBuffer
+		b.u8(id)
+		b.u8(d.str(f.Method.Name()))
+		b.u8(d.str(f.Method.RawSigniture))
+		b.u8(d.str(""))
+		b.u4(serials["L"+f.Method.Class().Name()+";"])
+		if f.Method.Native() {
+			b.u4(math.MaxUint32 - 2)
+		} else {
+			b.u4(math.MaxUint32)
+		}
+		d.record(hprofStackFrame, &b)
+		trace.u8(id)
+	}
+	next := uint32(math.MaxUint32)
+	for i := len(frames) - 1; i >= 0; i-- {
+		if n, ok := numbers[frames[i]]; ok {
+			next = n
+		} else {
+			numbers[frames[i]] = next
+		}
+	}
+	var b hprofBuffer
+	b.u4(hprofMainStackTrace)
+	b.u4(hprofMainThread)
+	b.u4(count)
+	b.Write(trace.Bytes())
+	d.record(hprofStackTrace, &b)
+	return numbers
+}
+
+func (d *heapDumper) classDump(c *Class) {
+	vm := d.vm
+	b := &d.segment
+	b.u1(hprofClassDump)
+	b.u8(d.classID("L" + c.Name() + ";"))
+	b.u4(hprofNoStackTrace)
+	if super := vm.superclass(c); super != nil {
+		b.u8(d.classID("L" + super.Name() + ";"))
+	} else {
+		b.u8(0)
+	}
+	for i := 0; i < 5; i++ {
+		// The class loader, signers, protection domain and two reserved
+		// identifiers.
+		b.u8(0)
+	}
+	b.u4(uint32(vm.instanceSize(c)))
+	b.u2(0)
+	var statics, instance []*field
+	for i := range c.fields {
+		if c.fields[i].accessFlags&Static != 0 {
+			statics = append(statics, &c.fields[i])
+		} else {
+			instance = append(instance, &c.fields[i])
+		}
+	}
+	b.u2(uint16(len(statics)))
+	for _, f := range statics {
+		b.u8(d.str(f.name()))
+		b.u1(hprofTypes[f.descriptor()[0]])
+		value := f.value
+		if value == nil {
+			value = fieldDefaultValue(f.descriptor())
+		}
+		d.value(b, f.descriptor(), value)
+	}
+	b.u2(uint16(len(instance)))
+	for _, f := range instance {
+		b.u8(d.str(f.name()))
+		b.u1(hprofTypes[f.descriptor()[0]])
+	}
+	d.endSubRecord()
+}
+
+// arrayClassDump writes the class of arrays of the type descriptor. Array
+// classes extend Object and have no fields.
+func (d *heapDumper) arrayClassDump(descriptor string) {
+	b := &d.segment
+	b.u1(hprofClassDump)
+	b.u8(d.classID(descriptor))
+	b.u4(hprofNoStackTrace)
+	b.u8(d.classID("Ljava/lang/Object;"))
+	for i := 0; i < 5; i++ {
+		b.u8(0)
+	}
+	b.u4(0)
+	b.u2(0)
+	b.u2(0)
+	b.u2(0)
+	d.endSubRecord()
+}
+
+// instanceDump writes o with the values of its fields, those of its class
+// first and then those of each superclass.
+func (d *heapDumper) instanceDump(o javaObject) {
+	var values hprofBuffer
+	for c := o.class(); c != nil; c = d.vm.superclass(c) {
+		for i := range c.fields {
+			if f := &c.fields[i]; f.accessFlags&Static == 0 {
+				d.value(&values, f.descriptor(), o.fields[f.slot])
+			}
+		}
+	}
+	b := &d.segment
+	b.u1(hprofInstanceDump)
+	b.u8(d.objectID(o))
+	b.u4(hprofNoStackTrace)
+	b.u8(d.classID("L" + o.class().Name() + ";"))
+	b.u4(uint32(values.Len()))
+	b.Write(values.Bytes())
+	d.endSubRecord()
+}
+
+func (d *heapDumper) arrayDump(a javaArray) {
+	b := &d.segment
+	if t := a.elementType[0]; t == 'L' || t == '[' {
+		b.u1(hprofObjectArrayDump)
+		b.u8(d.objectID(a))
+		b.u4(hprofNoStackTrace)
+		b.u4(uint32(len(a.contents)))
+		b.u8(d.classID(descriptorOf(a)))
+	} else {
+		b.u1(hprofPrimitiveArray)
+		b.u8(d.objectID(a))
+		b.u4(hprofNoStackTrace)
+		b.u4(uint32(len(a.contents)))
+		b.u1(hprofTypes[t])
+	}
+	for _, v := range a.contents {
+		d.value(b, a.elementType, v)
+	}
+	d.endSubRecord()
+}
+
+// value writes v, a value of the type descriptor, in as many bytes as the
+// type takes.
+func (d *heapDumper) value(b *hprofBuffer, descriptor string, v javaValue) {
+	switch descriptor[0] {
+	case 'L', '[':
+		b.u8(d.objectID(v))
+	case 'Z', 'B':
+		b.u1(uint8(primitiveBits(v)))
+	case 'C', 'S':
+		b.u2(uint16(primitiveBits(v)))
+	case 'I', 'F':
+		b.u4(uint32(primitiveBits(v)))
+	case 'J', 'D':
+		b.u8(primitiveBits(v))
+	}
+}
+
+// primitiveBits is the bit pattern of the primitive value v.
+func primitiveBits(v javaValue) uint64 {
+	switch v := v.(type) {
+	case javaBoolean:
+		if v {
+			return 1
+		}
+		return 0
+	case javaByte:
+		return uint64(uint8(v))
+	case javaChar:
+		return uint64(v)
+	case javaShort:
+		return uint64(uint16(v))
+	case javaInt:
+		return uint64(uint32(v))
+	case javaLong:
+		return uint64(v)
+	case javaFloat:
+		return uint64(math.Float32bits(float32(v)))
+	case javaDouble:
+		return math.Float64bits(float64(v))
+	}
+	log.Panicf("%v is not a primitive value", v)
+	return 0
+}
+
+func (d *heapDumper) newID() uint64 {
+	d.lastID += 8
+	return d.lastID
+}
+
+// objectID returns the identifier of the object v refers to, or 0 for null.
+func (d *heapDumper) objectID(v javaValue) uint64 {
+	r, ok := v.(javaReference)
+	if !ok || r.isNull() {
+		return 0
+	}
+	h := headerOf(r)
+	if id, ok := d.ids[h]; ok {
+		return id
+	}
+	id := d.newID()
+	d.ids[h] = id
+	return id
+}
+
+// classID returns the identifier of the class of the type descriptor, the
+// one of its mirror if it has one.
+func (d *heapDumper) classID(descriptor string) uint64 {
+	if mirror, ok := d.vm.mirrors[descriptor]; ok {
+		return d.objectID(mirror)
+	}
+	if id, ok := d.classIDs[descriptor]; ok {
+		return id
+	}
+	id := d.newID()
+	d.classIDs[descriptor] = id
+	return id
+}
+
+// str returns the identifier of s, writing it the first time.
+func (d *heapDumper) str(s string) uint64 {
+	if id, ok := d.strings[s]; ok {
+		return id
+	}
+	id := d.newID()
+	d.strings[s] = id
+	var b hprofBuffer
+	b.u8(id)
+	b.WriteString(s)
+	d.record(hprofString, &b)
+	return id
+}
+
+func (d *heapDumper) record(tag uint8, body *hprofBuffer) {
+	var header hprofBuffer
+	header.u1(tag)
+	header.u4(0)
+	header.u4(uint32(body.Len()))
+	d.w.Write(header.Bytes())
+	d.w.Write(body.Bytes())
+}
+
+// endSubRecord starts a new heap dump segment once this one is big enough.
+func (d *heapDumper) endSubRecord() {
+	if d.segment.Len() >= hprofSegmentSize {
+		d.flushSegment()
+	}
+}
+
+func (d *heapDumper) flushSegment() {
+	if d.segment.Len() > 0 {
+		d.record(hprofHeapDumpSegment, &d.segment)
+		d.segment.Reset()
+	}
+}
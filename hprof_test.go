@@ -0,0 +1,305 @@
+package java
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// hprofReader reads the big-endian values of an HPROF file.
+type hprofReader struct {
+	b []byte
+}
+
+func (r *hprofReader) u1() uint8 {
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *hprofReader) u2() uint16 {
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *hprofReader) u4() uint32 {
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *hprofReader) u8() uint64 {
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+// value reads a value of the HPROF basic type t, widened to 64 bits.
+func (r *hprofReader) value(t uint8) uint64 {
+	switch t {
+	case 2, 7, 11:
+		return r.u8()
+	case 4, 8:
+		return uint64(r.u1())
+	case 5, 9:
+		return uint64(r.u2())
+	}
+	return uint64(r.u4())
+}
+
+type hprofField struct {
+	name  string
+	t     uint8
+	value uint64
+}
+
+type hprofClass struct {
+	super    uint64
+	statics  []hprofField
+	instance []hprofField
+}
+
+type hprofArray struct {
+	class    uint64
+	t        uint8
+	elements []uint64
+}
+
+type hprofInstance struct {
+	class  uint64
+	values []byte
+}
+
+// hprofDump is what a heap dump says about the heap.
+type hprofDump struct {
+	idSize    uint32
+	strings   map[uint64]string
+	classIDs  map[string]uint64
+	classes   map[uint64]*hprofClass
+	instances map[uint64]hprofInstance
+	arrays    map[uint64]hprofArray
+	roots     int
+}
+
+func parseHeapDump(t *testing.T, b []byte) *hprofDump {
+	t.Helper()
+	const header = "JAVA PROFILE 1.0.2\x00"
+	if !bytes.HasPrefix(b, []byte(header)) {
+		t.Fatalf("heap dump starts with %q", b[:len(header)])
+	}
+	r := &hprofReader{b[len(header):]}
+	d := &hprofDump{
+		idSize:    r.u4(),
+		strings:   make(map[uint64]string),
+		classIDs:  make(map[string]uint64),
+		classes:   make(map[uint64]*hprofClass),
+		instances: make(map[uint64]hprofInstance),
+		arrays:    make(map[uint64]hprofArray),
+	}
+	r.u8()
+	ended := false
+	for len(r.b) > 0 {
+		tag := r.u1()
+		r.u4()
+		body := &hprofReader{r.b[:r.u4()]}
+		r.b = r.b[len(body.b):]
+		switch tag {
+		case hprofString:
+			id := body.u8()
+			d.strings[id] = string(body.b)
+		case hprofLoadClass:
+			body.u4()
+			id := body.u8()
+			body.u4()
+			d.classIDs[d.strings[body.u8()]] = id
+		case hprofHeapDumpSegment:
+			d.parseSegment(t, body)
+		case hprofHeapDumpEnd:
+			ended = true
+		}
+	}
+	if !ended {
+		t.Error("heap dump has no end record")
+	}
+	return d
+}
+
+func (d *hprofDump) parseSegment(t *testing.T, r *hprofReader) {
+	for len(r.b) > 0 {
+		switch tag := r.u1(); tag {
+		case hprofRootUnknown, hprofRootStickyClass:
+			r.u8()
+			d.roots++
+		case hprofRootJNILocal, hprofRootJavaFrame:
+			r.u8()
+			r.u4()
+			r.u4()
+			d.roots++
+		case hprofClassDump:
+			id := r.u8()
+			r.u4()
+			c := &hprofClass{super: r.u8()}
+			for i := 0; i < 5; i++ {
+				r.u8()
+			}
+			r.u4()
+			for i := r.u2(); i > 0; i-- {
+				r.u2()
+				r.value(r.u1())
+			}
+			for i := r.u2(); i > 0; i-- {
+				f := hprofField{name: d.strings[r.u8()], t: r.u1()}
+				f.value = r.value(f.t)
+				c.statics = append(c.statics, f)
+			}
+			for i := r.u2(); i > 0; i-- {
+				c.instance = append(c.instance, hprofField{name: d.strings[r.u8()], t: r.u1()})
+			}
+			d.classes[id] = c
+		case hprofInstanceDump:
+			id := r.u8()
+			r.u4()
+			o := hprofInstance{class: r.u8()}
+			o.values = r.b[:r.u4()]
+			r.b = r.b[len(o.values):]
+			d.instances[id] = o
+		case hprofObjectArrayDump, hprofPrimitiveArray:
+			id := r.u8()
+			r.u4()
+			a := hprofArray{elements: make([]uint64, r.u4()), t: 2}
+			if tag == hprofObjectArrayDump {
+				a.class = r.u8()
+			} else {
+				a.t = r.u1()
+			}
+			for i := range a.elements {
+				a.elements[i] = r.value(a.t)
+			}
+			d.arrays[id] = a
+		default:
+			t.Fatalf("unknown heap dump sub-record %#x", tag)
+		}
+	}
+}
+
+// static returns the value of the static field name of the class called
+// class.
+func (d *hprofDump) static(t *testing.T, class, name string) uint64 {
+	t.Helper()
+	c := d.classes[d.classIDs[class]]
+	if c == nil {
+		t.Fatalf("no class dump for %s", class)
+	}
+	for _, f := range c.statics {
+		if f.name == name {
+			return f.value
+		}
+	}
+	t.Fatalf("%s has no static field %s", class, name)
+	return 0
+}
+
+func TestHeapDump(t *testing.T) {
+	point := newTestClass(Public|Super, "Point", "java/lang/Object")
+	point.field(Public, "x", "I")
+	point.field(Public, "next", "LPoint;")
+	point.code(Public, "<init>", "(ILPoint;)V", 3, func(a *assembler) {
+		a.op("aload_0")
+		a.invoke("invokespecial", "java/lang/Object", "<init>", "()V")
+		a.op("aload_0")
+		a.op("iload_1")
+		a.field("putfield", "Point", "x", "I")
+		a.op("aload_0")
+		a.op("aload_2")
+		a.field("putfield", "Point", "next", "LPoint;")
+		a.op("return")
+	})
+
+	main := newTestClass(Public|Super, "Main", "java/lang/Object")
+	main.field(Public|Static, "point", "LPoint;")
+	main.field(Public|Static, "numbers", "[I")
+	main.field(Public|Static, "points", "[LPoint;")
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 2, func(a *assembler) {
+		a.class("new", "Point")
+		a.op("dup")
+		a.op("bipush", 7)
+		a.op("aconst_null")
+		a.invoke("invokespecial", "Point", "<init>", "(ILPoint;)V")
+		a.op("astore_1")
+		a.class("new", "Point")
+		a.op("dup")
+		a.op("bipush", 9)
+		a.op("aload_1")
+		a.invoke("invokespecial", "Point", "<init>", "(ILPoint;)V")
+		a.field("putstatic", "Main", "point", "LPoint;")
+
+		a.op("iconst_2")
+		a.op("newarray", 10)
+		a.op("dup")
+		a.op("iconst_0")
+		a.op("iconst_3")
+		a.op("iastore")
+		a.op("dup")
+		a.op("iconst_1")
+		a.op("iconst_4")
+		a.op("iastore")
+		a.field("putstatic", "Main", "numbers", "[I")
+
+		a.op("iconst_2")
+		a.class("anewarray", "Point")
+		a.op("dup")
+		a.op("iconst_0")
+		a.op("aload_1")
+		a.op("aastore")
+		a.field("putstatic", "Main", "points", "[LPoint;")
+		a.op("return")
+	})
+
+	vm := newTestVM(t, point, main)
+	run(vm, "Main")
+	var out bytes.Buffer
+	if err := vm.DumpHeap(&out); err != nil {
+		t.Fatal(err)
+	}
+	d := parseHeapDump(t, out.Bytes())
+	if d.idSize != 8 {
+		t.Errorf("identifiers are %d bytes", d.idSize)
+	}
+	if d.roots == 0 {
+		t.Error("heap dump has no roots")
+	}
+
+	pointClass := d.classes[d.classIDs["Point"]]
+	if pointClass == nil {
+		t.Fatal("no class dump for Point")
+	}
+	if pointClass.super != d.classIDs["java/lang/Object"] {
+		t.Errorf("the superclass of Point is %#x", pointClass.super)
+	}
+	if len(pointClass.instance) != 2 || pointClass.instance[0] != (hprofField{name: "x", t: 10}) || pointClass.instance[1] != (hprofField{name: "next", t: 2}) {
+		t.Errorf("Point has the fields %v", pointClass.instance)
+	}
+
+	second, ok := d.instances[d.static(t, "Main", "point")]
+	if !ok || second.class != d.classIDs["Point"] || len(second.values) != 12 {
+		t.Fatalf("Main.point is %v", second)
+	}
+	if x := binary.BigEndian.Uint32(second.values); x != 9 {
+		t.Errorf("Main.point.x is %d", x)
+	}
+	firstID := binary.BigEndian.Uint64(second.values[4:])
+	first, ok := d.instances[firstID]
+	if !ok || binary.BigEndian.Uint32(first.values) != 7 || binary.BigEndian.Uint64(first.values[4:]) != 0 {
+		t.Errorf("Main.point.next is %v", first)
+	}
+
+	numbers := d.arrays[d.static(t, "Main", "numbers")]
+	if numbers.t != 10 || len(numbers.elements) != 2 || numbers.elements[0] != 3 || numbers.elements[1] != 4 {
+		t.Errorf("Main.numbers is %v", numbers)
+	}
+	points := d.arrays[d.static(t, "Main", "points")]
+	if points.class != d.classIDs["[LPoint;"] || len(points.elements) != 2 || points.elements[0] != firstID || points.elements[1] != 0 {
+		t.Errorf("Main.points is %v", points)
+	}
+}
@@ -0,0 +1,81 @@
+package java
+
+import (
+	"io"
+)
+
+// identityHash returns the identity hash code of the non-null reference r,
+// choosing it the first time it is asked for and keeping it in the object
+// from then on.
+func (vm *VM) identityHash(r javaReference) int32 {
+	h := headerOf(r)
+	if h.hash == 0 {
+		h.hash = vm.thread.nextHash()
+	}
+	return h.hash
+}
+
+// nextHash draws an identity hash from the xor-shift generator of t, the way
+// HotSpot does. Hashes are 31 bits and never 0, which marks an object that
+// doesn't have one yet. The generator always starts from the same state, so
+// runs of a program see the same hashes.
+func (t *thread) nextHash() int32 {
+	s := &t.hashState
+	x := s[0]
+	x ^= x << 11
+	s[0], s[1], s[2] = s[1], s[2], s[3]
+	s[3] = s[3] ^ s[3]>>19 ^ x ^ x>>8
+	hash := int32(s[3] & 0x7fffffff)
+	if hash == 0 {
+		hash = 0xbad
+	}
+	return hash
+}
+
+// newThread makes a thread called name.
+func newThread(name string) *thread {
+	return &thread{name: name, hashState: [4]uint32{0x2545f491, 842502087, 0x8767, 273326509}}
+}
+
+// intern returns the one String object for the string s in the pool of
+// interned strings, making it the first time.
+func (vm *VM) intern(s string) javaObject {
+	if str, ok := vm.internedStrings[s]; ok {
+		return str
+	}
+	str := nativeStringToJavaString(vm, s)
+	vm.internedStrings[s] = str
+	return str
+}
+
+func nativeHashCode(vm *VM, f *Frame, w io.Writer) {
+	f.PreviousFrame.pushInt32(vm.identityHash(f.Variables[0].(javaReference)))
+}
+
+func nativeIdentityHashCode(vm *VM, f *Frame, w io.Writer) {
+	o := f.Variables[0].(javaReference)
+	if o.isNull() {
+		f.PreviousFrame.pushInt32(0)
+		return
+	}
+	f.PreviousFrame.pushInt32(vm.identityHash(o))
+}
+
+func nativeEquals(_ *VM, f *Frame, w io.Writer) {
+	if sameObject(f.Variables[0].(javaReference), f.Variables[1].(javaReference)) {
+		f.PreviousFrame.pushInt32(1)
+	} else {
+		f.PreviousFrame.pushInt32(0)
+	}
+}
+
+func nativeIntern(vm *VM, f *Frame, w io.Writer) {
+	str := f.Variables[0].(javaObject)
+	s := javaStringToNativeString(str)
+	if interned, ok := vm.internedStrings[s]; ok {
+		f.PreviousFrame.push(interned)
+		return
+	}
+	vm.internedStrings[s] = str
+	f.PreviousFrame.push(str)
+}
@@ -0,0 +1,40 @@
+package java
+
+import (
+	"testing"
+)
+
+func TestObjectEquals(t *testing.T) {
+	point := newTestClass(Public|Super, "Point", "java/lang/Object")
+	point.constructor("java/lang/Object", "()V")
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 3, func(a *assembler) {
+		equals := func(this, other func()) {
+			this()
+			other()
+			a.invoke("invokevirtual", "java/lang/Object", "equals", "(Ljava/lang/Object;)Z")
+			a.invoke("invokestatic", "Main", "printInt", "(I)V")
+		}
+		for slot := byte(1); slot <= 2; slot++ {
+			a.class("new", "Point")
+			a.op("dup")
+			a.invoke("invokespecial", "Point", "<init>", "()V")
+			a.op("astore", slot)
+		}
+		load := func(slot byte) func() { return func() { a.op("aload", slot) } }
+		equals(load(1), load(1))
+		equals(load(1), load(2))
+		equals(load(1), func() { a.op("aconst_null") })
+		a.op("return")
+	})
+
+	vm := newTestVM(t, point, main)
+	got := run(vm, "Main")
+	if want := "1\n0\n0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	m := vm.resolveClass("java/lang/Object").resolveMethod("equals", "(Ljava/lang/Object;)Z")
+	if vm.implementation(m) == nil {
+		t.Error("Object.equals runs its byte code instead of the VM's identity check")
+	}
+}
@@ -0,0 +1,257 @@
+package java
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bootstrapMethod is an entry of the BootstrapMethods attribute. Both fields
+// are constant pool indexes, the first of a methodHandle.
+type bootstrapMethod struct {
+	methodHandle uint16
+	arguments    []uint16
+}
+
+func parseBootstrapMethods(cr classDecoder) []bootstrapMethod {
+	methods := make([]bootstrapMethod, cr.u2())
+	for i := range methods {
+		methods[i].methodHandle = cr.u2()
+		methods[i].arguments = make([]uint16, cr.u2())
+		for j := range methods[i].arguments {
+			methods[i].arguments[j] = cr.u2()
+		}
+	}
+	return methods
+}
+
+// A callSite is a linked invokedynamic instruction. invoke is given the
+// arguments popped off frame and returns the frame to carry on with, just
+// like the other invoke instructions do.
+type callSite struct {
+	descriptor string
+	invoke     func(vm *VM, frame *Frame, args []javaValue) *Frame
+	// instance is the object the call site always returns, if it does.
+	instance javaObject
+}
+
+// bootstrapCall is what a bootstrap method is given to link a call site or
+// resolve a dynamic constant. arguments are the static arguments from the
+// BootstrapMethods attribute, found at indexes of the constant pool of caller.
+type bootstrapCall struct {
+	caller     *Class
+	name       string
+	descriptor string
+	arguments  []ConstantPoolItem
+	indexes    []uint16
+}
+
+// newBootstrapCall prepares the call to the bootstrap method at index of the
+// BootstrapMethods attribute of c, returning it along with the method.
+func newBootstrapCall(c *Class, index uint16, name, descriptor string) (bootstrapCall, handleTarget, error) {
+	call := bootstrapCall{caller: c, name: name, descriptor: descriptor}
+	if int(index) >= len(c.bootstrapMethods) {
+		return call, handleTarget{}, fmt.Errorf("No bootstrap method %d in %s", index, c.Name())
+	}
+	bsm := c.bootstrapMethods[index]
+	for _, a := range bsm.arguments {
+		call.arguments = append(call.arguments, c.getConstantPoolItemAt(a))
+		call.indexes = append(call.indexes, a)
+	}
+	return call, handleTargetOf(c.getMethodHandleAt(bsm.methodHandle)), nil
+}
+
+// argument resolves the i-th static argument of call.
+func (call bootstrapCall) argument(vm *VM, i int) (javaValue, error) {
+	return vm.constantValue(call.caller, call.indexes[i])
+}
+
+// linkCallSite returns the call site of the invokedynamic instruction
+// executing in frame, running its bootstrap method the first time through.
+func (vm *VM) linkCallSite(frame *Frame, index uint16) (*callSite, error) {
+	pc := frame.PC.CurrentByteCodeIndex()
+	if site, ok := frame.Method.callSites[pc]; ok {
+		return site, nil
+	}
+	indy := frame.Class.getInvokeDynamicAt(index)
+	call, bsm, err := newBootstrapCall(frame.Class, indy.bootstrapMethodAttrIndex, indy.name(), indy.descriptor())
+	if err != nil {
+		return nil, err
+	}
+	key := bsm.class + "." + bsm.name
+	linker := vm.bootstrapLinkers[key]
+	if linker == nil {
+		return nil, fmt.Errorf("Unsupported bootstrap method %s", key)
+	}
+	site, err := linker(vm, call)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Method.callSites == nil {
+		frame.Method.callSites = make(map[int]*callSite)
+	}
+	frame.Method.callSites[pc] = site
+	return site, nil
+}
+
+// invokeDynamic runs the invokedynamic instruction executing in frame.
+func (vm *VM) invokeDynamic(frame *Frame, index uint16) *Frame {
+	site, err := vm.linkCallSite(frame, index)
+	if err != nil {
+		return vm.throw(frame, "java/lang/BootstrapMethodError", err.Error())
+	}
+	params, _ := splitDescriptor(site.descriptor)
+	args := make([]javaValue, len(params))
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = frame.pop()
+	}
+	return site.invoke(vm, frame, args)
+}
+
+// Recipes passed to StringConcatFactory.makeConcatWithConstants use these to
+// mark where the arguments and the constants go.
+const (
+	concatArgument = '\x01'
+	concatConstant = '\x02'
+)
+
+// concatPart is a piece of a string concatenation, either literal text or
+// the argument at index arg.
+type concatPart struct {
+	text string
+	arg  int
+}
+
+// linkStringConcat implements StringConcatFactory.makeConcat and
+// makeConcatWithConstants without going through method handles.
+func linkStringConcat(vm *VM, call bootstrapCall) (*callSite, error) {
+	params, ret := splitDescriptor(call.descriptor)
+	if ret != "Ljava/lang/String;" {
+		return nil, fmt.Errorf("String concatenation must return a String, not %s", typeName(ret))
+	}
+	recipe := strings.Repeat(string(concatArgument), len(params))
+	var constants []ConstantPoolItem
+	if call.name == "makeConcatWithConstants" || len(call.arguments) > 0 {
+		if len(call.arguments) == 0 {
+			return nil, fmt.Errorf("String concatenation recipe is missing")
+		}
+		r, ok := call.arguments[0].(stringConstant)
+		if !ok {
+			return nil, fmt.Errorf("String concatenation recipe is not a string")
+		}
+		recipe = call.caller.getUTF8At(r.utf8Index)
+		constants = call.arguments[1:]
+	}
+
+	var parts []concatPart
+	var text strings.Builder
+	arg := 0
+	for _, r := range recipe {
+		switch r {
+		case concatArgument:
+			if arg == len(params) {
+				return nil, fmt.Errorf("String concatenation recipe has more arguments than %s", call.descriptor)
+			}
+			if text.Len() > 0 {
+				parts = append(parts, concatPart{text.String(), -1})
+				text.Reset()
+			}
+			parts = append(parts, concatPart{arg: arg})
+			arg++
+		case concatConstant:
+			if len(constants) == 0 {
+				return nil, fmt.Errorf("String concatenation recipe has more constants than were given")
+			}
+			s, err := constantText(call.caller, constants[0])
+			if err != nil {
+				return nil, err
+			}
+			text.WriteString(s)
+			constants = constants[1:]
+		default:
+			text.WriteRune(r)
+		}
+	}
+	if text.Len() > 0 {
+		parts = append(parts, concatPart{text.String(), -1})
+	}
+	if arg != len(params) {
+		return nil, fmt.Errorf("String concatenation recipe has fewer arguments than %s", call.descriptor)
+	}
+
+	return &callSite{descriptor: call.descriptor, invoke: func(vm *VM, frame *Frame, args []javaValue) *Frame {
+		// Calling toString can collect the heap, which mustn't lose the
+		// arguments.
+		vm.keep(args...)
+		var b strings.Builder
+		for _, p := range parts {
+			if p.arg < 0 {
+				b.WriteString(p.text)
+				continue
+			}
+			s, thrown := vm.stringValueOf(args[p.arg], params[p.arg])
+			if !thrown.isNull() {
+				return handleException(vm, frame, thrown)
+			}
+			b.WriteString(s)
+		}
+		s := b.String()
+		if !vm.reserve(vm.stringSize(s)) {
+			return vm.throwOutOfMemory(frame)
+		}
+		frame.push(nativeStringToJavaString(vm, s))
+		return frame
+	}}, nil
+}
+
+// constantText is how a constant given to a concatenation recipe is written.
+func constantText(c *Class, item ConstantPoolItem) (string, error) {
+	switch item := item.(type) {
+	case stringConstant:
+		return c.getUTF8At(item.utf8Index), nil
+	case intConstant:
+		return strconv.Itoa(int(item.value)), nil
+	case longConstant:
+		return strconv.FormatInt(item.value, 10), nil
+	case floatConstant:
+		return formatJavaFloat(float64(item.value), 32), nil
+	case doubleConstant:
+		return formatJavaFloat(item.value, 64), nil
+	}
+	return "", fmt.Errorf("Cannot use %v as a String concatenation constant", item)
+}
+
+// stringValueOf converts v, of the type described by descriptor, to a string
+// the way String.valueOf does. Objects other than strings are asked for
+// their toString, and what that throws is returned.
+func (vm *VM) stringValueOf(v javaValue, descriptor string) (string, javaObject) {
+	switch descriptor[0] {
+	case 'Z':
+		return strconv.FormatBool(v.(javaInt) != 0), javaObject{}
+	case 'C':
+		return string(rune(uint16(v.(javaInt)))), javaObject{}
+	case 'B', 'S', 'I':
+		return strconv.Itoa(int(v.(javaInt))), javaObject{}
+	case 'J':
+		return strconv.FormatInt(int64(v.(javaLong)), 10), javaObject{}
+	case 'F':
+		return formatJavaFloat(float64(v.(javaFloat)), 32), javaObject{}
+	case 'D':
+		return formatJavaFloat(float64(v.(javaDouble)), 64), javaObject{}
+	}
+	ref := v.(javaReference)
+	if ref.isNull() {
+		return "null", javaObject{}
+	}
+	if o, ok := ref.(javaObject); ok && o.class().Name() == "java/lang/String" {
+		return javaStringToNativeString(o), javaObject{}
+	}
+	s, thrown := vm.call("java/lang/Object", "toString", "()Ljava/lang/String;", true, v)
+	if !thrown.isNull() {
+		return "", thrown
+	}
+	if s.(javaReference).isNull() {
+		return "null", javaObject{}
+	}
+	return javaStringToNativeString(s.(javaObject)), javaObject{}
+}
@@ -0,0 +1,132 @@
+package java
+
+import (
+	"fmt"
+	"testing"
+)
+
+const (
+	methodHandleTag  = 15
+	dynamicTag       = 17
+	invokeDynamicTag = 18
+)
+
+func (w *classWriter) methodHandle(kind uint8, class, name, descriptor string) uint16 {
+	tag := uint8(methodRefTag)
+	if kind <= refPutStatic {
+		tag = fieldRefTag
+	}
+	ref := w.reference(tag, class, name, descriptor)
+	return w.constant(fmt.Sprintf("methodHandle %d %d", kind, ref), func() {
+		w.u1(methodHandleTag)
+		w.u1(kind)
+		w.u2(ref)
+	})
+}
+
+// dynamic adds a CONSTANT_Dynamic or CONSTANT_InvokeDynamic, depending on
+// tag, made by the bootstrap method at index bsm.
+func (w *classWriter) dynamic(tag uint8, bsm uint16, name, descriptor string) uint16 {
+	nt := w.nameAndType(name, descriptor)
+	return w.constant(fmt.Sprintf("dynamic%d %d %s%s", tag, bsm, name, descriptor), func() {
+		w.u1(tag)
+		w.u2(bsm)
+		w.u2(nt)
+	})
+}
+
+// bootstrap adds an entry to the BootstrapMethods attribute of c that calls
+// the static method class.name with the constants at arguments, and returns
+// its index.
+func (c *testClass) bootstrap(class, name, descriptor string, arguments ...uint16) uint16 {
+	entry := []uint16{c.methodHandle(refInvokeStatic, class, name, descriptor), uint16(len(arguments))}
+	c.bootstraps = append(c.bootstraps, append(entry, arguments...))
+	return uint16(len(c.bootstraps) - 1)
+}
+
+func (a *assembler) invokeDynamic(bsm uint16, name, descriptor string) {
+	index := a.w.dynamic(invokeDynamicTag, bsm, name, descriptor)
+	a.op("invokedynamic", byte(index>>8), byte(index), 0, 0)
+}
+
+const makeConcatWithConstants = "(Ljava/lang/invoke/MethodHandles$Lookup;Ljava/lang/String;Ljava/lang/invoke/MethodType;Ljava/lang/String;[Ljava/lang/Object;)Ljava/lang/invoke/CallSite;"
+
+func TestStringConcatenationThrows(t *testing.T) {
+	broken := newTestClass(Public|Super, "Broken", "java/lang/Object")
+	broken.constructor("java/lang/Object", "()V")
+	broken.code(Public, "toString", "()Ljava/lang/String;", 1, func(a *assembler) {
+		a.class("new", "java/lang/RuntimeException")
+		a.op("dup")
+		a.ldc("broken toString")
+		a.invoke("invokespecial", "java/lang/RuntimeException", "<init>", "(Ljava/lang/String;)V")
+		a.op("athrow")
+	})
+
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	concat := main.bootstrap("java/lang/invoke/StringConcatFactory", "makeConcatWithConstants", makeConcatWithConstants,
+		main.string("\x01 and \x01\n"))
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 2, func(a *assembler) {
+		a.ldc("fine")
+		a.op("iconst_5")
+		a.invokeDynamic(concat, "makeConcatWithConstants", "(Ljava/lang/String;I)Ljava/lang/String;")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.label("start")
+		a.ldc("never")
+		a.class("new", "Broken")
+		a.op("dup")
+		a.invoke("invokespecial", "Broken", "<init>", "()V")
+		a.invokeDynamic(concat, "makeConcatWithConstants", "(Ljava/lang/String;LBroken;)Ljava/lang/String;")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.label("end")
+		a.op("return")
+		a.label("handler")
+		a.op("astore_1")
+		a.ldc("caught ")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.op("aload_1")
+		a.invoke("invokevirtual", "java/lang/Throwable", "getMessage", "()Ljava/lang/String;")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.op("return")
+		a.catch("start", "end", "handler", "java/lang/RuntimeException")
+	})
+
+	got := run(newTestVM(t, broken, main), "Main")
+	want := "fine and 5\ncaught broken toString"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStringConcatenationRunsOutOfMemory(t *testing.T) {
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	concat := main.bootstrap("java/lang/invoke/StringConcatFactory", "makeConcatWithConstants", makeConcatWithConstants,
+		main.string("\x01\x01"))
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 2, func(a *assembler) {
+		a.printThrows(func() {
+			// Doubles a string 24 times, to 16 million characters.
+			a.ldc("x")
+			a.op("astore_1")
+			a.index("sipush", 24)
+			a.op("istore_0")
+			a.label("double")
+			a.op("aload_1")
+			a.op("aload_1")
+			a.invokeDynamic(concat, "makeConcatWithConstants", "(Ljava/lang/String;Ljava/lang/String;)Ljava/lang/String;")
+			a.op("astore_1")
+			a.op("iinc", 0, 0xff)
+			a.op("iload_0")
+			a.branch("ifne", "double")
+		})
+		a.op("return")
+	})
+
+	vm := newTestVM(t, main)
+	vm.SetMaxHeap(1 << 20)
+	got := run(vm, "Main")
+	if want := "java.lang.OutOfMemoryError: Java heap space\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if stats := vm.HeapStats(); stats.Used > stats.Limit {
+		t.Errorf("the heap holds %d bytes, more than its limit of %d", stats.Used, stats.Limit)
+	}
+}
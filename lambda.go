@@ -0,0 +1,240 @@
+package java
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Flags given to LambdaMetafactory.altMetafactory.
+const (
+	lambdaSerializable = 1
+	lambdaMarkers      = 2
+	lambdaBridges      = 4
+)
+
+// lambda is what a LambdaMetafactory bootstrap method is asked to make: a
+// class implementing the functional interface returned by descriptor whose
+// method name, of type samDescriptor, calls impl.
+type lambda struct {
+	caller                 *Class
+	name                   string
+	descriptor             string
+	samDescriptor          string
+	impl                   handleTarget
+	instantiatedDescriptor string
+	flags                  int
+	markers                []string
+	bridges                []string
+}
+
+// linkLambda implements LambdaMetafactory.metafactory and altMetafactory by
+// spinning up a class for the call site to make instances of.
+func linkLambda(vm *VM, call bootstrapCall) (*callSite, error) {
+	l, err := parseLambda(call)
+	if err != nil {
+		return nil, err
+	}
+	class, err := vm.spinLambdaClass(l)
+	if err != nil {
+		return nil, err
+	}
+	params, _ := splitDescriptor(call.descriptor)
+	if len(params) == 0 {
+		// Lambdas that capture nothing can all share the one instance.
+		site := &callSite{descriptor: call.descriptor, instance: vm.newInstance(class)}
+		site.invoke = func(vm *VM, frame *Frame, args []javaValue) *Frame {
+			frame.push(site.instance)
+			return frame
+		}
+		return site, nil
+	}
+	return &callSite{descriptor: call.descriptor, invoke: func(vm *VM, frame *Frame, args []javaValue) *Frame {
+		vm.keep(args...)
+		if !vm.reserve(vm.instanceSize(class)) {
+			return vm.throwOutOfMemory(frame)
+		}
+		instance := vm.newInstance(class)
+		for i, a := range args {
+			instance.setField(capturedField(i), a)
+		}
+		frame.push(instance)
+		return frame
+	}}, nil
+}
+
+func parseLambda(call bootstrapCall) (*lambda, error) {
+	args := call.arguments
+	if len(args) < 3 {
+		return nil, fmt.Errorf("%s needs 3 static arguments, not %d", call.name, len(args))
+	}
+	l := &lambda{caller: call.caller, name: call.name, descriptor: call.descriptor}
+	impl, ok := args[1].(methodHandle)
+	if !ok {
+		return nil, fmt.Errorf("The implementation of a lambda must be a method handle, not %v", args[1])
+	}
+	l.impl = handleTargetOf(impl)
+	var err error
+	if l.samDescriptor, err = methodTypeDescriptor(args[0]); err != nil {
+		return nil, err
+	}
+	if l.instantiatedDescriptor, err = methodTypeDescriptor(args[2]); err != nil {
+		return nil, err
+	}
+	args = args[3:]
+
+	if call.name == "altMetafactory" || len(args) > 0 {
+		next := func() (int, error) {
+			if len(args) == 0 {
+				return 0, fmt.Errorf("altMetafactory is missing static arguments")
+			}
+			n, ok := args[0].(intConstant)
+			if !ok {
+				return 0, fmt.Errorf("altMetafactory expected an int, not %v", args[0])
+			}
+			args = args[1:]
+			return int(n.value), nil
+		}
+		if l.flags, err = next(); err != nil {
+			return nil, err
+		}
+		if l.flags&lambdaMarkers != 0 {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			for ; n > 0 && len(args) > 0; n-- {
+				c, ok := args[0].(classInfo)
+				if !ok {
+					return nil, fmt.Errorf("Marker interfaces must be classes, not %v", args[0])
+				}
+				l.markers = append(l.markers, c.className())
+				args = args[1:]
+			}
+		}
+		if l.flags&lambdaBridges != 0 {
+			n, err := next()
+			if err != nil {
+				return nil, err
+			}
+			for ; n > 0 && len(args) > 0; n-- {
+				d, err := methodTypeDescriptor(args[0])
+				if err != nil {
+					return nil, err
+				}
+				l.bridges = append(l.bridges, d)
+				args = args[1:]
+			}
+		}
+	}
+	return l, nil
+}
+
+func methodTypeDescriptor(item ConstantPoolItem) (string, error) {
+	t, ok := item.(methodType)
+	if !ok {
+		return "", fmt.Errorf("Expected a method type, not %v", item)
+	}
+	return t.containingClass.getUTF8At(t.descriptorIndex), nil
+}
+
+// capturedField is the name of the field of a lambda holding the i-th
+// argument captured by its call site.
+func capturedField(i int) string {
+	return "arg$" + strconv.Itoa(i+1)
+}
+
+// spinLambdaClass generates and loads the class implementing l.
+func (vm *VM) spinLambdaClass(l *lambda) (*Class, error) {
+	params, ret := splitDescriptor(l.descriptor)
+	if ret[0] != 'L' {
+		return nil, fmt.Errorf("A lambda must be an interface, not %s", typeName(ret))
+	}
+	iface := ret[1 : len(ret)-1]
+	name := vm.spinName(l.caller.Name() + "$$Lambda$")
+
+	interfaces := append([]string{iface}, l.markers...)
+	if l.flags&lambdaSerializable != 0 {
+		interfaces = append(interfaces, "java/io/Serializable")
+	}
+	w := newClassWriter(Final|Super|Synthetic, name, "java/lang/Object", interfaces)
+	for i, p := range params {
+		w.field(Final, capturedField(i), p)
+	}
+	for _, d := range append([]string{l.samDescriptor}, l.bridges...) {
+		code, err := l.forwarder(w, name, params, d)
+		if err != nil {
+			return nil, err
+		}
+		w.method(Public, l.name, d, code)
+	}
+	if l.flags&lambdaSerializable != 0 {
+		w.method(Final, "writeReplace", "()Ljava/lang/Object;", l.writeReplace(w, name, iface, params))
+	}
+	return vm.defineClass(w, l.caller)
+}
+
+// forwarder is the code of the interface method of type descriptor. It passes
+// the captured arguments followed by its own to the implementation method,
+// adapting them and the result between the types on either side.
+func (l *lambda) forwarder(w *classWriter, name string, captured []string, descriptor string) (*codeWriter, error) {
+	switch l.impl.kind {
+	case refInvokeVirtual, refInvokeStatic, refInvokeSpecial, refNewInvokeSpecial, refInvokeInterface:
+	default:
+		return nil, fmt.Errorf("Unsupported method handle kind %d for a lambda", l.impl.kind)
+	}
+	params, ret := splitDescriptor(descriptor)
+	sources := append(append([]string{}, captured...), params...)
+	slots := make([]int, len(sources))
+	slot := 1
+	for i := len(captured); i < len(sources); i++ {
+		slots[i] = slot
+		slot += descriptorCategory(sources[i])
+	}
+
+	code := newCodeWriter(slot)
+	load := func(i int) {
+		if i < len(captured) {
+			code.op(1, opAload0)
+			code.opIndex(descriptorCategory(captured[i])-1, opGetfield, w.fieldRef(name, capturedField(i), captured[i]))
+			return
+		}
+		code.load(sources[i], slots[i])
+	}
+	if err := writeCall(w, code, l.impl, sources, load, ret); err != nil {
+		return nil, fmt.Errorf("Lambda %s%s cannot call %v: %v", l.name, descriptor, l.impl, err)
+	}
+	code.ret(ret)
+	return code, nil
+}
+
+// writeReplace is the code of the method that gives a serializable lambda
+// the SerializedLambda to write out in its place.
+func (l *lambda) writeReplace(w *classWriter, name, iface string, captured []string) *codeWriter {
+	code := newCodeWriter(1)
+	serialized := "java/lang/invoke/SerializedLambda"
+	code.opIndex(1, opNew, w.class(serialized))
+	code.op(1, opDup)
+	code.opIndex(1, opLdcW, w.class(l.caller.Name()))
+	for _, s := range []string{iface, l.name, l.samDescriptor} {
+		code.opIndex(1, opLdcW, w.string(s))
+	}
+	code.opIndex(1, opSipush, uint16(l.impl.kind))
+	for _, s := range []string{l.impl.class, l.impl.name, l.impl.descriptor, l.instantiatedDescriptor} {
+		code.opIndex(1, opLdcW, w.string(s))
+	}
+	code.opIndex(1, opSipush, uint16(len(captured)))
+	code.opIndex(0, opAnewarray, w.class("java/lang/Object"))
+	for i, c := range captured {
+		code.op(1, opDup)
+		code.opIndex(1, opSipush, uint16(i))
+		code.op(1, opAload0)
+		code.opIndex(descriptorCategory(c)-1, opGetfield, w.fieldRef(name, capturedField(i), c))
+		convertValue(w, code, c, "Ljava/lang/Object;")
+		code.op(-3, opAastore)
+	}
+	constructor := "(Ljava/lang/Class;Ljava/lang/String;Ljava/lang/String;Ljava/lang/String;I" +
+		"Ljava/lang/String;Ljava/lang/String;Ljava/lang/String;Ljava/lang/String;[Ljava/lang/Object;)V"
+	code.opIndex(-11, opInvokespecial, w.methodRef(serialized, "<init>", constructor))
+	code.ret("Ljava/lang/Object;")
+	return code
+}
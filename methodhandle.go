@@ -0,0 +1,533 @@
+package java
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Reference kinds of method handles.
+const (
+	refGetField         = 1
+	refGetStatic        = 2
+	refPutField         = 3
+	refPutStatic        = 4
+	refInvokeVirtual    = 5
+	refInvokeStatic     = 6
+	refInvokeSpecial    = 7
+	refNewInvokeSpecial = 8
+	refInvokeInterface  = 9
+)
+
+// primitiveBoxes are the wrapper classes of the primitive types and the
+// methods that unwrap them.
+var primitiveBoxes = map[byte]struct{ class, unbox string }{
+	'Z': {"java/lang/Boolean", "booleanValue"},
+	'B': {"java/lang/Byte", "byteValue"},
+	'C': {"java/lang/Character", "charValue"},
+	'S': {"java/lang/Short", "shortValue"},
+	'I': {"java/lang/Integer", "intValue"},
+	'J': {"java/lang/Long", "longValue"},
+	'F': {"java/lang/Float", "floatValue"},
+	'D': {"java/lang/Double", "doubleValue"},
+}
+
+// handleTarget is the field or method a direct method handle refers to. kind
+// is one of the ref* reference kinds.
+type handleTarget struct {
+	kind        uint8
+	class       string
+	name        string
+	descriptor  string
+	isInterface bool
+}
+
+func handleTargetOf(h methodHandle) handleTarget {
+	switch ref := h.containingClass.getConstantPoolItemAt(h.referenceIndex).(type) {
+	case fieldRef:
+		return handleTarget{h.referenceKind, ref.className(), ref.fieldName(), ref.fieldDescriptor(), false}
+	case interfaceMethodRef:
+		return handleTarget{h.referenceKind, ref.className(), ref.methodName(), ref.methodType(), true}
+	case methodRef:
+		return handleTarget{h.referenceKind, ref.className(), ref.methodName(), ref.methodType(), false}
+	}
+	log.Panicf("Method handle %v does not refer to a field or method", h)
+	return handleTarget{}
+}
+
+// referenceKindNames are the names of the reference kinds, by kind.
+var referenceKindNames = []string{"", "getField", "getStatic", "putField", "putStatic",
+	"invokeVirtual", "invokeStatic", "invokeSpecial", "newInvokeSpecial", "invokeInterface"}
+
+// String describes t the way the messages of java.lang.invoke do, like
+// Main.add(int,int)int/invokeStatic.
+func (t handleTarget) String() string {
+	member := typeName(classDescriptor(t.class)) + "." + t.name
+	if t.descriptor[0] == '(' {
+		member += methodTypeString(t.descriptor)
+	} else {
+		member += "/" + simpleTypeName(t.descriptor)
+	}
+	if int(t.kind) < len(referenceKindNames) {
+		member += "/" + referenceKindNames[t.kind]
+	}
+	return member
+}
+
+// methodType is the descriptor of the type of a handle to t, which is what
+// invokeExact has to be called with.
+func (t handleTarget) methodType() string {
+	self := classDescriptor(t.class)
+	switch t.kind {
+	case refGetField:
+		return "(" + self + ")" + t.descriptor
+	case refGetStatic:
+		return "()" + t.descriptor
+	case refPutField:
+		return "(" + self + t.descriptor + ")V"
+	case refPutStatic:
+		return "(" + t.descriptor + ")V"
+	case refInvokeVirtual, refInvokeSpecial, refInvokeInterface:
+		return "(" + self + t.descriptor[1:]
+	case refNewInvokeSpecial:
+		return t.descriptor[:len(t.descriptor)-1] + self
+	}
+	return t.descriptor
+}
+
+// classDescriptor is the descriptor of the class named the way a
+// CONSTANT_Class names it.
+func classDescriptor(name string) string {
+	if name[0] == '[' {
+		return name
+	}
+	return "L" + name + ";"
+}
+
+// methodTypeString formats a method descriptor like MethodType.toString.
+func methodTypeString(descriptor string) string {
+	params, ret := splitDescriptor(descriptor)
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = simpleTypeName(p)
+	}
+	return "(" + strings.Join(names, ",") + ")" + simpleTypeName(ret)
+}
+
+// simpleTypeName is the type described by descriptor without its package.
+func simpleTypeName(descriptor string) string {
+	name := typeName(descriptor)
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+// writeCall adds the code that calls target with arguments of the types in
+// sources, load(i) pushing the i-th of them. The arguments are converted to
+// the types target takes and its result to ret.
+func writeCall(w *classWriter, code *codeWriter, t handleTarget, sources []string, load func(int), ret string) error {
+	params, result := splitDescriptor(t.methodType())
+	if len(sources) != len(params) {
+		return fmt.Errorf("%v takes %d arguments, not %d", t, len(params), len(sources))
+	}
+	if t.kind == refNewInvokeSpecial {
+		code.opIndex(1, opNew, w.class(t.class))
+		code.op(1, opDup)
+	}
+	words := 0
+	for i, s := range sources {
+		load(i)
+		if err := convertValue(w, code, s, params[i]); err != nil {
+			return err
+		}
+		words += descriptorCategory(params[i])
+	}
+
+	method := func() uint16 {
+		if t.isInterface {
+			return w.interfaceMethodRef(t.class, t.name, t.descriptor)
+		}
+		return w.methodRef(t.class, t.name, t.descriptor)
+	}
+	effect := descriptorCategory(result) - words
+	switch t.kind {
+	case refGetField:
+		code.opIndex(effect, opGetfield, w.fieldRef(t.class, t.name, t.descriptor))
+	case refGetStatic:
+		code.opIndex(effect, opGetstatic, w.fieldRef(t.class, t.name, t.descriptor))
+	case refPutField:
+		code.opIndex(effect, opPutfield, w.fieldRef(t.class, t.name, t.descriptor))
+	case refPutStatic:
+		code.opIndex(effect, opPutstatic, w.fieldRef(t.class, t.name, t.descriptor))
+	case refInvokeVirtual:
+		code.opIndex(effect, opInvokevirtual, method())
+	case refInvokeStatic:
+		code.opIndex(effect, opInvokestatic, method())
+	case refInvokeSpecial:
+		code.opIndex(effect, opInvokespecial, method())
+	case refInvokeInterface:
+		index := method()
+		code.op(effect, opInvokeinterface, byte(index>>8), byte(index), byte(words), 0)
+	case refNewInvokeSpecial:
+		code.opIndex(-words-1, opInvokespecial, method())
+	default:
+		return fmt.Errorf("Unknown method handle kind %d", t.kind)
+	}
+
+	switch {
+	case ret == "V" && descriptorCategory(result) == 1:
+		code.op(-1, opPop)
+	case ret == "V" && descriptorCategory(result) == 2:
+		code.op(-2, opPop2)
+	case ret != "V" && result == "V":
+		return fmt.Errorf("%v returns void, not %s", t, typeName(ret))
+	case ret != "V":
+		return convertValue(w, code, result, ret)
+	}
+	return nil
+}
+
+// signaturePolymorphic reports whether the method name of c can be invoked
+// with any descriptor, like MethodHandle.invokeExact.
+func (c *Class) signaturePolymorphic(name string) bool {
+	if c.Name() != "java/lang/invoke/MethodHandle" {
+		return false
+	}
+	m := c.resolveMethod(name, "([Ljava/lang/Object;)Ljava/lang/Object;")
+	return m != nil && m.Native() && m.accessFlags&Varargs != 0
+}
+
+// invokeHandle runs invokeExact or invoke on a method handle with arguments
+// of the types in descriptor.
+func (vm *VM) invokeHandle(frame *Frame, name, descriptor string) *Frame {
+	params, _ := splitDescriptor(descriptor)
+	args := make([]javaValue, len(params))
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = frame.pop()
+	}
+	handle := frame.popObject()
+	if handle.isNull() {
+		return vm.throwNullPointer(frame)
+	}
+	target, ok := handle.hidden.(handleTarget)
+	if !ok {
+		log.Panicf("Unsupported method handle %v", handle)
+	}
+	if name == "invokeExact" && descriptor != target.methodType() {
+		message := fmt.Sprintf("handle's method type %s but found %s", methodTypeString(target.methodType()), methodTypeString(descriptor))
+		return vm.throw(frame, "java/lang/invoke/WrongMethodTypeException", message)
+	}
+	adapter, err := vm.handleAdapter(target, descriptor)
+	if err != nil {
+		message := fmt.Sprintf("cannot convert MethodHandle%s to %s", methodTypeString(target.methodType()), methodTypeString(descriptor))
+		return vm.throw(frame, "java/lang/invoke/WrongMethodTypeException", message)
+	}
+	for _, a := range args {
+		frame.push(a)
+	}
+	return buildFrame(vm, adapter.Name(), "invoke", descriptor, frame, false)
+}
+
+// handleAdapter returns a class whose static method invoke, of type
+// descriptor, calls target adapting the arguments and result the way
+// MethodHandle.asType does.
+func (vm *VM) handleAdapter(target handleTarget, descriptor string) (*Class, error) {
+	key := fmt.Sprintf("%d %s.%s%s as %s", target.kind, target.class, target.name, target.descriptor, descriptor)
+	if adapter, ok := vm.handleAdapters[key]; ok {
+		return adapter, nil
+	}
+	owner := target.class
+	if owner[0] == '[' {
+		owner = "java/lang/Object"
+	}
+	w := newClassWriter(Final|Super|Synthetic, vm.spinName(owner+"$$MethodHandle$"), "java/lang/Object", nil)
+	params, ret := splitDescriptor(descriptor)
+	code := newCodeWriter(argumentsSize(descriptor))
+	slots := make([]int, len(params))
+	for i := 1; i < len(params); i++ {
+		slots[i] = slots[i-1] + descriptorCategory(params[i-1])
+	}
+	load := func(i int) { code.load(params[i], slots[i]) }
+	if err := writeCall(w, code, target, params, load, ret); err != nil {
+		return nil, err
+	}
+	code.ret(ret)
+	w.method(Public|Static, "invoke", descriptor, code)
+	adapter, err := vm.defineClass(w, vm.resolveClass(owner))
+	if err != nil {
+		return nil, err
+	}
+	vm.handleAdapters[key] = adapter
+	return adapter, nil
+}
+
+// callHandle calls target with args, of the types in types, and returns the
+// result converted to ret, or a thrownError if target throws.
+func (vm *VM) callHandle(target handleTarget, types []string, args []javaValue, ret string) (javaValue, error) {
+	descriptor := "(" + strings.Join(types, "") + ")" + ret
+	adapter, err := vm.handleAdapter(target, descriptor)
+	if err != nil {
+		return nil, err
+	}
+	result, thrown := vm.call(adapter.Name(), "invoke", descriptor, false, args...)
+	if !thrown.isNull() {
+		return nil, thrownError{thrown}
+	}
+	return result, nil
+}
+
+// thrownError is an exception thrown by Java code the VM called, handed back
+// to be thrown where the VM was asked for what the code computes.
+type thrownError struct {
+	throwable javaObject
+}
+
+func (e thrownError) Error() string {
+	return typeName(classDescriptor(e.throwable.class().Name()))
+}
+
+// methodTypeObject returns a java.lang.invoke.MethodType for descriptor.
+func (vm *VM) methodTypeObject(descriptor string) javaObject {
+	o := vm.newInstance(vm.resolveClass("java/lang/invoke/MethodType"))
+	o.hidden = descriptor
+	return o
+}
+
+// methodHandleObject returns a java.lang.invoke.MethodHandle for target.
+func (vm *VM) methodHandleObject(target handleTarget) javaObject {
+	o := vm.newInstance(vm.resolveClass("java/lang/invoke/MethodHandle"))
+	o.hidden = target
+	return o
+}
+
+// lookupObject returns a java.lang.invoke.MethodHandles.Lookup on caller.
+func (vm *VM) lookupObject(caller *Class) javaObject {
+	lookup := vm.newInstance(vm.resolveClass("java/lang/invoke/MethodHandles$Lookup"))
+	lookup.hidden = caller
+	return lookup
+}
+
+// nativeLookup implements MethodHandles.lookup, which returns a Lookup for
+// the class that calls it.
+func nativeLookup(vm *VM, f *Frame, w io.Writer) {
+	if !vm.reserveNative(f, vm.instanceSize(vm.resolveClass("java/lang/invoke/MethodHandles$Lookup"))) {
+		return
+	}
+	f.PreviousFrame.push(vm.lookupObject(f.PreviousFrame.Class))
+}
+
+// findMember implements the find methods of MethodHandles.Lookup. Their
+// arguments are the class to look in, the name of the member unless it is a
+// constructor, and its type as a MethodType or, for fields, a Class.
+func findMember(vm *VM, f *Frame, static bool, kind func(*Class) uint8) {
+	params, _ := splitDescriptor(f.Method.RawSigniture)
+	args := f.Variables[1 : 1+len(params)]
+	for _, a := range args {
+		if a.(javaObject).isNull() {
+			f.thrown = vm.newThrowable("java/lang/NullPointerException", "")
+			return
+		}
+	}
+	class := vm.resolveClass(internalName(args[0].(javaObject).hidden.(string)))
+	name := "<init>"
+	if len(args) == 3 {
+		name = javaStringToNativeString(args[1].(javaObject))
+	}
+	descriptor := args[len(args)-1].(javaObject).hidden.(string)
+	target := handleTarget{kind(class), class.Name(), name, descriptor, class.AccessFlags&Interface != 0}
+
+	member, exception := "method", "java/lang/NoSuchMethodException"
+	var found, isStatic bool
+	var declaringClass *Class
+	var flags accessFlags
+	switch target.kind {
+	case refGetField, refGetStatic:
+		member, exception = "field", "java/lang/NoSuchFieldException"
+		if field := vm.resolveField(class, target.name, target.descriptor); field != nil {
+			found, isStatic = true, field.accessFlags&Static != 0
+			declaringClass, flags = field.class, field.accessFlags
+		}
+	default:
+		if m := vm.resolveMethod(class, target.name, target.descriptor); m != nil {
+			found, isStatic = true, m.Static()
+			declaringClass, flags = m.Class(), m.accessFlags
+		}
+	}
+	if !found {
+		f.thrown = vm.newThrowable(exception, fmt.Sprintf("no such %s: %v", member, target))
+		return
+	}
+	if isStatic != static {
+		expected := "non-static"
+		if static {
+			expected = "static"
+		}
+		f.thrown = vm.newThrowable("java/lang/IllegalAccessException", fmt.Sprintf("expected a %s %s: %v", expected, member, target))
+		return
+	}
+	caller := accessingClass(f.Variables[0].(javaObject).hidden.(*Class))
+	if vm.accessChecks && !vm.memberAccessible(caller, declaringClass, flags) {
+		access := "private to package"
+		if flags&(Private|Protected) != 0 {
+			access = strings.TrimSpace(accessName(flags))
+		}
+		f.thrown = vm.newThrowable("java/lang/IllegalAccessException", fmt.Sprintf("member is %s: %v, from class %s", access, target, javaName("L"+caller.Name()+";")))
+		return
+	}
+	if !vm.reserveNative(f, vm.instanceSize(vm.resolveClass("java/lang/invoke/MethodHandle"))) {
+		return
+	}
+	f.PreviousFrame.push(vm.methodHandleObject(target))
+}
+
+func nativeFindStatic(vm *VM, f *Frame, w io.Writer) {
+	findMember(vm, f, true, func(*Class) uint8 { return refInvokeStatic })
+}
+
+func nativeFindVirtual(vm *VM, f *Frame, w io.Writer) {
+	findMember(vm, f, false, func(c *Class) uint8 {
+		if c.AccessFlags&Interface != 0 {
+			return refInvokeInterface
+		}
+		return refInvokeVirtual
+	})
+}
+
+func nativeFindConstructor(vm *VM, f *Frame, w io.Writer) {
+	findMember(vm, f, false, func(*Class) uint8 { return refNewInvokeSpecial })
+}
+
+func nativeFindGetter(vm *VM, f *Frame, w io.Writer) {
+	findMember(vm, f, false, func(*Class) uint8 { return refGetField })
+}
+
+func nativeFindStaticGetter(vm *VM, f *Frame, w io.Writer) {
+	findMember(vm, f, true, func(*Class) uint8 { return refGetStatic })
+}
+
+// nativeMethodType implements the MethodType.methodType factories that take
+// classes, arrays of classes and method types.
+func nativeMethodType(vm *VM, f *Frame, w io.Writer) {
+	var params []string
+	var ret string
+	args, _ := splitDescriptor(f.Method.RawSigniture)
+	for i, p := range args {
+		o := f.Variables[i].(javaReference)
+		if o.isNull() {
+			f.thrown = vm.newThrowable("java/lang/NullPointerException", "")
+			return
+		}
+		switch p {
+		case "Ljava/lang/Class;":
+			d := o.(javaObject).hidden.(string)
+			if i == 0 {
+				ret = d
+			} else {
+				params = append(params, d)
+			}
+		case "[Ljava/lang/Class;":
+			for _, c := range o.(javaArray).contents {
+				params = append(params, c.(javaObject).hidden.(string))
+			}
+		case "Ljava/lang/invoke/MethodType;":
+			ps, _ := splitDescriptor(o.(javaObject).hidden.(string))
+			params = append(params, ps...)
+		default:
+			log.Panicf("Unsupported MethodType.methodType%s", f.Method.RawSigniture)
+		}
+	}
+	if !vm.reserveNative(f, vm.instanceSize(vm.resolveClass("java/lang/invoke/MethodType"))) {
+		return
+	}
+	f.PreviousFrame.push(vm.methodTypeObject("(" + strings.Join(params, "") + ")" + ret))
+}
+
+func nativeMethodTypeToString(vm *VM, f *Frame, w io.Writer) {
+	s := methodTypeString(f.Variables[0].(javaObject).hidden.(string))
+	if !vm.reserveNative(f, vm.stringSize(s)) {
+		return
+	}
+	f.PreviousFrame.push(nativeStringToJavaString(vm, s))
+}
+
+func nativeMethodHandleType(vm *VM, f *Frame, w io.Writer) {
+	target := f.Variables[0].(javaObject).hidden.(handleTarget)
+	if !vm.reserveNative(f, vm.instanceSize(vm.resolveClass("java/lang/invoke/MethodType"))) {
+		return
+	}
+	f.PreviousFrame.push(vm.methodTypeObject(target.methodType()))
+}
+
+func nativeMethodHandleToString(vm *VM, f *Frame, w io.Writer) {
+	s := "MethodHandle" + methodTypeString(f.Variables[0].(javaObject).hidden.(handleTarget).methodType())
+	if !vm.reserveNative(f, vm.stringSize(s)) {
+		return
+	}
+	f.PreviousFrame.push(nativeStringToJavaString(vm, s))
+}
+
+// convertValue adds the code that turns the value of type from on top of the
+// stack into one of type to: a cast, boxing, unboxing or a widening primitive
+// conversion.
+func convertValue(w *classWriter, code *codeWriter, from, to string) error {
+	if from == to {
+		return nil
+	}
+	fromPrimitive := from[0] != 'L' && from[0] != '['
+	toPrimitive := to[0] != 'L' && to[0] != '['
+	switch {
+	case !fromPrimitive && !toPrimitive:
+		if to != "Ljava/lang/Object;" {
+			code.opIndex(0, opCheckcast, w.class(internalName(to)))
+		}
+		return nil
+	case fromPrimitive && !toPrimitive:
+		box := primitiveBoxes[from[0]].class
+		valueOf := "(" + from + ")L" + box + ";"
+		code.opIndex(1-descriptorCategory(from), opInvokestatic, w.methodRef(box, "valueOf", valueOf))
+		return convertValue(w, code, "L"+box+";", to)
+	case !fromPrimitive && toPrimitive:
+		unboxed := to
+		for p, box := range primitiveBoxes {
+			if from == "L"+box.class+";" {
+				unboxed = string(p)
+			}
+		}
+		box := primitiveBoxes[unboxed[0]]
+		code.opIndex(0, opCheckcast, w.class(box.class))
+		code.opIndex(descriptorCategory(unboxed)-1, opInvokevirtual, w.methodRef(box.class, box.unbox, "()"+unboxed))
+		return convertValue(w, code, unboxed, to)
+	}
+	return widenPrimitive(code, from, to)
+}
+
+// widenPrimitive adds the widening primitive conversion from from to to.
+func widenPrimitive(code *codeWriter, from, to string) error {
+	isInt := func(d string) bool { return d == "B" || d == "S" || d == "C" || d == "I" }
+	switch {
+	case from == "B" && to == "S", isInt(from) && to == "I":
+		return nil
+	case isInt(from) && to == "J":
+		code.op(1, opI2l)
+	case isInt(from) && to == "F":
+		code.op(0, opI2f)
+	case isInt(from) && to == "D":
+		code.op(1, opI2d)
+	case from == "J" && to == "F":
+		code.op(-1, opL2f)
+	case from == "J" && to == "D":
+		code.op(0, opL2d)
+	case from == "F" && to == "D":
+		code.op(1, opF2d)
+	default:
+		return fmt.Errorf("Cannot convert %s to %s", typeName(from), typeName(to))
+	}
+	return nil
+}
+
+// internalName is the name a CONSTANT_Class uses for the type descriptor.
+func internalName(descriptor string) string {
+	if descriptor[0] == 'L' {
+		return descriptor[1 : len(descriptor)-1]
+	}
+	return descriptor
+}
@@ -0,0 +1,35 @@
+package java
+
+import (
+	"testing"
+)
+
+func TestWidenPrimitive(t *testing.T) {
+	tests := []struct {
+		from, to string
+		widens   bool
+	}{
+		{"B", "S", true},
+		{"B", "I", true},
+		{"S", "I", true},
+		{"C", "I", true},
+		{"I", "J", true},
+		{"C", "D", true},
+		{"J", "F", true},
+		{"F", "D", true},
+		{"S", "B", false},
+		{"I", "S", false},
+		{"I", "C", false},
+		{"C", "S", false},
+		{"B", "C", false},
+		{"J", "I", false},
+		{"D", "F", false},
+		{"Z", "I", false},
+	}
+	for _, test := range tests {
+		err := widenPrimitive(newCodeWriter(0), test.from, test.to)
+		if widens := err == nil; widens != test.widens {
+			t.Errorf("widening %s to %s: got %v, want widens %v", test.from, test.to, err, test.widens)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package java
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	moduleOpen         = 0x0020
+	requiresTransitive = 0x0020
+	requiresStatic     = 0x0040
+)
+
+// moduleDescriptor is the contents of the Module attribute of a
+// module-info.class file.
+type moduleDescriptor struct {
+	name     string
+	flags    uint16
+	version  string
+	requires []moduleRequires
+	exports  []modulePackageRule
+	opens    []modulePackageRule
+	uses     []string
+	provides []moduleProvides
+}
+
+type moduleRequires struct {
+	name    string
+	flags   uint16
+	version string
+}
+
+// modulePackageRule is an exports or opens directive. An empty to list means
+// the package is available to every module.
+type modulePackageRule struct {
+	pkg   string
+	flags uint16
+	to    []string
+}
+
+type moduleProvides struct {
+	service string
+	with    []string
+}
+
+func parseModuleAttribute(c *Class, cr classDecoder) *moduleDescriptor {
+	var m moduleDescriptor
+	m.name = c.getModuleNameAt(cr.u2())
+	m.flags = cr.u2()
+	if v := cr.u2(); v != 0 {
+		m.version = c.getUTF8At(v)
+	}
+
+	requiresCount := cr.u2()
+	for i := uint16(0); i < requiresCount; i++ {
+		var r moduleRequires
+		r.name = c.getModuleNameAt(cr.u2())
+		r.flags = cr.u2()
+		if v := cr.u2(); v != 0 {
+			r.version = c.getUTF8At(v)
+		}
+		m.requires = append(m.requires, r)
+	}
+	m.exports = parsePackageRules(c, cr)
+	m.opens = parsePackageRules(c, cr)
+
+	usesCount := cr.u2()
+	for i := uint16(0); i < usesCount; i++ {
+		m.uses = append(m.uses, c.getClassInfoAt(cr.u2()).className())
+	}
+
+	providesCount := cr.u2()
+	for i := uint16(0); i < providesCount; i++ {
+		var p moduleProvides
+		p.service = c.getClassInfoAt(cr.u2()).className()
+		withCount := cr.u2()
+		for j := uint16(0); j < withCount; j++ {
+			p.with = append(p.with, c.getClassInfoAt(cr.u2()).className())
+		}
+		m.provides = append(m.provides, p)
+	}
+	return &m
+}
+
+func parsePackageRules(c *Class, cr classDecoder) []modulePackageRule {
+	var rules []modulePackageRule
+	count := cr.u2()
+	for i := uint16(0); i < count; i++ {
+		var r modulePackageRule
+		r.pkg = c.getPackageNameAt(cr.u2())
+		r.flags = cr.u2()
+		toCount := cr.u2()
+		for j := uint16(0); j < toCount; j++ {
+			r.to = append(r.to, c.getModuleNameAt(cr.u2()))
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// module is a module loaded by the VM. Classes that are not loaded from the
+// module path belong to the unnamed module, which has no descriptor.
+type module struct {
+	name       string
+	dir        string
+	descriptor *moduleDescriptor
+	packages   map[string]bool
+	mainClass  string
+	object     *javaObject
+}
+
+func (m *module) named() bool {
+	return m.descriptor != nil
+}
+
+func (m *module) String() string {
+	if !m.named() {
+		return "unnamed module"
+	}
+	return "module " + m.name
+}
+
+// AddModulePath adds every exploded module found at path. The path is either
+// a module directory itself or a directory of module directories.
+func (vm *VM) AddModulePath(path string) error {
+	if _, err := os.Stat(filepath.Join(path, "module-info.class")); err == nil {
+		return vm.addModule(path)
+	}
+	dirs, err := filepath.Glob(filepath.Join(path, "*", "module-info.class"))
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if err := vm.addModule(filepath.Dir(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (vm *VM) addModule(dir string) error {
+	file, err := os.Open(filepath.Join(dir, "module-info.class"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := ParseClass(file)
+	if err != nil {
+		return err
+	}
+	if info.module == nil {
+		return fmt.Errorf("%s has no Module attribute", file.Name())
+	}
+	m := &module{
+		name:       info.module.name,
+		dir:        dir,
+		descriptor: info.module,
+		packages:   make(map[string]bool),
+		mainClass:  info.moduleMainClass,
+	}
+	if info.modulePackages != nil {
+		for _, p := range info.modulePackages {
+			m.packages[p] = true
+		}
+	} else {
+		filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+			if err == nil && !f.IsDir() && strings.HasSuffix(path, ".class") && filepath.Base(path) != "module-info.class" {
+				rel, _ := filepath.Rel(dir, filepath.Dir(path))
+				m.packages[filepath.ToSlash(rel)] = true
+			}
+			return nil
+		})
+	}
+	if vm.modules[m.name] != nil {
+		return fmt.Errorf("module %s found more than once on the module path", m.name)
+	}
+	vm.modules[m.name] = m
+	return nil
+}
+
+// SetMainModule selects the module, and optionally the class within it, that
+// Run starts executing. Without a class the module's ModuleMainClass is used.
+func (vm *VM) SetMainModule(name, mainClass string) error {
+	m := vm.modules[name]
+	if m == nil {
+		return fmt.Errorf("module %s not found", name)
+	}
+	if mainClass == "" {
+		mainClass = m.mainClass
+	}
+	if mainClass == "" {
+		return fmt.Errorf("module %s does not have a ModuleMainClass attribute", name)
+	}
+	vm.mainClass = strings.Replace(mainClass, ".", "/", -1)
+	return nil
+}
+
+func packageName(className string) string {
+	i := strings.LastIndex(className, "/")
+	if i < 0 {
+		return ""
+	}
+	return className[:i]
+}
+
+// moduleForPackage returns the named module that contains pkg, if any.
+func (vm *VM) moduleForPackage(pkg string) *module {
+	for _, m := range vm.modules {
+		if m.packages[pkg] {
+			return m
+		}
+	}
+	return nil
+}
+
+// reads reports whether module from can read module to. The unnamed module
+// reads every module and every module reads java.base, but named modules
+// can't read the unnamed module.
+func (vm *VM) reads(from, to *module) bool {
+	if from == to || !from.named() || to.name == "java.base" {
+		return true
+	}
+	if !to.named() {
+		return false
+	}
+	seen := make(map[string]bool)
+	var requires func(m *module, transitiveOnly bool) bool
+	requires = func(m *module, transitiveOnly bool) bool {
+		for _, r := range m.descriptor.requires {
+			if transitiveOnly && r.flags&requiresTransitive == 0 {
+				continue
+			}
+			if r.name == to.name {
+				return true
+			}
+			dep := vm.modules[r.name]
+			if dep != nil && dep.named() && !seen[dep.name] {
+				seen[dep.name] = true
+				if requires(dep, true) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return requires(from, false)
+}
+
+// exports reports whether module m makes pkg available to module to.
+func (m *module) exports(pkg string, to *module) bool {
+	if !m.named() || m == to {
+		return true
+	}
+	for _, e := range m.descriptor.exports {
+		if e.pkg != pkg {
+			continue
+		}
+		if len(e.to) == 0 {
+			return true
+		}
+		for _, name := range e.to {
+			if name == to.name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classLibraryPackages are the prefixes of the packages of the class library.
+// It is loaded from the class path, so its classes are in the unnamed module,
+// but they stand in for java.base, which every module reads.
+var classLibraryPackages = []string{"java/", "jdk/", "sun/"}
+
+func inClassLibrary(c *Class) bool {
+	for _, prefix := range classLibraryPackages {
+		if strings.HasPrefix(c.Name(), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (vm *VM) moduleOf(c *Class) *module {
+	if c.definingModule == nil {
+		return vm.unnamedModule
+	}
+	return c.definingModule
+}
+
+// checkModuleAccess makes sure accessor may refer to class c: the module of
+// accessor has to read the module of c and that module has to export the
+// package of c to it.
+func (vm *VM) checkModuleAccess(accessor, c *Class) error {
+	from := vm.moduleOf(accessor)
+	to := vm.moduleOf(c)
+	if !to.named() && inClassLibrary(c) {
+		return nil
+	}
+	if !vm.reads(from, to) {
+		return linkageError{"java/lang/IllegalAccessError", fmt.Sprintf("class %s (in %v) cannot access class %s (in %v) because %v does not read %v",
+			accessor.Name(), from, c.Name(), to, from, to)}
+	}
+	if !to.exports(packageName(c.Name()), from) {
+		return linkageError{"java/lang/IllegalAccessError", fmt.Sprintf("class %s (in %v) cannot access class %s (in %v) because %v does not export %s to %v",
+			accessor.Name(), from, c.Name(), to, to, packageName(c.Name()), from)}
+	}
+	return nil
+}
+
+// moduleObject returns the java.lang.Module instance for the module of c, or
+// a null reference when the class library has no java.lang.Module.
+func (vm *VM) moduleObject(c *Class) javaObject {
+	m := vm.moduleOf(c)
+	if m.object != nil {
+		return *m.object
+	}
+	moduleClass := vm.findClass("java/lang/Module")
+	if moduleClass == nil {
+		return javaObject{}
+	}
+	o := vm.newInstance(moduleClass)
+	if m.named() {
+		o.setField("name", nativeStringToJavaString(vm, m.name))
+	} else {
+		o.setField("name", javaObject{})
+	}
+	m.object = &o
+	return o
+}
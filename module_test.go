@@ -0,0 +1,94 @@
+package java
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func (w *classWriter) moduleConstant(name string) uint16 {
+	n := w.utf8(name)
+	return w.constant("module "+name, func() {
+		w.u1(19)
+		w.u2(n)
+	})
+}
+
+func (w *classWriter) packageConstant(name string) uint16 {
+	n := w.utf8(name)
+	return w.constant("package "+name, func() {
+		w.u1(20)
+		w.u2(n)
+	})
+}
+
+// moduleInfo builds the module-info class of the module called name, which
+// requires and exports the modules and packages given.
+func moduleInfo(name string, requires, exports []string) *classWriter {
+	w := newClassWriter(0x8000, "module-info", "java/lang/Object", nil)
+	w.super = 0
+	data := u2s(w.moduleConstant(name), 0, 0, uint16(len(requires)))
+	for _, r := range requires {
+		data = append(data, u2s(w.moduleConstant(r), 0, 0)...)
+	}
+	data = append(data, u2s(uint16(len(exports)))...)
+	for _, e := range exports {
+		data = append(data, u2s(w.packageConstant(e), 0, 0)...)
+	}
+	data = append(data, u2s(0, 0, 0)...)
+	w.attribute("Module", data)
+	return w
+}
+
+func emptyClass(name string) *classWriter {
+	return newClassWriter(Public|Super, name, "java/lang/Object", nil)
+}
+
+func TestModuleAccess(t *testing.T) {
+	modules, classPath := t.TempDir(), t.TempDir()
+	a, b := filepath.Join(modules, "a"), filepath.Join(modules, "b")
+	writeClass(t, a, "module-info", moduleInfo("a", []string{"b"}, nil))
+	writeClass(t, a, "a/A", emptyClass("a/A"))
+	writeClass(t, b, "module-info", moduleInfo("b", nil, []string{"b"}))
+	writeClass(t, b, "b/B", emptyClass("b/B"))
+	writeClass(t, b, "b/internal/Hidden", emptyClass("b/internal/Hidden"))
+	writeClass(t, classPath, "Plain", emptyClass("Plain"))
+	writeClass(t, classPath, "java/lang/Object", newClassWriter(Public|Super, "java/lang/Object", "java/lang/Object", nil))
+
+	vm := NewVM()
+	if err := vm.AddModulePath(modules); err != nil {
+		t.Fatal(err)
+	}
+	vm.AddDirectory(classPath)
+	class := func(name string) *Class {
+		c := vm.findClass(name)
+		if c == nil {
+			t.Fatalf("unable to load %s", name)
+		}
+		return c
+	}
+
+	tests := []struct {
+		from, to string
+		problem  string
+	}{
+		{"a/A", "b/B", ""},
+		{"a/A", "java/lang/Object", ""},
+		{"a/A", "b/internal/Hidden", "module b does not export b/internal to module a"},
+		{"b/B", "a/A", "module b does not read module a"},
+		{"a/A", "Plain", "module a does not read unnamed module"},
+		{"Plain", "b/B", ""},
+		{"Plain", "b/internal/Hidden", "module b does not export b/internal to unnamed module"},
+	}
+	for _, test := range tests {
+		err := vm.checkModuleAccess(class(test.from), class(test.to))
+		switch {
+		case test.problem == "" && err != nil:
+			t.Errorf("%s can't access %s: %v", test.from, test.to, err)
+		case test.problem != "" && err == nil:
+			t.Errorf("%s can access %s", test.from, test.to)
+		case err != nil && (err.(linkageError).class != "java/lang/IllegalAccessError" || !strings.HasSuffix(err.Error(), test.problem)):
+			t.Errorf("%s accessing %s: got %v, want IllegalAccessError ending %q", test.from, test.to, err, test.problem)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package java
+
+import (
+	"io"
+	"log"
+)
+
+// thread is a thread of execution. The VM only runs its main thread so far.
+type thread struct {
+	name string
+	// hashState is the state of the generator of identity hashes.
+	hashState [4]uint32
+	// monitors are the monitors the thread holds.
+	monitors []*monitor
+}
+
+// monitor is the re-entrant lock every object has. It is free when count is
+// zero, and otherwise owner has entered it count times.
+type monitor struct {
+	owner *thread
+	count int
+}
+
+// monitorOf returns the monitor of the non-null reference r.
+func (vm *VM) monitorOf(r javaReference) *monitor {
+	h := headerOf(r)
+	if h.monitor == nil {
+		h.monitor = &monitor{}
+	}
+	return h.monitor
+}
+
+// enter locks m for t, or locks it once more if t already holds it. It
+// reports false if another thread holds m.
+func (m *monitor) enter(t *thread) bool {
+	if m.count > 0 && m.owner != t {
+		return false
+	}
+	if m.count == 0 {
+		t.monitors = append(t.monitors, m)
+	}
+	m.owner = t
+	m.count++
+	return true
+}
+
+// exit undoes one enter by t. It reports false if t doesn't hold m.
+func (m *monitor) exit(t *thread) bool {
+	if m.count == 0 || m.owner != t {
+		return false
+	}
+	m.count--
+	if m.count == 0 {
+		m.owner = nil
+		for i, held := range t.monitors {
+			if held == m {
+				t.monitors = append(t.monitors[:i], t.monitors[i+1:]...)
+				break
+			}
+		}
+	}
+	return true
+}
+
+// releaseAll exits every monitor t holds.
+func (t *thread) releaseAll() {
+	for _, m := range t.monitors {
+		m.owner = nil
+		m.count = 0
+	}
+	t.monitors = nil
+}
+
+// finalizerBlocked is what the finalizer thread panics with when it has to
+// wait for a monitor, to give up on the finalizer it is running.
+type finalizerBlocked struct{}
+
+// enter locks m for the running thread. Only the finalizer thread can find m
+// held by another thread, the main thread it runs in the middle of, which
+// won't let go of m until the finalizer returns. The finalizer is given up on
+// then, to be run again later.
+func (vm *VM) enter(m *monitor) {
+	if m.enter(vm.thread) {
+		return
+	}
+	if vm.thread == vm.finalizer {
+		panic(finalizerBlocked{})
+	}
+	log.Panicf("Thread %s would wait for a monitor held by %s, but there is no other thread to run", vm.thread.name, m.owner.name)
+}
+
+// enterMethod locks the monitor of a synchronized method run by f: the one of
+// its receiver, or of the mirror of its class if it is static.
+func (vm *VM) enterMethod(f *Frame, args []javaValue) {
+	if f.Method.accessFlags&Synchronized == 0 {
+		return
+	}
+	if f.Method.Static() {
+		f.monitor = vm.monitorOf(vm.classMirror("L" + f.Method.Class().Name() + ";"))
+	} else {
+		f.monitor = vm.monitorOf(args[0].(javaReference))
+	}
+	vm.enter(f.monitor)
+}
+
+// exitMethod unlocks the monitor f locked on entering a synchronized method.
+// It reports false if the thread no longer held it.
+func (vm *VM) exitMethod(f *Frame) bool {
+	if f.monitor == nil {
+		return true
+	}
+	m := f.monitor
+	f.monitor = nil
+	return m.exit(vm.thread)
+}
+
+// checkOwner throws IllegalMonitorStateException from the native method
+// running in f unless the thread holds the monitor of its receiver.
+func (vm *VM) checkOwner(f *Frame) bool {
+	m := vm.monitorOf(f.Variables[0].(javaReference))
+	if m.count == 0 || m.owner != vm.thread {
+		f.thrown = vm.newThrowable("java/lang/IllegalMonitorStateException", "current thread is not owner")
+		return false
+	}
+	return true
+}
+
+// nativeWait implements Object.wait. There is no other thread to notify the
+// one waiting, so it wakes up straight away, which Java allows waits to do.
+func nativeWait(vm *VM, f *Frame, w io.Writer) {
+	// The timeout, if there is one, follows the receiver.
+	if len(f.Variables) > 1 && f.Variables[1].(javaLong) < 0 {
+		f.thrown = vm.newThrowable("java/lang/IllegalArgumentException", "timeout value is negative")
+		return
+	}
+	vm.checkOwner(f)
+}
+
+func nativeNotify(vm *VM, f *Frame, w io.Writer) {
+	vm.checkOwner(f)
+}
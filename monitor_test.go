@@ -0,0 +1,82 @@
+package java
+
+import (
+	"testing"
+)
+
+func TestMonitors(t *testing.T) {
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	// release leaves the monitor that being synchronized entered.
+	main.code(Public|Static|Synchronized, "release", "()V", 0, func(a *assembler) {
+		a.index("ldc_w", a.w.class("Main"))
+		a.op("monitorexit")
+		a.op("return")
+	})
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 2, func(a *assembler) {
+		object := func() {
+			a.class("new", "java/lang/Object")
+			a.op("dup")
+			a.invoke("invokespecial", "java/lang/Object", "<init>", "()V")
+		}
+		object()
+		a.op("astore_1")
+		a.op("aload_1")
+		a.op("monitorenter")
+		a.op("aload_1")
+		a.op("monitorenter")
+		a.op("aload_1")
+		a.invoke("invokevirtual", "java/lang/Object", "notify", "()V")
+		a.op("aload_1")
+		a.op("lconst_0")
+		a.invoke("invokevirtual", "java/lang/Object", "wait", "(J)V")
+		a.op("aload_1")
+		a.op("monitorexit")
+		a.op("aload_1")
+		a.op("monitorexit")
+		a.ldc("notified\n")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+
+		a.printThrows(
+			func() {
+				a.op("aload_1")
+				a.op("monitorexit")
+			},
+			func() {
+				a.op("aload_1")
+				a.invoke("invokevirtual", "java/lang/Object", "notify", "()V")
+			},
+			func() {
+				a.op("aload_1")
+				a.op("lconst_1")
+				a.invoke("invokevirtual", "java/lang/Object", "wait", "(J)V")
+			},
+			func() {
+				a.op("aload_1")
+				a.op("monitorenter")
+				a.op("aload_1")
+				a.op("iconst_m1")
+				a.op("i2l")
+				a.invoke("invokevirtual", "java/lang/Object", "wait", "(J)V")
+			},
+			func() { a.invoke("invokestatic", "Main", "release", "()V") },
+		)
+		// The monitor entered before wait threw is still held.
+		a.op("aload_1")
+		a.op("monitorexit")
+		a.ldc("done\n")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.op("return")
+	})
+
+	got := run(newTestVM(t, main), "Main")
+	want := "notified\n" +
+		"java.lang.IllegalMonitorStateException: current thread is not owner\n" +
+		"java.lang.IllegalMonitorStateException: current thread is not owner\n" +
+		"java.lang.IllegalMonitorStateException: current thread is not owner\n" +
+		"java.lang.IllegalArgumentException: timeout value is negative\n" +
+		"java.lang.IllegalMonitorStateException: current thread is not owner\n" +
+		"done\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
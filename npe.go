@@ -0,0 +1,462 @@
+package java
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Helpful NullPointerException messages say what the failing instruction was
+// trying to do and where the null came from, for example
+//
+//	Cannot invoke "Printer.print()" because "this.printer" is null
+//
+// The first half comes from the failing instruction. For the second half a
+// data flow analysis of the method works out which instruction pushed each
+// value on the operand stack, which is then turned back into something that
+// looks like the source code.
+
+// stackEntry is a value on the operand stack during the analysis.
+type stackEntry struct {
+	// source is the index of the instruction that pushed the value, or -1
+	// when different paths through the method disagree.
+	source   int
+	category int
+}
+
+type sourceAnalysis struct {
+	method  *Method
+	ops     []OpCode
+	offsets []int
+	// stacks holds the operand stack before each instruction, nil for
+	// instructions that were never reached.
+	stacks [][]stackEntry
+}
+
+// maxExpressionDepth limits how much of an expression is rebuilt.
+const maxExpressionDepth = 5
+
+// nullPointerMessage describes the null reference that made the instruction
+// executing in f fail. It returns "" if there is nothing useful to say.
+func (vm *VM) nullPointerMessage(f *Frame) string {
+	if !vm.helpfulNullPointers || f.Root || f.Method.Native() {
+		return ""
+	}
+	a := analyseSources(f.Method)
+	i := a.instructionAt(f.PC.CurrentByteCodeIndex())
+	action, depth := a.failedAction(i)
+	if action == "" {
+		return ""
+	}
+	stack := a.stacks[i]
+	if depth >= len(stack) || stack[len(stack)-1-depth].source < 0 {
+		return action
+	}
+	because := a.describe(stack[len(stack)-1-depth].source)
+	if because == "" {
+		return action
+	}
+	return action + " because " + because + " is null"
+}
+
+// analyseSources finds the instruction behind every value on the operand
+// stack before each instruction of m. If the byte code can't be followed the
+// analysis stops early and leaves the remaining stacks unknown.
+func analyseSources(m *Method) *sourceAnalysis {
+	ops, offsets := Disassemble(m.Code.Instructions)
+	a := &sourceAnalysis{method: m, ops: ops, offsets: offsets, stacks: make([][]stackEntry, len(ops))}
+	var work []int
+	merge := func(i int, stack []stackEntry) bool {
+		if i < 0 || i >= len(ops) {
+			return false
+		}
+		if a.stacks[i] == nil {
+			a.stacks[i] = append([]stackEntry{}, stack...)
+			work = append(work, i)
+			return true
+		}
+		if len(a.stacks[i]) != len(stack) {
+			return false
+		}
+		changed := false
+		for j, e := range stack {
+			if a.stacks[i][j].source != e.source && a.stacks[i][j].source >= 0 {
+				a.stacks[i][j].source = -1
+				changed = true
+			}
+		}
+		if changed {
+			work = append(work, i)
+		}
+		return true
+	}
+	merge(0, nil)
+	for _, h := range m.Code.ExceptionHandlers {
+		merge(a.instructionAt(int(h.Handler)), []stackEntry{{-1, 1}})
+	}
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		out, ok := a.step(i, a.stacks[i])
+		if !ok {
+			return a
+		}
+		for _, next := range a.successors(i) {
+			stack := out
+			if name := ops[i].name; name == "jsr" || name == "jsr_w" {
+				// The subroutine returns to the next instruction without
+				// the return address.
+				if next == i+1 {
+					stack = a.stacks[i]
+				}
+			}
+			if !merge(next, stack) {
+				return a
+			}
+		}
+	}
+	return a
+}
+
+// instructionAt converts a byte code index into an index into a.ops.
+func (a *sourceAnalysis) instructionAt(index int) int {
+	i := sort.SearchInts(a.offsets, index)
+	if i == len(a.offsets) || a.offsets[i] != index {
+		return -1
+	}
+	return i
+}
+
+// successors lists the instructions that can run after instruction i.
+func (a *sourceAnalysis) successors(i int) []int {
+	op := a.ops[i]
+	target := func(offset int) int {
+		return a.instructionAt(a.offsets[i] + offset)
+	}
+	switch op.name {
+	case "goto":
+		return []int{target(int(op.int16()))}
+	case "goto_w":
+		return []int{target(int(op.int32At(0)))}
+	case "jsr":
+		return []int{target(int(op.int16())), i + 1}
+	case "jsr_w":
+		return []int{target(int(op.int32At(0))), i + 1}
+	case "ifeq", "ifne", "iflt", "ifge", "ifgt", "ifle",
+		"if_icmpeq", "if_icmpne", "if_icmplt", "if_icmpge", "if_icmpgt", "if_icmple",
+		"if_acmpeq", "if_acmpne", "ifnull", "ifnonnull":
+		return []int{i + 1, target(int(op.int16()))}
+	case "tableswitch", "lookupswitch":
+		var next []int
+		for _, c := range op.SwitchCases() {
+			next = append(next, target(int(c.Offset)))
+		}
+		return next
+	case "ret", "ireturn", "lreturn", "freturn", "dreturn", "areturn", "return", "athrow":
+		return nil
+	}
+	return []int{i + 1}
+}
+
+// step works out the operand stack after instruction i from the one before it.
+func (a *sourceAnalysis) step(i int, in []stackEntry) ([]stackEntry, bool) {
+	op := a.ops[i]
+	stack := append([]stackEntry{}, in...)
+	// words pops values totalling n words, returning them bottom first.
+	words := func(n int) ([]stackEntry, bool) {
+		start := len(stack)
+		for n > 0 && start > 0 {
+			start--
+			n -= stack[start].category
+		}
+		if n != 0 {
+			return nil, false
+		}
+		values := append([]stackEntry{}, stack[start:]...)
+		stack = stack[:start]
+		return values, true
+	}
+	// Stack manipulation moves values around without creating new ones.
+	shuffles := map[string][2]int{
+		"pop": {1, 0}, "pop2": {2, 0},
+		"dup": {1, -1}, "dup2": {2, -1},
+		"dup_x1": {1, 1}, "dup_x2": {1, 2},
+		"dup2_x1": {2, 1}, "dup2_x2": {2, 2},
+		"swap": {1, 1},
+	}
+	if shuffle, ok := shuffles[op.name]; ok {
+		value1, ok := words(shuffle[0])
+		if !ok {
+			return nil, false
+		}
+		switch {
+		case op.name == "pop" || op.name == "pop2":
+		case op.name == "swap":
+			value2, ok := words(1)
+			if !ok {
+				return nil, false
+			}
+			stack = append(append(stack, value1...), value2...)
+		case shuffle[1] < 0:
+			stack = append(append(stack, value1...), value1...)
+		default:
+			value2, ok := words(shuffle[1])
+			if !ok {
+				return nil, false
+			}
+			stack = append(append(append(stack, value1...), value2...), value1...)
+		}
+		return stack, true
+	}
+	if op.name == "checkcast" {
+		// A cast doesn't change where a reference came from.
+		return stack, len(stack) > 0
+	}
+	pops, pushes, ok := a.stackEffect(op)
+	if !ok || pops > len(stack) {
+		return nil, false
+	}
+	stack = stack[:len(stack)-pops]
+	if pushes > 0 {
+		stack = append(stack, stackEntry{i, pushes})
+	}
+	return stack, true
+}
+
+// stackEffect is the number of values op pops and the category of the value
+// it pushes, which is zero when it doesn't push anything.
+func (a *sourceAnalysis) stackEffect(op OpCode) (int, int, bool) {
+	c := a.method.Class()
+	name := localOpName(op.name)
+	switch name {
+	case "nop", "iinc", "goto", "goto_w", "ret", "return":
+		return 0, 0, true
+	case "aconst_null", "iconst_m1", "iconst_0", "iconst_1", "iconst_2", "iconst_3", "iconst_4", "iconst_5",
+		"fconst_0", "fconst_1", "fconst_2", "bipush", "sipush", "ldc", "ldc_w",
+		"iload", "fload", "aload", "new", "jsr", "jsr_w":
+		return 0, 1, true
+	case "lconst_0", "lconst_1", "dconst_0", "dconst_1", "ldc2_w", "lload", "dload":
+		return 0, 2, true
+	case "istore", "lstore", "fstore", "dstore", "astore",
+		"ifeq", "ifne", "iflt", "ifge", "ifgt", "ifle", "ifnull", "ifnonnull",
+		"tableswitch", "lookupswitch", "ireturn", "lreturn", "freturn", "dreturn", "areturn",
+		"athrow", "putstatic", "monitorenter", "monitorexit":
+		return 1, 0, true
+	case "if_icmpeq", "if_icmpne", "if_icmplt", "if_icmpge", "if_icmpgt", "if_icmple",
+		"if_acmpeq", "if_acmpne", "putfield":
+		return 2, 0, true
+	case "iaload", "faload", "aaload", "baload", "caload", "saload":
+		return 2, 1, true
+	case "laload", "daload":
+		return 2, 2, true
+	case "iastore", "lastore", "fastore", "dastore", "aastore", "bastore", "castore", "sastore":
+		return 3, 0, true
+	case "lcmp", "fcmpl", "fcmpg", "dcmpl", "dcmpg":
+		return 2, 1, true
+	case "newarray", "anewarray", "arraylength", "instanceof":
+		return 1, 1, true
+	case "multianewarray":
+		return int(op.args[2]), 1, true
+	case "getstatic":
+		return 0, descriptorCategory(c.getFieldRefAt(op.uint16()).fieldDescriptor()), true
+	case "getfield":
+		return 1, descriptorCategory(c.getFieldRefAt(op.uint16()).fieldDescriptor()), true
+	case "invokevirtual", "invokespecial", "invokestatic", "invokeinterface":
+		params, ret := splitDescriptor(c.getMethodReferenceAt(op.uint16()).methodType())
+		pops := len(params)
+		if name != "invokestatic" {
+			pops++
+		}
+		return pops, descriptorCategory(ret), true
+	case "invokedynamic":
+		params, ret := splitDescriptor(c.getInvokeDynamicAt(op.uint16()).descriptor())
+		return len(params), descriptorCategory(ret), true
+	}
+	// What's left is arithmetic and conversions, which are named after the
+	// types they work on.
+	category := func(t byte) int {
+		if t == 'l' || t == 'd' {
+			return 2
+		}
+		return 1
+	}
+	if len(name) == 3 && name[1] == '2' {
+		return 1, category(name[2]), true
+	}
+	switch name[1:] {
+	case "add", "sub", "mul", "div", "rem", "shl", "shr", "ushr", "and", "or", "xor":
+		return 2, category(name[0]), true
+	case "neg":
+		return 1, category(name[0]), true
+	}
+	return 0, 0, false
+}
+
+// descriptorCategory is the category of a value of the type described by
+// descriptor, or zero for void.
+func descriptorCategory(descriptor string) int {
+	switch descriptor[0] {
+	case 'V':
+		return 0
+	case 'J', 'D':
+		return 2
+	}
+	return 1
+}
+
+// failedAction describes what instruction i was doing when it found a null,
+// and how many values down the stack the null was.
+func (a *sourceAnalysis) failedAction(i int) (string, int) {
+	if i < 0 {
+		return "", 0
+	}
+	op := a.ops[i]
+	c := a.method.Class()
+	arrays := map[byte]string{
+		'i': "int", 'l': "long", 'f': "float", 'd': "double",
+		'a': "object", 'b': "byte/boolean", 'c': "char", 's': "short",
+	}
+	switch op.name {
+	case "getfield":
+		return fmt.Sprintf("Cannot read field %q", c.getFieldRefAt(op.uint16()).fieldName()), 0
+	case "putfield":
+		return fmt.Sprintf("Cannot assign field %q", c.getFieldRefAt(op.uint16()).fieldName()), 1
+	case "invokevirtual", "invokespecial", "invokeinterface":
+		ref := c.getMethodReferenceAt(op.uint16())
+		params, _ := splitDescriptor(ref.methodType())
+		return fmt.Sprintf("Cannot invoke %q", methodDescription(ref)), len(params)
+	case "arraylength":
+		return "Cannot read the array length", 0
+	case "iaload", "laload", "faload", "daload", "aaload", "baload", "caload", "saload":
+		return "Cannot load from " + arrays[op.name[0]] + " array", 1
+	case "iastore", "lastore", "fastore", "dastore", "aastore", "bastore", "castore", "sastore":
+		return "Cannot store to " + arrays[op.name[0]] + " array", 2
+	case "athrow":
+		return "Cannot throw exception", 0
+	case "monitorenter":
+		return "Cannot enter synchronized block", 0
+	case "monitorexit":
+		return "Cannot exit synchronized block", 0
+	}
+	return "", 0
+}
+
+// describe says where the value pushed by instruction i came from.
+func (a *sourceAnalysis) describe(i int) string {
+	switch a.ops[i].name {
+	case "invokevirtual", "invokespecial", "invokestatic", "invokeinterface":
+		ref := a.method.Class().getMethodReferenceAt(a.ops[i].uint16())
+		return fmt.Sprintf("the return value of %q", methodDescription(ref))
+	}
+	if e, ok := a.expression(i, 0); ok {
+		return `"` + e + `"`
+	}
+	return ""
+}
+
+// expression rebuilds the source code for the value pushed by instruction i.
+func (a *sourceAnalysis) expression(i int, depth int) (string, bool) {
+	if i < 0 || depth > maxExpressionDepth {
+		return "...", false
+	}
+	op := a.ops[i]
+	c := a.method.Class()
+	// operand rebuilds the value n down the stack before instruction i.
+	operand := func(n int) (string, bool) {
+		stack := a.stacks[i]
+		if n >= len(stack) {
+			return "...", false
+		}
+		return a.expression(stack[len(stack)-1-n].source, depth+1)
+	}
+	switch localOpName(op.name) {
+	case "aconst_null":
+		return "null", true
+	case "iconst_m1":
+		return "-1", true
+	case "iconst_0", "iconst_1", "iconst_2", "iconst_3", "iconst_4", "iconst_5":
+		return op.name[len(op.name)-1:], true
+	case "bipush":
+		return fmt.Sprint(op.int8()), true
+	case "sipush":
+		return fmt.Sprint(op.int16()), true
+	case "iload", "lload", "fload", "dload", "aload":
+		return a.localName(op.localIndex(), a.offsets[i]), true
+	case "getstatic":
+		ref := c.getFieldRefAt(op.uint16())
+		return printableName("L"+ref.className()+";") + "." + ref.fieldName(), true
+	case "getfield":
+		ref := c.getFieldRefAt(op.uint16())
+		if o, ok := operand(0); ok {
+			return o + "." + ref.fieldName(), true
+		}
+		return ref.fieldName(), true
+	case "iaload", "laload", "faload", "daload", "aaload", "baload", "caload", "saload":
+		array, ok := operand(1)
+		if !ok {
+			return "", false
+		}
+		index, _ := operand(0)
+		return array + "[" + index + "]", true
+	case "invokevirtual", "invokespecial", "invokestatic", "invokeinterface":
+		return methodDescription(c.getMethodReferenceAt(op.uint16())), true
+	}
+	return "...", false
+}
+
+// localOpName turns the names of loads and stores with an implicit local
+// variable, like aload_1, into the name of the general instruction.
+func localOpName(name string) string {
+	i := strings.LastIndexByte(name, '_')
+	if i > 0 && (strings.HasSuffix(name[:i], "load") || strings.HasSuffix(name[:i], "store")) {
+		return name[:i]
+	}
+	return name
+}
+
+// localName names local variable slot at byte code index pc, falling back on
+// its position when there's no LocalVariableTable.
+func (a *sourceAnalysis) localName(slot int, pc int) string {
+	for _, v := range a.method.Code.LocalVariables {
+		if int(v.Index) == slot && pc >= int(v.Start) && pc < int(v.Start)+int(v.Length) {
+			return v.Name
+		}
+	}
+	params, _ := splitDescriptor(a.method.RawSigniture)
+	parameterSlot := 0
+	if !a.method.Static() {
+		if slot == 0 {
+			return "this"
+		}
+		parameterSlot = 1
+	}
+	for n, p := range params {
+		if slot == parameterSlot {
+			return fmt.Sprintf("<parameter%d>", n+1)
+		}
+		parameterSlot += descriptorCategory(p)
+	}
+	return fmt.Sprintf("<local%d>", slot)
+}
+
+// methodDescription is how a method is shown in messages, such as
+// "Printer.print(String, int)".
+func methodDescription(ref methodReference) string {
+	params, _ := splitDescriptor(ref.methodType())
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = printableName(p)
+	}
+	return printableName("L"+ref.className()+";") + "." + ref.methodName() + "(" + strings.Join(names, ", ") + ")"
+}
+
+// printableName is the Java name of the type described by descriptor, with
+// java.lang left off Object and String as they're so common.
+func printableName(descriptor string) string {
+	name := typeName(descriptor)
+	switch strings.TrimRight(name, "[]") {
+	case "java.lang.Object", "java.lang.String":
+		return strings.TrimPrefix(name, "java.lang.")
+	}
+	return name
+}
@@ -1,8 +1,10 @@
 package java
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 )
 
@@ -16,7 +18,56 @@ func (op OpCode) Name() string {
 	return op.name
 }
 
+// wideOpCode is the byte of the wide prefix. A widened instruction keeps the
+// name of the instruction it modifies and has that instruction's byte as its
+// first argument.
+const wideOpCode = 196
+
+// Wide reports whether the instruction has a wide prefix, giving it a two
+// byte local variable index and, for iinc, a two byte constant.
+func (op OpCode) Wide() bool {
+	return op.byte == wideOpCode
+}
+
+// localIndex is the local variable an instruction like iload, aload_1 or ret
+// refers to.
+func (op OpCode) localIndex() int {
+	if op.Wide() {
+		return int(binary.BigEndian.Uint16(op.args[1:]))
+	}
+	if len(op.args) == 0 {
+		return int(op.name[len(op.name)-1] - '0')
+	}
+	return int(op.args[0])
+}
+
+// incrementConstant is the signed constant iinc adds to its local variable.
+func (op OpCode) incrementConstant() int32 {
+	if op.Wide() {
+		return int32(int16(binary.BigEndian.Uint16(op.args[3:])))
+	}
+	return int32(int8(op.args[1]))
+}
+
 func (op OpCode) String() string {
+	if cases := op.SwitchCases(); cases != nil {
+		result := make([]string, len(cases))
+		for i, c := range cases {
+			if c.Default {
+				result[i] = fmt.Sprintf("default: %+d", c.Offset)
+			} else {
+				result[i] = fmt.Sprintf("%d: %+d", c.Match, c.Offset)
+			}
+		}
+		return op.Name() + " {" + strings.Join(result, ", ") + "}"
+	}
+	if op.Wide() {
+		result := []string{"wide", op.Name(), fmt.Sprintf("%d", op.localIndex())}
+		if op.name == "iinc" {
+			result = append(result, fmt.Sprintf("%d", op.incrementConstant()))
+		}
+		return strings.Join(result, " ")
+	}
 	result := make([]string, len(op.args)+1)
 	result[0] = op.Name()
 	for i, a := range op.args {
@@ -43,17 +94,87 @@ func (op OpCode) uint16() uint16 {
 	return x
 }
 
-func (op OpCode) int8() byte {
+func (op OpCode) int8() int8 {
+	return int8(op.args[0])
+}
+
+func (op OpCode) uint8() uint8 {
 	return op.args[0]
 }
 
-func bytesToOpcode(bytes []byte) OpCode {
+func (op OpCode) int32At(i int) int32 {
+	return int32(binary.BigEndian.Uint32(op.args[i:]))
+}
+
+// switchPadding is the number of bytes between a tableswitch or lookupswitch
+// at index and its operands, which start on a multiple of four.
+func switchPadding(index int) int {
+	return (4 - (index+1)%4) % 4
+}
+
+// A SwitchCase is one jump target of a tableswitch or lookupswitch. Offset is
+// relative to the start of the switch instruction.
+type SwitchCase struct {
+	Match   int32
+	Offset  int32
+	Default bool
+}
+
+// SwitchCases lists the jump targets of a tableswitch or lookupswitch with the
+// default target last. The operands of a switch are a multiple of four bytes
+// long so the padding in front of them is whatever is left over.
+func (op OpCode) SwitchCases() []SwitchCase {
+	var cases []SwitchCase
+	pad := len(op.args) % 4
+	switch op.name {
+	case "tableswitch":
+		low := op.int32At(pad + 4)
+		for i := pad + 12; i < len(op.args); i += 4 {
+			cases = append(cases, SwitchCase{Match: low, Offset: op.int32At(i)})
+			low++
+		}
+	case "lookupswitch":
+		for i := pad + 8; i < len(op.args); i += 8 {
+			cases = append(cases, SwitchCase{Match: op.int32At(i), Offset: op.int32At(i + 4)})
+		}
+	default:
+		return nil
+	}
+	return append(cases, SwitchCase{Offset: op.int32At(pad), Default: true})
+}
+
+// switchTarget returns the offset a tableswitch or lookupswitch jumps by for key.
+func (op OpCode) switchTarget(key int32) int32 {
+	pad := len(op.args) % 4
+	switch op.name {
+	case "tableswitch":
+		low := op.int32At(pad + 4)
+		high := op.int32At(pad + 8)
+		if key >= low && key <= high {
+			return op.int32At(pad + 12 + 4*int(int64(key)-int64(low)))
+		}
+	case "lookupswitch":
+		n := int(op.int32At(pad + 4))
+		i := sort.Search(n, func(i int) bool {
+			return op.int32At(pad+8+8*i) >= key
+		})
+		if i < n && op.int32At(pad+8+8*i) == key {
+			return op.int32At(pad + 8 + 8*i + 4)
+		}
+	}
+	return op.int32At(pad)
+}
+
+func bytesToOpcode(code []byte, index int) OpCode {
+	bytes := code[index:]
 	b := bytes[0]
 	switch b {
 	case 0:
 		return OpCode{b, "nop", nil}
 	case 1:
 		return OpCode{b, "aconst_null", nil}
+	case 2:
+		return OpCode{b, "iconst_m1", nil}
 	case 3:
 		return OpCode{b, "iconst_0", nil}
 	case 4:
@@ -66,18 +187,38 @@ func bytesToOpcode(bytes []byte) OpCode {
 		return OpCode{b, "iconst_4", nil}
 	case 8:
 		return OpCode{b, "iconst_5", nil}
+	case 9:
+		return OpCode{b, "lconst_0", nil}
+	case 10:
+		return OpCode{b, "lconst_1", nil}
+	case 11:
+		return OpCode{b, "fconst_0", nil}
+	case 12:
+		return OpCode{b, "fconst_1", nil}
 	case 13:
 		return OpCode{b, "fconst_2", nil}
+	case 14:
+		return OpCode{b, "dconst_0", nil}
 	case 15:
 		return OpCode{b, "dconst_1", nil}
 	case 16:
 		return OpCode{b, "bipush", bytes[1:2]}
+	case 17:
+		return OpCode{b, "sipush", bytes[1:3]}
 	case 18:
 		return OpCode{b, "ldc", bytes[1:2]}
+	case 19:
+		return OpCode{b, "ldc_w", bytes[1:3]}
 	case 20:
 		return OpCode{b, "ldc2_w", bytes[1:3]}
 	case 21:
 		return OpCode{b, "iload", bytes[1:2]}
+	case 22:
+		return OpCode{b, "lload", bytes[1:2]}
+	case 23:
+		return OpCode{b, "fload", bytes[1:2]}
+	case 24:
+		return OpCode{b, "dload", bytes[1:2]}
 	case 25:
 		return OpCode{b, "aload", bytes[1:2]}
 	case 26:
@@ -100,6 +241,18 @@ func bytesToOpcode(bytes []byte) OpCode {
 		return OpCode{b, "fload_0", nil}
 	case 35:
 		return OpCode{b, "fload_1", nil}
+	case 36:
+		return OpCode{b, "fload_2", nil}
+	case 37:
+		return OpCode{b, "fload_3", nil}
+	case 38:
+		return OpCode{b, "dload_0", nil}
+	case 39:
+		return OpCode{b, "dload_1", nil}
+	case 40:
+		return OpCode{b, "dload_2", nil}
+	case 41:
+		return OpCode{b, "dload_3", nil}
 	case 42:
 		return OpCode{b, "aload_0", nil}
 	case 43:
@@ -108,84 +261,272 @@ func bytesToOpcode(bytes []byte) OpCode {
 		return OpCode{b, "aload_2", nil}
 	case 45:
 		return OpCode{b, "aload_3", nil}
+	case 46:
+		return OpCode{b, "iaload", nil}
+	case 47:
+		return OpCode{b, "laload", nil}
+	case 48:
+		return OpCode{b, "faload", nil}
+	case 49:
+		return OpCode{b, "daload", nil}
+	case 50:
+		return OpCode{b, "aaload", nil}
+	case 51:
+		return OpCode{b, "baload", nil}
 	case 52:
 		return OpCode{b, "caload", nil}
+	case 53:
+		return OpCode{b, "saload", nil}
 	case 54:
 		return OpCode{b, "istore", bytes[1:2]}
+	case 55:
+		return OpCode{b, "lstore", bytes[1:2]}
+	case 56:
+		return OpCode{b, "fstore", bytes[1:2]}
+	case 57:
+		return OpCode{b, "dstore", bytes[1:2]}
 	case 58:
 		return OpCode{b, "astore", bytes[1:2]}
+	case 59:
+		return OpCode{b, "istore_0", nil}
 	case 60:
 		return OpCode{b, "istore_1", nil}
 	case 61:
 		return OpCode{b, "istore_2", nil}
 	case 62:
 		return OpCode{b, "istore_3", nil}
+	case 63:
+		return OpCode{b, "lstore_0", nil}
+	case 64:
+		return OpCode{b, "lstore_1", nil}
+	case 65:
+		return OpCode{b, "lstore_2", nil}
+	case 66:
+		return OpCode{b, "lstore_3", nil}
+	case 67:
+		return OpCode{b, "fstore_0", nil}
+	case 68:
+		return OpCode{b, "fstore_1", nil}
+	case 69:
+		return OpCode{b, "fstore_2", nil}
+	case 70:
+		return OpCode{b, "fstore_3", nil}
+	case 71:
+		return OpCode{b, "dstore_0", nil}
+	case 72:
+		return OpCode{b, "dstore_1", nil}
+	case 73:
+		return OpCode{b, "dstore_2", nil}
+	case 74:
+		return OpCode{b, "dstore_3", nil}
+	case 75:
+		return OpCode{b, "astore_0", nil}
 	case 76:
 		return OpCode{b, "astore_1", nil}
 	case 77:
 		return OpCode{b, "astore_2", nil}
 	case 78:
 		return OpCode{b, "astore_3", nil}
+	case 79:
+		return OpCode{b, "iastore", nil}
+	case 80:
+		return OpCode{b, "lastore", nil}
+	case 81:
+		return OpCode{b, "fastore", nil}
+	case 82:
+		return OpCode{b, "dastore", nil}
+	case 83:
+		return OpCode{b, "aastore", nil}
+	case 84:
+		return OpCode{b, "bastore", nil}
 	case 85:
 		return OpCode{b, "castore", nil}
+	case 86:
+		return OpCode{b, "sastore", nil}
 	case 87:
 		return OpCode{b, "pop", nil}
+	case 88:
+		return OpCode{b, "pop2", nil}
 	case 89:
 		return OpCode{b, "dup", nil}
 	case 90:
 		return OpCode{b, "dup_x1", nil}
+	case 91:
+		return OpCode{b, "dup_x2", nil}
+	case 92:
+		return OpCode{b, "dup2", nil}
+	case 93:
+		return OpCode{b, "dup2_x1", nil}
+	case 94:
+		return OpCode{b, "dup2_x2", nil}
+	case 95:
+		return OpCode{b, "swap", nil}
 	case 96:
 		return OpCode{b, "iadd", nil}
 	case 97:
 		return OpCode{b, "ladd", nil}
 	case 98:
 		return OpCode{b, "fadd", nil}
+	case 99:
+		return OpCode{b, "dadd", nil}
 	case 100:
 		return OpCode{b, "isub", nil}
 	case 101:
 		return OpCode{b, "lsub", nil}
 	case 102:
 		return OpCode{b, "fsub", nil}
+	case 103:
+		return OpCode{b, "dsub", nil}
 	case 104:
 		return OpCode{b, "imul", nil}
 	case 105:
 		return OpCode{b, "lmul", nil}
 	case 106:
 		return OpCode{b, "fmul", nil}
+	case 107:
+		return OpCode{b, "dmul", nil}
 	case 108:
 		return OpCode{b, "idiv", nil}
 	case 109:
 		return OpCode{b, "ldiv", nil}
 	case 110:
 		return OpCode{b, "fdiv", nil}
+	case 111:
+		return OpCode{b, "ddiv", nil}
+	case 112:
+		return OpCode{b, "irem", nil}
+	case 113:
+		return OpCode{b, "lrem", nil}
+	case 114:
+		return OpCode{b, "frem", nil}
+	case 115:
+		return OpCode{b, "drem", nil}
+	case 116:
+		return OpCode{b, "ineg", nil}
+	case 117:
+		return OpCode{b, "lneg", nil}
+	case 118:
+		return OpCode{b, "fneg", nil}
+	case 119:
+		return OpCode{b, "dneg", nil}
+	case 120:
+		return OpCode{b, "ishl", nil}
+	case 121:
+		return OpCode{b, "lshl", nil}
+	case 122:
+		return OpCode{b, "ishr", nil}
+	case 123:
+		return OpCode{b, "lshr", nil}
+	case 124:
+		return OpCode{b, "iushr", nil}
+	case 125:
+		return OpCode{b, "lushr", nil}
+	case 126:
+		return OpCode{b, "iand", nil}
+	case 127:
+		return OpCode{b, "land", nil}
+	case 128:
+		return OpCode{b, "ior", nil}
+	case 129:
+		return OpCode{b, "lor", nil}
+	case 130:
+		return OpCode{b, "ixor", nil}
+	case 131:
+		return OpCode{b, "lxor", nil}
 	case 132:
 		return OpCode{b, "iinc", bytes[1:3]}
+	case 133:
+		return OpCode{b, "i2l", nil}
+	case 134:
+		return OpCode{b, "i2f", nil}
+	case 135:
+		return OpCode{b, "i2d", nil}
+	case 136:
+		return OpCode{b, "l2i", nil}
+	case 137:
+		return OpCode{b, "l2f", nil}
+	case 138:
+		return OpCode{b, "l2d", nil}
+	case 139:
+		return OpCode{b, "f2i", nil}
+	case 140:
+		return OpCode{b, "f2l", nil}
+	case 141:
+		return OpCode{b, "f2d", nil}
+	case 142:
+		return OpCode{b, "d2i", nil}
+	case 143:
+		return OpCode{b, "d2l", nil}
+	case 144:
+		return OpCode{b, "d2f", nil}
+	case 145:
+		return OpCode{b, "i2b", nil}
+	case 146:
+		return OpCode{b, "i2c", nil}
+	case 147:
+		return OpCode{b, "i2s", nil}
+	case 148:
+		return OpCode{b, "lcmp", nil}
+	case 149:
+		return OpCode{b, "fcmpl", nil}
+	case 150:
+		return OpCode{b, "fcmpg", nil}
+	case 151:
+		return OpCode{b, "dcmpl", nil}
+	case 152:
+		return OpCode{b, "dcmpg", nil}
 	case 153:
 		return OpCode{b, "ifeq", bytes[1:3]}
 	case 154:
 		return OpCode{b, "ifne", bytes[1:3]}
+	case 155:
+		return OpCode{b, "iflt", bytes[1:3]}
 	case 156:
 		return OpCode{b, "ifge", bytes[1:3]}
 	case 157:
 		return OpCode{b, "ifgt", bytes[1:3]}
 	case 158:
 		return OpCode{b, "ifle", bytes[1:3]}
+	case 159:
+		return OpCode{b, "if_icmpeq", bytes[1:3]}
 	case 160:
 		return OpCode{b, "if_icmpne", bytes[1:3]}
+	case 161:
+		return OpCode{b, "if_icmplt", bytes[1:3]}
 	case 162:
 		return OpCode{b, "if_icmpge", bytes[1:3]}
 	case 163:
 		return OpCode{b, "if_icmpgt", bytes[1:3]}
 	case 164:
 		return OpCode{b, "if_icmple", bytes[1:3]}
+	case 165:
+		return OpCode{b, "if_acmpeq", bytes[1:3]}
+	case 166:
+		return OpCode{b, "if_acmpne", bytes[1:3]}
 	case 167:
 		return OpCode{b, "goto", bytes[1:3]}
+	case 168:
+		return OpCode{b, "jsr", bytes[1:3]}
+	case 169:
+		return OpCode{b, "ret", bytes[1:2]}
+	case 170:
+		pad := switchPadding(index)
+		low := int32(binary.BigEndian.Uint32(bytes[1+pad+4:]))
+		high := int32(binary.BigEndian.Uint32(bytes[1+pad+8:]))
+		n := int(int64(high) - int64(low) + 1)
+		return OpCode{b, "tableswitch", bytes[1 : 1+pad+12+4*n]}
+	case 171:
+		pad := switchPadding(index)
+		n := int(binary.BigEndian.Uint32(bytes[1+pad+4:]))
+		return OpCode{b, "lookupswitch", bytes[1 : 1+pad+8+8*n]}
 	case 172:
 		return OpCode{b, "ireturn", nil}
 	case 173:
 		return OpCode{b, "lreturn", nil}
 	case 174:
 		return OpCode{b, "freturn", nil}
+	case 175:
+		return OpCode{b, "dreturn", nil}
 	case 176:
 		return OpCode{b, "areturn", nil}
 	case 177:
@@ -206,6 +547,8 @@ func bytesToOpcode(bytes []byte) OpCode {
 		return OpCode{b, "invokestatic", bytes[1:3]}
 	case 185:
 		return OpCode{b, "invokeinterface", bytes[1:5]}
+	case 186:
+		return OpCode{b, "invokedynamic", bytes[1:5]}
 	case 187:
 		return OpCode{b, "new", bytes[1:3]}
 	case 188:
@@ -224,10 +567,27 @@ func bytesToOpcode(bytes []byte) OpCode {
 		return OpCode{b, "monitorenter", nil}
 	case 195:
 		return OpCode{b, "monitorexit", nil}
+	case wideOpCode:
+		op := bytesToOpcode(code, index+1)
+		switch op.name {
+		case "iload", "lload", "fload", "dload", "aload",
+			"istore", "lstore", "fstore", "dstore", "astore", "ret":
+			return OpCode{b, op.name, bytes[1:4]}
+		case "iinc":
+			return OpCode{b, op.name, bytes[1:6]}
+		default:
+			log.Panicf("Instruction %v cannot be widened", op.name)
+		}
+	case 197:
+		return OpCode{b, "multianewarray", bytes[1:4]}
 	case 198:
 		return OpCode{b, "ifnull", bytes[1:3]}
 	case 199:
 		return OpCode{b, "ifnonnull", bytes[1:3]}
+	case 200:
+		return OpCode{b, "goto_w", bytes[1:5]}
+	case 201:
+		return OpCode{b, "jsr_w", bytes[1:5]}
 	default:
 		log.Panicf("Unknown instruction: %v", b)
 	}
@@ -239,68 +599,74 @@ type ProgramCounter struct {
 	RawByteCodeIndex int
 	OpCodeIndex      int
 	OpCodes          []OpCode
+	offsets          []int
+	current          int
 }
 
-func opsFromBytes(bytes []byte) []OpCode {
+// Disassemble decodes code into its instructions along with the byte code
+// index each of them starts at.
+func Disassemble(code []byte) ([]OpCode, []int) {
 	var ops []OpCode
+	var offsets []int
 	i := 0
-	for i < len(bytes) {
-		op := bytesToOpcode(bytes[i:])
+	for i < len(code) {
+		op := bytesToOpcode(code, i)
 		ops = append(ops, op)
+		offsets = append(offsets, i)
 		i += op.Width()
 	}
-	return ops
+	return ops, offsets
 }
 
 func newProgramCounter(bytes []byte) ProgramCounter {
-	return ProgramCounter{bytes, 0, 0, opsFromBytes(bytes)}
+	ops, offsets := Disassemble(bytes)
+	return ProgramCounter{
+		RawByteCodes: bytes,
+		OpCodes:      ops,
+		offsets:      offsets,
+	}
 }
 
 func (pc *ProgramCounter) OpCode() OpCode {
 	return pc.OpCodes[pc.OpCodeIndex]
 }
 
+// CurrentByteCodeIndex is the index of the instruction that is executing,
+// which is the last one returned by next.
 func (pc *ProgramCounter) CurrentByteCodeIndex() int {
-	return pc.RawByteCodeIndex - pc.OpCode().Width()
+	return pc.current
 }
 
 func (pc *ProgramCounter) next() OpCode {
 	op := pc.OpCode()
+	pc.current = pc.RawByteCodeIndex
 	pc.RawByteCodeIndex += op.Width()
 	pc.OpCodeIndex++
 	return op
 }
 
+// jumpTo makes the instruction at byte code index the next one to execute.
 func (pc *ProgramCounter) jumpTo(index int) {
-	pc.jump(index - pc.RawByteCodeIndex + pc.OpCode().Width())
+	i := sort.SearchInts(pc.offsets, index)
+	if i == len(pc.offsets) || pc.offsets[i] != index {
+		log.Panicf("Cannot jump to %d, it is not the start of an instruction", index)
+	}
+	pc.OpCodeIndex = i
+	pc.RawByteCodeIndex = index
 }
 
 func (pc *ProgramCounter) DebugOut() {
-	index := 0
 	for i, o := range pc.OpCodes {
 		prefix := "\t"
 		if i == pc.OpCodeIndex-1 {
 			prefix = "->\t"
 		}
-		log.Printf("%s %3d %3d %v", prefix, index, i, o)
-		index += o.Width()
+		log.Printf("%s %3d %3d %v", prefix, pc.offsets[i], i, o)
 	}
 }
 
+// jump moves relative to the start of the executing instruction, which is
+// how branch offsets are encoded.
 func (pc *ProgramCounter) jump(offset int) {
-	pc.OpCodeIndex--
-	pc.RawByteCodeIndex -= pc.OpCode().Width()
-	pc.RawByteCodeIndex += offset
-
-	if offset < 0 {
-		for offset < 0 {
-			pc.OpCodeIndex--
-			offset += pc.OpCode().Width()
-		}
-	} else {
-		for offset > 0 {
-			offset -= pc.OpCode().Width()
-			pc.OpCodeIndex++
-		}
-	}
+	pc.jumpTo(pc.current + offset)
 }
@@ -0,0 +1,154 @@
+package java
+
+import (
+	"io"
+)
+
+// referenceKind is how strongly the objects of a class hold the referent of
+// java.lang.ref.Reference.
+type referenceKind uint8
+
+const (
+	// strongReference is the kind of every class that isn't a Reference.
+	strongReference referenceKind = iota
+	// Soft references keep their referents until memory runs out.
+	softReference
+	// Weak references are cleared once nothing stronger holds their
+	// referents, before the referents are finalized.
+	weakReference
+	// Phantom references are cleared once their referents have been
+	// finalized too.
+	phantomReference
+)
+
+// referenceKinds are the kinds of the classes that make them, which their
+// subclasses inherit.
+var referenceKinds = map[string]referenceKind{
+	"java/lang/ref/SoftReference":    softReference,
+	"java/lang/ref/WeakReference":    weakReference,
+	"java/lang/ref/PhantomReference": phantomReference,
+}
+
+// SetFinalization controls whether the VM runs the finalize methods of
+// objects the collector finds unreachable. It is on by default.
+func (vm *VM) SetFinalization(on bool) {
+	vm.finalization = on
+}
+
+// hasFinalizer reports whether c overrides Object.finalize with a method that
+// does something.
+func (vm *VM) hasFinalizer(c *Class) bool {
+	if !c.finalizerChecked {
+		m := vm.resolveMethod(c, "finalize", "()V")
+		c.finalizer = m != nil && m.Class().Name() != "java/lang/Object" && !m.Abstract() &&
+			!(len(m.Code.Instructions) == 1 && m.Code.Instructions[0] == 0xb1)
+		c.finalizerChecked = true
+	}
+	return c.finalizer
+}
+
+// clearReferences clears those of refs whose referents weren't marked, and
+// adds them to the references pending.
+func (vm *VM) clearReferences(refs []javaObject) {
+	slot := vm.heap.referentSlot
+	for _, ref := range refs {
+		referent := ref.fields[slot].(javaReference)
+		if referent.isNull() || headerOf(referent).marked {
+			continue
+		}
+		ref.fields[slot] = javaObject{}
+		vm.heap.pending = append(vm.heap.pending, ref)
+	}
+}
+
+// processReferences does what the reference handler and finalizer threads of
+// a JVM would after a collection. It hands the references the collector
+// cleared to their queues, cleaning the ones that are Cleaners' instead, and
+// then runs the finalizers of the objects found unreachable. That runs Java
+// code, which can collect the heap again, so the call that started the work
+// carries on until there is none left but the finalizers that have to wait
+// for a monitor of the main thread.
+func (vm *VM) processReferences() {
+	h := &vm.heap
+	if h.processing {
+		return
+	}
+	h.processing = true
+	for len(h.pending) > 0 || len(h.finalizing) > 0 {
+		if len(h.pending) > 0 {
+			ref := h.pending[0]
+			h.pending = h.pending[1:]
+			vm.enqueue(ref)
+			continue
+		}
+		o := h.finalizing[0]
+		h.finalizing = h.finalizing[1:]
+		if !vm.runFinalizer(o) {
+			h.blocked = append(h.blocked, o)
+		}
+	}
+	h.finalizing, h.blocked = h.blocked, nil
+	h.processing = false
+}
+
+// enqueue adds the cleared reference ref to the queue it was registered with,
+// if it was. Cleaners register references to clean up after objects, so
+// those are cleaned straight away without a cleaner thread.
+func (vm *VM) enqueue(ref javaObject) {
+	if cleanable := vm.getClass("java/lang/ref/Cleaner$Cleanable"); cleanable != nil && vm.implements(ref.class(), cleanable) {
+		vm.callQuietly(ref, "clean", "()V")
+		return
+	}
+	queue, ok := ref.getField("queue", "Ljava/lang/ref/ReferenceQueue;").(javaObject)
+	if !ok || queue.isNull() {
+		return
+	}
+	vm.callQuietly(queue, "enqueue", "(Ljava/lang/ref/Reference;)Z", ref)
+}
+
+// runFinalizer runs the finalize method of o on the finalizer thread. It
+// reports false if the finalizer had to wait for a monitor the main thread
+// holds, in which case it is abandoned, letting go of the monitors it took,
+// and has to be run again from the start.
+func (vm *VM) runFinalizer(o javaObject) (finished bool) {
+	if vm.finalizer == nil {
+		vm.finalizer = newThread("Finalizer")
+	}
+	current := vm.thread
+	vm.thread = vm.finalizer
+	stacks, handles := len(vm.heap.stacks), len(vm.heap.handles)
+	defer func() {
+		vm.thread = current
+		if r := recover(); r != nil {
+			if _, ok := r.(finalizerBlocked); !ok {
+				panic(r)
+			}
+			vm.heap.stacks = vm.heap.stacks[:stacks]
+			vm.heap.handles = vm.heap.handles[:handles]
+			vm.finalizer.releaseAll()
+			finished = false
+		}
+	}()
+	vm.callQuietly(o, "finalize", "()V")
+	return true
+}
+
+// callQuietly calls the method name of o with args the way the threads of the
+// VM itself do, ignoring what it returns or throws.
+func (vm *VM) callQuietly(o javaObject, name, descriptor string, args ...javaValue) {
+	vm.call(o.class().Name(), name, descriptor, true, append([]javaValue{o}, args...)...)
+}
+
+func nativeClearReference(vm *VM, f *Frame, w io.Writer) {
+	ref := f.Variables[0].(javaObject)
+	ref.fields[vm.heap.referentSlot] = javaObject{}
+}
+
+func nativeRefersTo(vm *VM, f *Frame, w io.Writer) {
+	ref := f.Variables[0].(javaObject)
+	if sameObject(ref.fields[vm.heap.referentSlot].(javaReference), f.Variables[1].(javaReference)) {
+		f.PreviousFrame.pushInt32(1)
+	} else {
+		f.PreviousFrame.pushInt32(0)
+	}
+}
@@ -0,0 +1,55 @@
+package java
+
+import (
+	"testing"
+)
+
+func TestFinalizerWaitsForMonitor(t *testing.T) {
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.native("gc", "()V")
+	main.field(Public|Static, "lock", "Ljava/lang/Object;")
+
+	// The finalizer of Doomed locks the lock main holds while it collects
+	// the heap the first time.
+	doomed := newTestClass(Public|Super, "Doomed", "java/lang/Object")
+	doomed.constructor("java/lang/Object", "()V")
+	doomed.code(Protected, "finalize", "()V", 1, func(a *assembler) {
+		a.field("getstatic", "Main", "lock", "Ljava/lang/Object;")
+		a.op("monitorenter")
+		a.ldc("finalized\n")
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		a.field("getstatic", "Main", "lock", "Ljava/lang/Object;")
+		a.op("monitorexit")
+		a.op("return")
+	})
+
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 1, func(a *assembler) {
+		print := func(s string) {
+			a.ldc(s)
+			a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+		}
+		a.class("new", "java/lang/Object")
+		a.op("dup")
+		a.invoke("invokespecial", "java/lang/Object", "<init>", "()V")
+		a.field("putstatic", "Main", "lock", "Ljava/lang/Object;")
+		a.class("new", "Doomed")
+		a.op("dup")
+		a.invoke("invokespecial", "Doomed", "<init>", "()V")
+		a.op("pop")
+
+		a.field("getstatic", "Main", "lock", "Ljava/lang/Object;")
+		a.op("monitorenter")
+		a.invoke("invokestatic", "Main", "gc", "()V")
+		print("collected while locked\n")
+		a.field("getstatic", "Main", "lock", "Ljava/lang/Object;")
+		a.op("monitorexit")
+		a.invoke("invokestatic", "Main", "gc", "()V")
+		print("collected\n")
+		a.op("return")
+	})
+
+	got := run(newTestVM(t, main, doomed), "Main")
+	if want := "collected while locked\nfinalized\ncollected\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,419 @@
+package java
+
+import (
+	"fmt"
+	"strings"
+)
+
+// linkageError is an error found while linking a method call, to be thrown
+// as an exception of the named class.
+type linkageError struct {
+	class   string
+	message string
+}
+
+func (e linkageError) Error() string {
+	return e.message
+}
+
+// superclass returns the direct superclass of c, or nil for Object.
+func (vm *VM) superclass(c *Class) *Class {
+	if c.superClass == 0 || c.Name() == "java/lang/Object" {
+		return nil
+	}
+	return vm.resolveClass(c.getSuperName())
+}
+
+// superinterfaces returns every interface c, its superclasses and their
+// superinterfaces implement, each once.
+func (vm *VM) superinterfaces(c *Class) []*Class {
+	var result []*Class
+	seen := make(map[string]bool)
+	var visit func(*Class)
+	visit = func(k *Class) {
+		for _, i := range k.interfaces {
+			name := k.getClassInfoAt(i).className()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			iface := vm.resolveClass(name)
+			result = append(result, iface)
+			visit(iface)
+		}
+	}
+	for k := c; k != nil; k = vm.superclass(k) {
+		visit(k)
+	}
+	return result
+}
+
+// maximallySpecific returns the methods with name and descriptor declared by
+// superinterfaces of c that aren't overridden by one declared in another of
+// its superinterfaces (JVMS §5.4.3.3).
+func (vm *VM) maximallySpecific(c *Class, name, descriptor string) []*Method {
+	var declared []*Method
+	for _, iface := range vm.superinterfaces(c) {
+		if m := iface.resolveMethod(name, descriptor); m != nil && !m.Private() && !m.Static() {
+			declared = append(declared, m)
+		}
+	}
+	var result []*Method
+	for _, m := range declared {
+		specific := true
+		for _, other := range declared {
+			if other != m && vm.implements(other.Class(), m.Class()) {
+				specific = false
+				break
+			}
+		}
+		if specific {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// resolveMethod finds the method a reference to name and descriptor in c
+// resolves to (JVMS §5.4.3.3 and §5.4.3.4). Classes look in themselves and
+// their superclasses, interfaces in themselves and then the public methods of
+// Object, before both fall back to their superinterfaces.
+func (vm *VM) resolveMethod(c *Class, name, descriptor string) *Method {
+	if c.AccessFlags&Interface != 0 {
+		if m := c.resolveMethod(name, descriptor); m != nil {
+			return m
+		}
+		object := vm.resolveClass("java/lang/Object")
+		if m := object.resolveMethod(name, descriptor); m != nil && m.accessFlags&Public != 0 && !m.Static() {
+			return m
+		}
+	} else {
+		for k := c; k != nil; k = vm.superclass(k) {
+			if m := k.resolveMethod(name, descriptor); m != nil {
+				return m
+			}
+		}
+	}
+	candidates := vm.maximallySpecific(c, name, descriptor)
+	if concrete := nonAbstract(candidates); len(concrete) == 1 {
+		return concrete[0]
+	}
+	if len(candidates) > 0 {
+		return candidates[0]
+	}
+	return nil
+}
+
+// selectMethod picks the method that runs when the resolved method is
+// invoked on an instance of receiver (JVMS §5.4.6): the one receiver or its
+// closest superclass declares, or else the only maximally-specific default
+// method.
+func (vm *VM) selectMethod(receiver *Class, resolved *Method) (*Method, error) {
+	if resolved.Private() {
+		return resolved, nil
+	}
+	name, descriptor := resolved.Name(), resolved.RawSigniture
+	for k := receiver; k != nil; k = vm.superclass(k) {
+		if m := k.resolveMethod(name, descriptor); m != nil && !m.Private() && !m.Static() && overrides(m, resolved) {
+			return m, nil
+		}
+	}
+	concrete := nonAbstract(vm.maximallySpecific(receiver, name, descriptor))
+	switch len(concrete) {
+	case 0:
+		return nil, vm.abstractMethodError(receiver, resolved)
+	case 1:
+		return concrete[0], nil
+	}
+	return nil, conflictingDefaults(concrete)
+}
+
+// conflictingDefaults reports that there is more than one default method to
+// choose from.
+func conflictingDefaults(methods []*Method) error {
+	var names []string
+	for _, m := range methods {
+		names = append(names, javaName("L"+m.Class().Name()+";")+"."+m.Name())
+	}
+	return linkageError{"java/lang/IncompatibleClassChangeError", "Conflicting default methods: " + strings.Join(names, " ")}
+}
+
+func nonAbstract(methods []*Method) []*Method {
+	var result []*Method
+	for _, m := range methods {
+		if !m.Abstract() {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// abstractMethodError reports that receiver has no implementation of the
+// resolved method.
+func (vm *VM) abstractMethodError(receiver *Class, resolved *Method) error {
+	owner := "abstract class"
+	if resolved.Class().AccessFlags&Interface != 0 {
+		owner = "interface"
+	}
+	return linkageError{"java/lang/AbstractMethodError", fmt.Sprintf(
+		"Receiver class %s does not define or inherit an implementation of the resolved method 'abstract %s' of %s %s.",
+		javaName("L"+receiver.Name()+";"), methodSignature("", resolved.Name(), resolved.RawSigniture),
+		owner, javaName("L"+resolved.Class().Name()+";"))}
+}
+
+// methodSignature is how HotSpot describes a method in its error messages,
+// such as "int Main.add(int, int)". The class is left out if it is empty.
+func methodSignature(class, name, descriptor string) string {
+	params, ret := splitDescriptor(descriptor)
+	names := make([]string, len(params))
+	for i, p := range params {
+		names[i] = typeName(p)
+	}
+	if class != "" {
+		name = typeName("L"+class+";") + "." + name
+	}
+	return fmt.Sprintf("%s %s(%s)", typeName(ret), name, strings.Join(names, ", "))
+}
+
+// overrides reports whether m can override the method inherited, which has
+// the same name and descriptor (JVMS §5.4.5). Package-private methods are only
+// overridden by methods in the same package.
+func overrides(m, inherited *Method) bool {
+	if inherited.accessFlags&(Public|Protected) != 0 {
+		return true
+	}
+	return packageName(m.Class().Name()) == packageName(inherited.Class().Name())
+}
+
+// isVirtual reports whether m is dispatched on the class of its receiver.
+func (m *Method) isVirtual() bool {
+	return !m.Static() && !m.Private() && m.Name()[0] != '<'
+}
+
+// link lays out the method tables of c, after those of its superclasses and
+// superinterfaces. A method in c takes over each vtable slot of an inherited
+// method it overrides, and gets a new slot if there are none. The itables
+// hold the method §5.4.6 selects for each method of an interface, or nil if
+// calling it is an error.
+func (vm *VM) link(c *Class) {
+	if c.linked {
+		return
+	}
+	c.linked = true
+	if c.AccessFlags&Interface != 0 {
+		n := 0
+		for i := range c.methods {
+			m := &c.methods[i]
+			m.tableIndex = -1
+			if m.isVirtual() {
+				m.tableIndex = n
+				n++
+			}
+		}
+		return
+	}
+
+	var vtable []*Method
+	if super := vm.superclass(c); super != nil {
+		vm.link(super)
+		vtable = append(vtable, super.vtable...)
+	}
+	inherited := len(vtable)
+	for i := range c.methods {
+		m := &c.methods[i]
+		m.tableIndex = -1
+		if !m.isVirtual() {
+			continue
+		}
+		for slot, s := range vtable[:inherited] {
+			if s.Name() == m.Name() && s.RawSigniture == m.RawSigniture && overrides(m, s) {
+				vtable[slot] = m
+				if m.tableIndex < 0 {
+					m.tableIndex = slot
+				}
+			}
+		}
+		if m.tableIndex < 0 {
+			m.tableIndex = len(vtable)
+			vtable = append(vtable, m)
+		}
+	}
+	c.vtable = vtable
+
+	c.itables = make(map[*Class][]*Method)
+	for _, iface := range vm.superinterfaces(c) {
+		vm.link(iface)
+		var itable []*Method
+		for i := range iface.methods {
+			m := &iface.methods[i]
+			if m.tableIndex < 0 {
+				continue
+			}
+			selected, _ := vm.selectMethod(c, m)
+			itable = append(itable, selected)
+		}
+		c.itables[iface] = itable
+	}
+}
+
+// dispatch selects the method that runs when resolved is invoked on an
+// instance of receiver from the method tables of receiver.
+func (vm *VM) dispatch(receiver *Class, resolved *Method) (*Method, error) {
+	if resolved.Private() {
+		return resolved, nil
+	}
+	vm.link(receiver)
+	var selected *Method
+	if resolved.Class().AccessFlags&Interface != 0 {
+		itable, ok := receiver.itables[resolved.Class()]
+		if !ok {
+			return nil, linkageError{"java/lang/IncompatibleClassChangeError", fmt.Sprintf("Class %s does not implement the requested interface %s",
+				javaName("L"+receiver.Name()+";"), javaName("L"+resolved.Class().Name()+";"))}
+		}
+		if selected = itable[resolved.tableIndex]; selected == nil {
+			_, err := vm.selectMethod(receiver, resolved)
+			return nil, err
+		}
+	} else {
+		selected = receiver.vtable[resolved.tableIndex]
+	}
+	if selected.Abstract() {
+		return nil, vm.abstractMethodError(receiver, resolved)
+	}
+	return selected, nil
+}
+
+// selectSpecial picks the method invokespecial runs for the resolved method
+// of class. Code in an ACC_SUPER class calling a method of one of its
+// superclasses runs the one inherited by its direct superclass, rather than
+// the one class has.
+func (vm *VM) selectSpecial(current, class *Class, resolved *Method) (*Method, error) {
+	c := class
+	if resolved.Name() != "<init>" && class.AccessFlags&Interface == 0 && current.AccessFlags&Super != 0 &&
+		current != class && vm.implements(current, class) {
+		c = vm.superclass(current)
+	}
+	selected := resolved
+	if c != resolved.Class() {
+		name, descriptor := resolved.Name(), resolved.RawSigniture
+		selected = nil
+		if c.AccessFlags&Interface != 0 {
+			selected = c.resolveMethod(name, descriptor)
+			object := vm.resolveClass("java/lang/Object")
+			if m := object.resolveMethod(name, descriptor); selected == nil && m != nil && m.accessFlags&Public != 0 && !m.Static() {
+				selected = m
+			}
+		} else {
+			for k := c; k != nil && selected == nil; k = vm.superclass(k) {
+				selected = k.resolveMethod(name, descriptor)
+			}
+		}
+		if selected == nil {
+			concrete := nonAbstract(vm.maximallySpecific(c, name, descriptor))
+			if len(concrete) > 1 {
+				return nil, conflictingDefaults(concrete)
+			}
+			if len(concrete) == 1 {
+				selected = concrete[0]
+			}
+		}
+	}
+	if selected == nil || selected.Abstract() {
+		return nil, linkageError{"java/lang/AbstractMethodError", fmt.Sprintf("Method '%s' is abstract",
+			methodSignature(c.Name(), resolved.Name(), resolved.RawSigniture))}
+	}
+	return selected, nil
+}
+
+// invokeMethod links and calls the method the reference at index refers to
+// for the invoke instruction of the given kind, which is one of the refInvoke
+// constants.
+func (vm *VM) invokeMethod(frame *Frame, kind uint8, index uint16) *Frame {
+	current := frame.Class
+	ref := current.getMethodReferenceAt(index)
+	method := current.resolvedMethods[index]
+	if method == nil {
+		class, err := vm.resolveClassFrom(current, ref.className())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		_, interfaceRef := ref.(interfaceMethodRef)
+		isInterface := class.AccessFlags&Interface != 0
+		if interfaceRef && !isInterface {
+			return vm.throw(frame, "java/lang/IncompatibleClassChangeError", fmt.Sprintf("Found class %s, but interface was expected", javaName("L"+class.Name()+";")))
+		}
+		if !interfaceRef && isInterface {
+			return vm.throw(frame, "java/lang/IncompatibleClassChangeError", fmt.Sprintf("Found interface %s, but class was expected", javaName("L"+class.Name()+";")))
+		}
+		if method = vm.resolveMethod(class, ref.methodName(), ref.methodType()); method == nil {
+			return vm.throw(frame, "java/lang/NoSuchMethodError", "'"+methodSignature(class.Name(), ref.methodName(), ref.methodType())+"'")
+		}
+		if err := vm.checkMethodAccess(current, method); err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if current.resolvedMethods == nil {
+			current.resolvedMethods = make(map[uint16]*Method)
+		}
+		current.resolvedMethods[index] = method
+	}
+	if static := kind == refInvokeStatic; static != method.Static() {
+		message := "Expecting non-static method '%s'"
+		if static {
+			message = "Expected static method '%s'"
+		}
+		return vm.throw(frame, "java/lang/IncompatibleClassChangeError", fmt.Sprintf(message, methodSignature(method.Class().Name(), method.Name(), method.RawSigniture)))
+	}
+	if kind == refInvokeSpecial {
+		special := current.specialMethods[index]
+		if special == nil {
+			var err error
+			if special, err = vm.selectSpecial(current, vm.resolveClass(ref.className()), method); err != nil {
+				return vm.throwLinkageError(frame, err)
+			}
+			if current.specialMethods == nil {
+				current.specialMethods = make(map[uint16]*Method)
+			}
+			current.specialMethods[index] = special
+		}
+		method = special
+	}
+	if kind == refInvokeVirtual && method.accessFlags&Protected != 0 {
+		receiver := frame.Items[int(frame.size)-1-method.numArgs()]
+		member := "method '" + methodSignature(method.Class().Name(), method.Name(), method.RawSigniture) + "'"
+		if err := vm.checkProtectedReceiver(current, method.Class(), method.accessFlags, member, receiver); err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+	}
+	return vm.invoke(method, frame, kind == refInvokeVirtual || kind == refInvokeInterface)
+}
+
+// invoke pops the arguments of method off previousFrame and returns the frame
+// that runs it. Virtual calls run whichever method the receiver selects.
+func (vm *VM) invoke(method *Method, previousFrame *Frame, virtual bool) *Frame {
+	args := collectArgs(method, previousFrame)
+	if method.Static() {
+		frame := newFrame(previousFrame, method, args)
+		vm.enterMethod(&frame, args)
+		return &frame
+	}
+	if args[0].(javaReference).isNull() {
+		return vm.throwNullPointer(previousFrame)
+	}
+	if virtual {
+		receiver := vm.resolveClass("java/lang/Object")
+		if o, ok := args[0].(javaObject); ok {
+			receiver = o.class()
+		}
+		selected, err := vm.dispatch(receiver, method)
+		if err != nil {
+			return vm.throwLinkageError(previousFrame, err)
+		}
+		method = selected
+	} else if method.Abstract() {
+		return vm.throw(previousFrame, "java/lang/AbstractMethodError", fmt.Sprintf("Method '%s' is abstract",
+			methodSignature(method.Class().Name(), method.Name(), method.RawSigniture)))
+	}
+	frame := newFrame(previousFrame, method, args)
+	vm.enterMethod(&frame, args)
+	return &frame
+}
@@ -0,0 +1,79 @@
+package java
+
+import (
+	"testing"
+)
+
+func TestMethodSelectionErrors(t *testing.T) {
+	defaultHello := func(name string) *testClass {
+		i := newTestClass(Public|Interface|Abstract, name, "java/lang/Object")
+		i.code(Public, "hello", "()V", 1, func(a *assembler) {
+			a.ldc(name + " says hello\n")
+			a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+			a.op("return")
+		})
+		return i
+	}
+	left, right := defaultHello("Left"), defaultHello("Right")
+	both := newTestClass(Public|Super, "Both", "java/lang/Object", "Left", "Right")
+	both.constructor("java/lang/Object", "()V")
+	// Overriding picks one of the conflicting defaults.
+	chosen := newTestClass(Public|Super, "Chosen", "java/lang/Object", "Left", "Right")
+	chosen.constructor("java/lang/Object", "()V")
+	chosen.code(Public, "hello", "()V", 1, func(a *assembler) {
+		a.op("aload_0")
+		a.index("invokespecial", a.w.interfaceMethodRef("Left", "hello", "()V"))
+		a.op("return")
+	})
+
+	greeter := newTestClass(Public|Interface|Abstract, "Greeter", "java/lang/Object")
+	greeter.method(Public|Abstract, "greet", "()V", nil)
+	rude := newTestClass(Public|Super, "Rude", "java/lang/Object", "Greeter")
+	rude.constructor("java/lang/Object", "()V")
+
+	shape := newTestClass(Public|Abstract|Super, "Shape", "java/lang/Object")
+	shape.constructor("java/lang/Object", "()V")
+	shape.method(Public|Abstract, "area", "()I", nil)
+	blob := newTestClass(Public|Super, "Blob", "Shape")
+	blob.constructor("Shape", "()V")
+
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 1, func(a *assembler) {
+		create := func(class string) {
+			a.class("new", class)
+			a.op("dup")
+			a.invoke("invokespecial", class, "<init>", "()V")
+		}
+		create("Chosen")
+		a.invoke("invokeinterface", "Right", "hello", "()V")
+		a.printThrows(
+			func() {
+				create("Both")
+				a.invoke("invokeinterface", "Left", "hello", "()V")
+			},
+			func() {
+				create("Both")
+				a.invoke("invokevirtual", "Both", "hello", "()V")
+			},
+			func() {
+				create("Rude")
+				a.invoke("invokeinterface", "Greeter", "greet", "()V")
+			},
+			func() {
+				create("Blob")
+				a.invoke("invokevirtual", "Shape", "area", "()I")
+			},
+		)
+		a.op("return")
+	})
+
+	got := run(newTestVM(t, left, right, both, chosen, greeter, rude, shape, blob, main), "Main")
+	want := "Left says hello\n" +
+		"java.lang.IncompatibleClassChangeError: Conflicting default methods: Left.hello Right.hello\n" +
+		"java.lang.IncompatibleClassChangeError: Conflicting default methods: Left.hello Right.hello\n" +
+		"java.lang.AbstractMethodError: Receiver class Rude does not define or inherit an implementation of the resolved method 'abstract void greet()' of interface Greeter.\n" +
+		"java.lang.AbstractMethodError: Receiver class Blob does not define or inherit an implementation of the resolved method 'abstract int area()' of abstract class Shape.\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,62 @@
+public class Main {
+	public static void main(String[] args) {
+		for (int i = 0; i < 3; i++) {
+			printInt(i);
+		}
+
+		printBoolean(lessThan(1L, 2L));
+		printBoolean(lessThan(2L, 1L));
+		printBoolean(lessThan(1.0f, Float.NaN));
+		printBoolean(greaterThan(1.0f, Float.NaN));
+		printBoolean(lessThan(-0.0, 0.0));
+		printBoolean(lessThan(1.0, Double.NaN));
+		printBoolean(greaterThan(1.0, Double.NaN));
+		printBoolean(equal(Double.NaN, Double.NaN));
+
+		Object a = new Object();
+		Object b = new Object();
+		Object c = a;
+		printBoolean(a == c);
+		printBoolean(a == b);
+		printBoolean(a != b);
+		printBoolean(a == null);
+		Object n = null;
+		printBoolean(n == null);
+	}
+
+	public static boolean lessThan(long x, long y) {
+		return x < y;
+	}
+
+	public static boolean lessThan(float x, float y) {
+		return x < y;
+	}
+
+	public static boolean greaterThan(float x, float y) {
+		return x > y;
+	}
+
+	public static boolean lessThan(double x, double y) {
+		return x < y;
+	}
+
+	public static boolean greaterThan(double x, double y) {
+		return x > y;
+	}
+
+	public static boolean equal(double x, double y) {
+		return x == y;
+	}
+
+	public static void printBoolean(boolean b) {
+		if (b) {
+			print("true\n");
+		} else {
+			print("false\n");
+		}
+	}
+
+	public static native void printInt(int x);
+
+	public static native void print(String s);
+}
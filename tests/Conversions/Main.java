@@ -0,0 +1,99 @@
+public class Main {
+	public static void main(String[] args) {
+		printInt(f2i(Float.NaN));
+		printInt(f2i(3e10f));
+		printInt(f2i(-3e10f));
+		printInt(f2i(-2.9f));
+		printInt(f2i(Float.POSITIVE_INFINITY));
+		printLong(f2l(Float.NaN));
+		printLong(f2l(1e30f));
+		printLong(f2l(Float.NEGATIVE_INFINITY));
+		printInt(d2i(Double.NaN));
+		printInt(d2i(1e300));
+		printInt(d2i(2.9));
+		printLong(d2l(-1e300));
+		printLong(d2l(-2.5));
+		printFloat(d2f(1e300));
+		printFloat(d2f(0.1));
+		printDouble(f2d(0.1f));
+
+		printInt(i2b(200));
+		printInt(i2b(-129));
+		printInt(i2c(-1));
+		printInt(i2s(40000));
+		printInt(l2i(0x100000005L));
+		printLong(i2l(-5));
+		printFloat(i2f(16777217));
+		printDouble(i2d(7));
+		printFloat(l2f(16777217L));
+		printDouble(l2d(9007199254740993L));
+	}
+
+	public static int f2i(float x) {
+		return (int) x;
+	}
+
+	public static long f2l(float x) {
+		return (long) x;
+	}
+
+	public static double f2d(float x) {
+		return (double) x;
+	}
+
+	public static int d2i(double x) {
+		return (int) x;
+	}
+
+	public static long d2l(double x) {
+		return (long) x;
+	}
+
+	public static float d2f(double x) {
+		return (float) x;
+	}
+
+	public static int i2b(int x) {
+		return (byte) x;
+	}
+
+	public static int i2c(int x) {
+		return (char) x;
+	}
+
+	public static int i2s(int x) {
+		return (short) x;
+	}
+
+	public static long i2l(int x) {
+		return (long) x;
+	}
+
+	public static float i2f(int x) {
+		return (float) x;
+	}
+
+	public static double i2d(int x) {
+		return (double) x;
+	}
+
+	public static int l2i(long x) {
+		return (int) x;
+	}
+
+	public static float l2f(long x) {
+		return (float) x;
+	}
+
+	public static double l2d(long x) {
+		return (double) x;
+	}
+
+	public static native void printInt(int x);
+
+	public static native void printLong(long x);
+
+	public static native void printFloat(float x);
+
+	public static native void printDouble(double x);
+}
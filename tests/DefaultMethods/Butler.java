@@ -0,0 +1,2 @@
+public class Butler implements Polite, Quiet {
+}
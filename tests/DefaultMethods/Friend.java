@@ -0,0 +1,5 @@
+public class Friend implements Polite {
+	public String name() {
+		return "my " + Polite.super.name();
+	}
+}
@@ -0,0 +1,17 @@
+public interface Greeter {
+	default String greet() {
+		return "Hello " + name();
+	}
+
+	default String name() {
+		return secret();
+	}
+
+	static int twice(int n) {
+		return n * 2;
+	}
+
+	private String secret() {
+		return "nobody";
+	}
+}
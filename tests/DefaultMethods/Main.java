@@ -0,0 +1,17 @@
+public class Main {
+	public static void main(String[] args) {
+		Greeter butler = new Butler();
+		print(butler.greet() + "\n");
+		print(new Butler().name() + "\n");
+		print(new Friend().greet() + "\n");
+		Stranger visitor = new Visitor();
+		print(visitor.greet() + "\n");
+		Visitor tourist = new Tourist();
+		print(tourist.name() + "\n");
+		printInt(Greeter.twice(21));
+	}
+
+	private static native void print(String s);
+
+	private static native void printInt(int i);
+}
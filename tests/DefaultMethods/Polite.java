@@ -0,0 +1,5 @@
+public interface Polite extends Greeter {
+	default String name() {
+		return "sir";
+	}
+}
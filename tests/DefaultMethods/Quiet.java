@@ -0,0 +1,2 @@
+public interface Quiet extends Greeter {
+}
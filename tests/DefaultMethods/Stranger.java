@@ -0,0 +1,2 @@
+public abstract class Stranger implements Greeter {
+}
@@ -0,0 +1,5 @@
+public class Tourist extends Visitor {
+	public String name() {
+		return "tourist";
+	}
+}
@@ -0,0 +1,2 @@
+public class Visitor extends Stranger {
+}
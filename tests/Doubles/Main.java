@@ -0,0 +1,58 @@
+public class Main {
+	private static double HALF = 0.5;
+
+	public static void main(String[] args) {
+		printDouble(add(0.1, 0.2));
+		printDouble(minus(30.25, 2.0));
+		printDouble(mult(2.5, HALF));
+		printDouble(div(5.0, 2.0));
+		printDouble(rem(5.5, 2.0));
+		printDouble(rem(-5.5, 2.0));
+		printDouble(neg(0.0));
+		printDouble(div(1.0, 0.0));
+		printDouble(div(-1.0, 0.0));
+		printDouble(div(0.0, 0.0));
+		printDouble(rem(1.0, 0.0));
+
+		printFloat(rem(5.5f, 2.0f));
+		printFloat(rem(-5.5f, 2.0f));
+		printFloat(neg(1.5f));
+		printFloat(neg(0.0f));
+	}
+
+	public static double add(double x, double y) {
+		return x + y;
+	}
+
+	public static double minus(double x, double y) {
+		return x - y;
+	}
+
+	public static double mult(double x, double y) {
+		return x * y;
+	}
+
+	public static double div(double x, double y) {
+		return x / y;
+	}
+
+	public static double rem(double x, double y) {
+		return x % y;
+	}
+
+	public static double neg(double x) {
+		return -x;
+	}
+
+	public static float rem(float x, float y) {
+		return x % y;
+	}
+
+	public static float neg(float x) {
+		return -x;
+	}
+
+	public static native void printDouble(double x);
+
+	public static native void printFloat(float x);
+}
@@ -0,0 +1,27 @@
+public class Main {
+	public static void main(String[] args) {
+		Square square = new Square();
+		Shape shape = square;
+		printInt(square.sides);
+		printInt(shape.sides);
+		printInt(square.shapeSides());
+		printInt(square.squareSides());
+
+		shape.sides = 38;
+		printInt(shape.sides + square.sides);
+		print(square.area + "\n");
+		shape.area = 10000000000L;
+		printLong(shape.area);
+
+		printInt(shape.b + shape.c + shape.s);
+		print(shape.filled ? "filled\n" : "empty\n");
+		print(shape.f == 0 && shape.d == 0 ? "zero\n" : "not zero\n");
+		print(shape.tag == null ? "no tag\n" : "tag\n");
+	}
+
+	private static native void print(String s);
+
+	private static native void printInt(int i);
+
+	private static native void printLong(long l);
+}
@@ -0,0 +1,15 @@
+public class Shape {
+	int sides = 1;
+	long area;
+	byte b;
+	char c;
+	short s;
+	boolean filled;
+	float f;
+	double d;
+	Object tag;
+
+	int shapeSides() {
+		return sides;
+	}
+}
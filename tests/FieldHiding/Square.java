@@ -0,0 +1,8 @@
+public class Square extends Shape {
+	int sides = 4;
+	String area = "square";
+
+	int squareSides() {
+		return sides;
+	}
+}
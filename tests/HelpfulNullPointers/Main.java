@@ -0,0 +1,61 @@
+public class Main {
+	Printer printer;
+	int[] counts;
+	static Printer shared;
+
+	public static void main(String[] args) {
+		new Main().run(null);
+	}
+
+	public void run(Printer parameter) {
+		try {
+			printer.print();
+		} catch (NullPointerException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+		try {
+			shared.print();
+		} catch (NullPointerException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+		try {
+			parameter.print();
+		} catch (NullPointerException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+		try {
+			nothing().print();
+		} catch (NullPointerException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+		try {
+			counts[1] = 2;
+		} catch (NullPointerException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+		try {
+			print(printer.name);
+		} catch (NullPointerException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+	}
+
+	public Printer nothing() {
+		return null;
+	}
+
+	public static native void print(String s);
+}
+
+class Printer {
+	String name;
+
+	public void print() {
+	}
+}
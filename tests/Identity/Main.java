@@ -0,0 +1,41 @@
+public class Main {
+	static String greeting() {
+		return "hello";
+	}
+
+	public static void main(String[] args) {
+		Object a = new Object();
+		Object b = new Object();
+		Object c = a;
+
+		if (a == c && a != b) {
+			print("same object\n");
+		}
+		if (a.hashCode() == System.identityHashCode(c) && a.hashCode() == a.hashCode()) {
+			print("stable hash\n");
+		}
+		if (a.hashCode() != b.hashCode()) {
+			print("different hashes\n");
+		}
+		if (System.identityHashCode(null) == 0) {
+			print("null hash\n");
+		}
+		if (a.equals(c) && !a.equals(b) && !a.equals(null)) {
+			print("equals\n");
+		}
+
+		int[] values = new int[3];
+		if (values.hashCode() == System.identityHashCode(values)) {
+			print("array hash\n");
+		}
+
+		if (a.getClass() == b.getClass() && a.getClass() == Object.class) {
+			print("one class object\n");
+		}
+		if (greeting() == "hello" && (greeting() + "").intern() == "hello") {
+			print("interned\n");
+		}
+	}
+
+	private static native void print(String s);
+}
@@ -0,0 +1,128 @@
+public class Main {
+	public static void main(String[] args) {
+		printInt(div(Integer.MIN_VALUE, -1));
+		printInt(rem(-7, 2));
+		printInt(rem(7, -2));
+		printInt(neg(Integer.MIN_VALUE));
+		printInt(add(Integer.MAX_VALUE, 1));
+		printInt(shl(1, 33));
+		printInt(shr(-16, 2));
+		printInt(ushr(-16, 28));
+		printInt(and(0x0ff0, 0x00ff));
+		printInt(or(0x0f00, 0x00f0));
+		printInt(xor(0x0ff0, 0x00ff));
+
+		printLong(div(Long.MIN_VALUE, -1L));
+		printLong(rem(-7L, 2L));
+		printLong(neg(Long.MIN_VALUE));
+		printLong(shl(1L, 65));
+		printLong(shr(-16L, 2));
+		printLong(ushr(-1L, 60));
+		printLong(and(0x0ff0L, 0x00ffL));
+		printLong(or(0x0f00L, 0x00f0L));
+		printLong(xor(0x0ff0L, 0x00ffL));
+
+		try {
+			printInt(div(1, 0));
+		} catch (ArithmeticException e) {
+			print("Caught int division by zero\n");
+		}
+		try {
+			printInt(rem(1, 0));
+		} catch (ArithmeticException e) {
+			print("Caught int remainder by zero\n");
+		}
+		try {
+			printLong(div(1L, 0L));
+		} catch (ArithmeticException e) {
+			print("Caught long division by zero\n");
+		}
+		try {
+			printLong(rem(1L, 0L));
+		} catch (ArithmeticException e) {
+			print("Caught long remainder by zero\n");
+		}
+	}
+
+	public static int add(int x, int y) {
+		return x + y;
+	}
+
+	public static int div(int x, int y) {
+		return x / y;
+	}
+
+	public static int rem(int x, int y) {
+		return x % y;
+	}
+
+	public static int neg(int x) {
+		return -x;
+	}
+
+	public static int shl(int x, int s) {
+		return x << s;
+	}
+
+	public static int shr(int x, int s) {
+		return x >> s;
+	}
+
+	public static int ushr(int x, int s) {
+		return x >>> s;
+	}
+
+	public static int and(int x, int y) {
+		return x & y;
+	}
+
+	public static int or(int x, int y) {
+		return x | y;
+	}
+
+	public static int xor(int x, int y) {
+		return x ^ y;
+	}
+
+	public static long div(long x, long y) {
+		return x / y;
+	}
+
+	public static long rem(long x, long y) {
+		return x % y;
+	}
+
+	public static long neg(long x) {
+		return -x;
+	}
+
+	public static long shl(long x, int s) {
+		return x << s;
+	}
+
+	public static long shr(long x, int s) {
+		return x >> s;
+	}
+
+	public static long ushr(long x, int s) {
+		return x >>> s;
+	}
+
+	public static long and(long x, long y) {
+		return x & y;
+	}
+
+	public static long or(long x, long y) {
+		return x | y;
+	}
+
+	public static long xor(long x, long y) {
+		return x ^ y;
+	}
+
+	public static native void printInt(int x);
+
+	public static native void printLong(long x);
+
+	public static native void print(String s);
+}
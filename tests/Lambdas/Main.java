@@ -0,0 +1,84 @@
+import java.io.Serializable;
+
+public class Main {
+	public static void main(String[] args) {
+		Operation add = (a, b) -> a + b;
+		printInt(add.apply(3, 4));
+
+		Operation max = Main::larger;
+		printInt(max.apply(3, 4));
+
+		Transformer<Integer, Integer> square = x -> x * x;
+		printInt(square.apply(9));
+
+		int offset = 100;
+		Operation shifted = (a, b) -> a + b + offset;
+		printInt(shifted.apply(1, 2));
+
+		Counter counter = new Counter(10);
+		Source next = counter::next;
+		next.get();
+		printInt(next.get());
+
+		Transformer<String, Greeting> greet = Greeting::new;
+		print(greet.apply("lambdas").text + "\n");
+
+		LongSource big = () -> 10000000000L;
+		printLong(big.get() + offset);
+
+		Action hello = () -> print("hello\n");
+		hello.run();
+
+		Action serializable = (Action & Serializable) () -> print("serializable\n");
+		serializable.run();
+		printInt(serializable instanceof Serializable ? 1 : 0);
+	}
+
+	static int larger(int a, int b) {
+		return a > b ? a : b;
+	}
+
+	public static native void print(String s);
+	public static native void printInt(int i);
+	public static native void printLong(long l);
+}
+
+interface Operation {
+	int apply(int a, int b);
+}
+
+interface Transformer<T, R> {
+	R apply(T t);
+}
+
+interface Source {
+	int get();
+}
+
+interface LongSource {
+	long get();
+}
+
+interface Action {
+	void run();
+}
+
+class Counter {
+	private int count;
+
+	Counter(int start) {
+		count = start;
+	}
+
+	int next() {
+		return count++;
+	}
+}
+
+class Greeting {
+	String text;
+
+	Greeting(String name) {
+		text = "hello " + name;
+	}
+}
@@ -0,0 +1,81 @@
+import java.lang.invoke.MethodHandle;
+import java.lang.invoke.MethodHandles;
+import java.lang.invoke.MethodType;
+import java.lang.invoke.WrongMethodTypeException;
+
+public class Main {
+	int value;
+
+	Main(int value) {
+		this.value = value;
+	}
+
+	static int add(int a, int b) {
+		return a + b;
+	}
+
+	int times(int n) {
+		return value * n;
+	}
+
+	static short half(short s) {
+		return (short) (s / 2);
+	}
+
+	static void fail() {
+		throw new IllegalStateException("failed");
+	}
+
+	public static void main(String[] args) throws Throwable {
+		MethodHandles.Lookup lookup = MethodHandles.lookup();
+
+		MethodHandle add = lookup.findStatic(Main.class, "add", MethodType.methodType(int.class, int.class, int.class));
+		printInt((int) add.invokeExact(3, 4));
+		Integer five = 5;
+		Object sum = add.invoke(five, 6);
+		printInt((Integer) sum);
+
+		MethodHandle times = lookup.findVirtual(Main.class, "times", MethodType.methodType(int.class, int.class));
+		Main three = new Main(3);
+		printInt((int) times.invokeExact(three, 7));
+		print(times.type().toString() + "\n");
+
+		MethodHandle getter = lookup.findGetter(Main.class, "value", int.class);
+		printInt((int) getter.invokeExact(three));
+
+		try {
+			int wrong = (int) times.invokeExact((Object) three, 7);
+		} catch (WrongMethodTypeException e) {
+			print(e.getMessage() + "\n");
+		}
+
+		MethodHandle constructor = lookup.findConstructor(Main.class, MethodType.methodType(void.class, int.class));
+		Main made = (Main) constructor.invoke(99);
+		printInt(made.value);
+
+		MethodHandle half = lookup.findStatic(Main.class, "half", MethodType.methodType(short.class, short.class));
+		byte eight = 8;
+		printInt((int) half.invoke(eight));
+		try {
+			Object narrowed = half.invoke(70000);
+		} catch (WrongMethodTypeException e) {
+			print(e.getMessage() + "\n");
+		}
+
+		MethodHandle fail = lookup.findStatic(Main.class, "fail", MethodType.methodType(void.class));
+		try {
+			fail.invokeExact();
+		} catch (IllegalStateException e) {
+			print("caught " + e.getMessage() + "\n");
+		}
+
+		try {
+			lookup.findStatic(Main.class, "missing", MethodType.methodType(void.class));
+		} catch (NoSuchMethodException e) {
+			print(e.getMessage() + "\n");
+		}
+	}
+
+	public static native void print(String s);
+	public static native void printInt(int i);
+}
@@ -0,0 +1,39 @@
+public class Main {
+	private int count = 40;
+
+	private static String greeting() {
+		return "hello from the host";
+	}
+
+	private int next() {
+		return ++count;
+	}
+
+	class Counter {
+		private int step = 1;
+
+		int bump() {
+			count += step;
+			return next();
+		}
+	}
+
+	static class Greeter {
+		private String greet() {
+			return greeting();
+		}
+	}
+
+	public static void main(String[] args) {
+		Main main = new Main();
+		Counter counter = main.new Counter();
+		printInt(counter.bump());
+		counter.step = 5;
+		printInt(counter.bump());
+		print(new Greeter().greet() + "\n");
+	}
+
+	private static native void print(String s);
+
+	private static native void printInt(int i);
+}
@@ -0,0 +1,39 @@
+public class Main {
+	static int[] last;
+
+	public static void main(String[] args) {
+		for (int i = 0; i < 200; i++) {
+			last = new int[65536];
+		}
+		print("collected the garbage\n");
+
+		Object[] kept = new Object[100];
+		int n = 0;
+		try {
+			while (true) {
+				kept[n] = new int[65536];
+				n++;
+			}
+		} catch (OutOfMemoryError e) {
+			print(e.getMessage() + "\n");
+		}
+		if (n > 10 && n <= 16) {
+			print("filled the heap\n");
+		}
+
+		kept = null;
+		for (int i = 0; i < 20; i++) {
+			last = new int[65536];
+		}
+		print("recovered\n");
+
+		try {
+			int[][] grid = new int[100000][100000];
+			print("allocated " + grid.length + "\n");
+		} catch (OutOfMemoryError e) {
+			print(e.getMessage() + "\n");
+		}
+	}
+
+	private static native void print(String s);
+}
@@ -0,0 +1,70 @@
+import java.lang.ref.Cleaner;
+import java.lang.ref.PhantomReference;
+import java.lang.ref.ReferenceQueue;
+import java.lang.ref.SoftReference;
+import java.lang.ref.WeakReference;
+
+public class Main {
+	public static void main(String[] args) {
+		Object kept = new Object();
+		WeakReference<Object> strong = new WeakReference<>(kept);
+		WeakReference<Object> weak = new WeakReference<>(new Object());
+		System.gc();
+		if (strong.get() == kept && weak.get() == null) {
+			print("weak references cleared\n");
+		}
+
+		ReferenceQueue<Object> queue = new ReferenceQueue<>();
+		WeakReference<Object> queued = new WeakReference<>(new Object(), queue);
+		if (queue.poll() == null) {
+			System.gc();
+			if (queue.poll() == queued) {
+				print("enqueued\n");
+			}
+		}
+
+		new Resource("plain");
+		System.gc();
+		printInt(Resource.finalized);
+
+		Resource phoenix = new Resource("phoenix");
+		WeakReference<Resource> before = new WeakReference<>(phoenix);
+		PhantomReference<Resource> after = new PhantomReference<>(phoenix, queue);
+		phoenix = null;
+		System.gc();
+		if (before.get() == null && Resource.saved != null && queue.poll() == null) {
+			print("resurrected\n");
+		}
+		Resource.saved = null;
+		System.gc();
+		if (queue.poll() == after) {
+			print("phantom enqueued\n");
+		}
+		printInt(Resource.finalized);
+
+		Cleaner cleaner = Cleaner.create();
+		cleaner.register(new Object(), () -> print("cleaned\n"));
+		System.gc();
+
+		SoftReference<int[]> soft = new SoftReference<>(new int[65536]);
+		System.gc();
+		if (soft.get() != null) {
+			print("soft reference kept\n");
+		}
+		Object[] hog = new Object[100];
+		try {
+			for (int i = 0; i < hog.length; i++) {
+				hog[i] = new int[65536];
+			}
+		} catch (OutOfMemoryError e) {
+			hog = null;
+		}
+		if (soft.get() == null) {
+			print("soft reference cleared\n");
+		}
+	}
+
+	private static native void print(String s);
+
+	private static native void printInt(int i);
+}
@@ -0,0 +1,19 @@
+public class Resource {
+	static int finalized;
+	static Resource saved;
+
+	private final String name;
+
+	Resource(String name) {
+		this.name = name;
+	}
+
+	@Override
+	protected void finalize() {
+		finalized++;
+		if (name.equals("phoenix")) {
+			saved = this;
+		}
+		throw new RuntimeException("ignored");
+	}
+}
@@ -0,0 +1,60 @@
+public class Main {
+	int field;
+
+	public static void main(String[] args) {
+		Main nothing = null;
+		try {
+			printInt(nothing.field);
+		} catch (NullPointerException e) {
+			print("getfield on null\n");
+		}
+		try {
+			nothing.method();
+		} catch (NullPointerException e) {
+			print("invokevirtual on null\n");
+		}
+
+		int[] numbers = new int[3];
+		try {
+			numbers[3] = 1;
+		} catch (ArrayIndexOutOfBoundsException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+		try {
+			numbers = new int[-2];
+		} catch (NegativeArraySizeException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+
+		Object o = "a string";
+		try {
+			Integer i = (Integer) o;
+		} catch (ClassCastException e) {
+			print("cannot cast a string to an integer\n");
+		}
+
+		Object[] objects = new String[1];
+		try {
+			objects[0] = new Object();
+		} catch (ArrayStoreException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+
+		try {
+			printInt(1 / (numbers.length - 3));
+		} catch (ArithmeticException e) {
+			print(e.getMessage());
+			print("\n");
+		}
+	}
+
+	public int method() {
+		return field;
+	}
+
+	public static native void print(String s);
+	public static native void printInt(int i);
+}
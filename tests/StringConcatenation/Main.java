@@ -0,0 +1,41 @@
+public class Main {
+	public static void main(String[] args) {
+		String name = "world";
+		int count = 3;
+		long big = 10000000000L;
+		double ratio = 0.25;
+		float small = 1e-5f;
+		boolean flag = true;
+		char letter = 'x';
+		String nothing = null;
+
+		print("hello " + name + "\n");
+		print("count=" + count + " big=" + big + "\n");
+		print("ratio=" + ratio + " small=" + small + "\n");
+		print(flag + " " + letter + " " + nothing + "\n");
+		print(count + big + "!\n");
+		print(new Thing() + "\n");
+		for (int i = 0; i < 3; i++) {
+			print("i=" + i + "\n");
+		}
+		try {
+			print("never " + new Broken() + "\n");
+		} catch (RuntimeException e) {
+			print("caught " + e.getMessage() + "\n");
+		}
+	}
+
+	public static native void print(String s);
+}
+
+class Thing {
+	public String toString() {
+		return "a thing";
+	}
+}
+
+class Broken {
+	public String toString() {
+		throw new RuntimeException("broken toString");
+	}
+}
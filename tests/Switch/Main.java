@@ -0,0 +1,55 @@
+public class Main {
+	public static void main(String[] args) {
+		for (int i = 0; i < 5; i++) {
+			print(dense(i));
+		}
+		print(sparse(-100));
+		print(sparse(7));
+		print(sparse(1000000));
+		print(sparse(8));
+		print(letter('a'));
+		print(letter('z'));
+		print(letter('?'));
+	}
+
+	public static String dense(int i) {
+		switch (i) {
+		case 1:
+			return "one\n";
+		case 2:
+			return "two\n";
+		case 3:
+			return "three\n";
+		default:
+			return "other\n";
+		}
+	}
+
+	public static String sparse(int i) {
+		switch (i) {
+		case -100:
+			return "minus one hundred\n";
+		case 7:
+			return "seven\n";
+		case 1000000:
+			return "one million\n";
+		default:
+			return "other\n";
+		}
+	}
+
+	public static String letter(char c) {
+		String result = "not a letter\n";
+		switch (c) {
+		case 'a':
+			result = "first letter\n";
+			break;
+		case 'z':
+			result = "last letter\n";
+			break;
+		}
+		return result;
+	}
+
+	public static native void print(String s);
+}
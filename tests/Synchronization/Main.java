@@ -0,0 +1,52 @@
+public class Main {
+	private int count;
+
+	synchronized int add(int n) {
+		if (n > 1) {
+			add(n - 1);
+		}
+		synchronized (this) {
+			count++;
+		}
+		return count;
+	}
+
+	synchronized void fail() {
+		throw new RuntimeException("failed while locked");
+	}
+
+	static synchronized int twice(int n) {
+		synchronized (Main.class) {
+			return n * 2;
+		}
+	}
+
+	public static void main(String[] args) {
+		Main main = new Main();
+		printInt(main.add(3));
+
+		try {
+			main.fail();
+		} catch (RuntimeException e) {
+			print(e.getMessage() + "\n");
+		}
+		printInt(main.add(1));
+
+		int[] values = new int[2];
+		try {
+			synchronized (values) {
+				values[5] = 1;
+			}
+		} catch (ArrayIndexOutOfBoundsException e) {
+			print("out of bounds\n");
+		}
+		synchronized (values) {
+			values[1] = twice(21);
+		}
+		printInt(values[1]);
+	}
+
+	private static native void print(String s);
+
+	private static native void printInt(int i);
+}
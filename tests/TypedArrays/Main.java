@@ -0,0 +1,51 @@
+public class Main {
+	public static void main(String[] args) {
+		boolean[] flags = new boolean[2];
+		flags[1] = true;
+		printInt(flags[0] ? 1 : 0);
+		printInt(flags[1] ? 1 : 0);
+
+		byte[] bytes = new byte[1];
+		bytes[0] = (byte) 200;
+		printInt(bytes[0]);
+
+		short[] shorts = new short[1];
+		shorts[0] = (short) 70000;
+		printInt(shorts[0]);
+
+		char[] chars = new char[1];
+		chars[0] = (char) -1;
+		printInt(chars[0]);
+
+		long[] longs = new long[2];
+		longs[1] = 1L << 40;
+		printLong(longs[0]);
+		printLong(longs[1]);
+
+		float[] floats = new float[1];
+		printFloat(floats[0]);
+
+		double[] doubles = new double[1];
+		doubles[0] = 1.5;
+		printDouble(doubles[0]);
+
+		int[][] grid = new int[2][3];
+		grid[1][2] = 42;
+		printInt(grid[1][2]);
+		printInt(grid.length);
+		printInt(grid[0].length);
+
+		String[][] partial = new String[2][];
+		if (partial[0] == null) {
+			print("null row\n");
+		}
+
+		print("héllo wörld\n");
+	}
+
+	public static native void print(String s);
+	public static native void printInt(int i);
+	public static native void printLong(long l);
+	public static native void printFloat(float f);
+	public static native void printDouble(double d);
+}
@@ -0,0 +1,11 @@
+package tuning;
+
+public class Car extends garage.Vehicle {
+	String kind() {
+		return "car";
+	}
+
+	public String honk() {
+		return "vroom";
+	}
+}
@@ -0,0 +1,14 @@
+public class Main {
+	public static void main(String[] args) {
+		print(new garage.Vehicle().describe() + "\n");
+		print(new tuning.Car().describe() + "\n");
+		print(new garage.Truck().describe() + "\n");
+		print(new SportsCar().describe() + "\n");
+
+		garage.Vehicle racer = new Racer();
+		print(racer.honk() + "\n");
+		print(new garage.Truck().honk() + "\n");
+	}
+
+	private static native void print(String s);
+}
@@ -0,0 +1,2 @@
+public class Racer extends SportsCar {
+}
@@ -0,0 +1,9 @@
+public class SportsCar extends tuning.Car {
+	public String honk() {
+		return super.honk() + " vroom";
+	}
+
+	private String kind() {
+		return "sports car";
+	}
+}
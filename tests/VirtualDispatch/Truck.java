@@ -0,0 +1,7 @@
+package garage;
+
+public class Truck extends tuning.Car {
+	String kind() {
+		return "truck";
+	}
+}
@@ -0,0 +1,15 @@
+package garage;
+
+public class Vehicle {
+	String kind() {
+		return "vehicle";
+	}
+
+	public String describe() {
+		return kind();
+	}
+
+	public String honk() {
+		return "honk";
+	}
+}
@@ -0,0 +1,32 @@
+public class Main {
+	public static void main(String[] args) {
+		// 140 longs fill the first 280 local variable slots so everything
+		// after them needs the wide prefix.
+		long l0 = 0, l1 = 1, l2 = 2, l3 = 3, l4 = 4, l5 = 5, l6 = 6, l7 = 7, l8 = 8, l9 = 9;
+		long l10 = 10, l11 = 11, l12 = 12, l13 = 13, l14 = 14, l15 = 15, l16 = 16, l17 = 17, l18 = 18, l19 = 19;
+		long l20 = 20, l21 = 21, l22 = 22, l23 = 23, l24 = 24, l25 = 25, l26 = 26, l27 = 27, l28 = 28, l29 = 29;
+		long l30 = 30, l31 = 31, l32 = 32, l33 = 33, l34 = 34, l35 = 35, l36 = 36, l37 = 37, l38 = 38, l39 = 39;
+		long l40 = 40, l41 = 41, l42 = 42, l43 = 43, l44 = 44, l45 = 45, l46 = 46, l47 = 47, l48 = 48, l49 = 49;
+		long l50 = 50, l51 = 51, l52 = 52, l53 = 53, l54 = 54, l55 = 55, l56 = 56, l57 = 57, l58 = 58, l59 = 59;
+		long l60 = 60, l61 = 61, l62 = 62, l63 = 63, l64 = 64, l65 = 65, l66 = 66, l67 = 67, l68 = 68, l69 = 69;
+		long l70 = 70, l71 = 71, l72 = 72, l73 = 73, l74 = 74, l75 = 75, l76 = 76, l77 = 77, l78 = 78, l79 = 79;
+		long l80 = 80, l81 = 81, l82 = 82, l83 = 83, l84 = 84, l85 = 85, l86 = 86, l87 = 87, l88 = 88, l89 = 89;
+		long l90 = 90, l91 = 91, l92 = 92, l93 = 93, l94 = 94, l95 = 95, l96 = 96, l97 = 97, l98 = 98, l99 = 99;
+		long l100 = 100, l101 = 101, l102 = 102, l103 = 103, l104 = 104, l105 = 105, l106 = 106, l107 = 107, l108 = 108, l109 = 109;
+		long l110 = 110, l111 = 111, l112 = 112, l113 = 113, l114 = 114, l115 = 115, l116 = 116, l117 = 117, l118 = 118, l119 = 119;
+		long l120 = 120, l121 = 121, l122 = 122, l123 = 123, l124 = 124, l125 = 125, l126 = 126, l127 = 127, l128 = 128, l129 = 129;
+		long l130 = 130, l131 = 131, l132 = 132, l133 = 133, l134 = 134, l135 = 135, l136 = 136, l137 = 137, l138 = 138, l139 = 139;
+		int count = 0;
+		for (int i = 0; i < 1000; i += 300) {
+			count++;
+		}
+		printInt(count);
+		long sum = l0 + l9 + l70 + l139;
+		printLong(sum);
+		l139 += 1000;
+		printLong(l139);
+	}
+
+	public static native void printInt(int i);
+	public static native void printLong(long l);
+}
@@ -0,0 +1,41 @@
+public class Main {
+	static long total;
+
+	public static void main(String[] args) {
+		long a, b;
+		a = b = 5L;
+		printLong(a + b);
+
+		double d = 1.5;
+		float f = 2.5f;
+		long l = 3L;
+		int i = 4;
+		printDouble(d);
+		printFloat(f);
+		printLong(l);
+		printInt(i);
+
+		long[] longs = new long[2];
+		longs[1] += 7L;
+		long previous = longs[1]++;
+		printLong(previous);
+		printLong(longs[1]);
+
+		double[] doubles = new double[1];
+		double old = doubles[0]--;
+		printDouble(old);
+		printDouble(doubles[0]);
+
+		printLong(total = mix(1L, 2, 3.5, 4L));
+		printLong(total);
+	}
+
+	public static long mix(long x, int y, double z, long w) {
+		return x + y + (long) z + w;
+	}
+
+	public static native void printInt(int i);
+	public static native void printLong(long l);
+	public static native void printFloat(float f);
+	public static native void printDouble(double d);
+}
@@ -2,12 +2,18 @@ package java
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"unicode/utf16"
 )
 
 var debug = true
@@ -19,6 +25,44 @@ type VM struct {
 	nativeMethods map[string](func(*VM, *Frame, io.Writer))
 	frame         *Frame
 	stdout        io.Writer
+	archive       *Archive
+	modules       map[string]*module
+	unnamedModule *module
+	mainClass     string
+	// helpfulNullPointers makes NullPointerExceptions say what was null.
+	helpfulNullPointers bool
+	// accessChecks makes the VM enforce access control.
+	accessChecks bool
+	// thread is the thread running.
+	thread *thread
+	// bootstrapLinkers are the bootstrap methods of invokedynamic call sites
+	// that the VM implements itself, keyed by class.method.
+	bootstrapLinkers map[string]func(*VM, bootstrapCall) (*callSite, error)
+	// constantBootstraps are the bootstrap methods of dynamic constants that
+	// the VM implements itself, keyed by class.method.
+	constantBootstraps map[string]func(*VM, bootstrapCall) (javaValue, error)
+	// intrinsics are methods the VM implements itself, whatever the class
+	// library says, keyed by class.method.
+	intrinsics map[string](func(*VM, *Frame, io.Writer))
+	// spunClasses counts the classes the VM has made up, to name them apart.
+	spunClasses int
+	// handleAdapters are the classes that invoke method handles with the
+	// types they were invoked with, keyed by target and type.
+	handleAdapters map[string]*Class
+	// mirrors are the java.lang.Class objects made so far, by descriptor.
+	mirrors map[string]javaObject
+	// internedStrings is the pool of interned strings, which string literals
+	// are taken from.
+	internedStrings map[string]javaObject
+	heap            heap
+	// finalization makes the VM run finalizers, on the finalizer thread.
+	finalization bool
+	finalizer    *thread
+	// heapDumps are the heap dumps asked for from other goroutines, and
+	// heapDumpOnOutOfMemory makes the writer to dump the heap to when the VM
+	// first runs out of memory.
+	heapDumps             *heapDumps
+	heapDumpOnOutOfMemory func() (io.WriteCloser, error)
 }
 
 type Frame struct {
@@ -29,6 +73,15 @@ type Frame struct {
 	PC            *ProgramCounter
 	Variables     []javaValue
 	Root          bool
+	// thrown is set by a native method that throws an exception, and is the
+	// exception dropped by a root frame that drops them.
+	thrown javaObject
+	// monitor is the monitor a synchronized method entered when it was
+	// invoked, to be exited when it returns.
+	monitor *monitor
+	// dropExceptions makes a root frame drop the exceptions thrown to it
+	// instead of stopping the VM.
+	dropExceptions bool
 }
 
 func NewVM() (vm VM) {
@@ -37,16 +90,76 @@ func NewVM() (vm VM) {
 		"printInt":                nativePrintInteger,
 		"printLong":               nativePrintLong,
 		"printFloat":              nativePrintFloat,
+		"printDouble":             nativePrintDouble,
 		"printChar":               nativePrintChar,
 		"arraycopy":               nativeArrayCopy,
 		"desiredAssertionStatus0": nativeDesiredAssertionStatus,
 		"fillInStackTrace":        nativeFillInStackTrace,
 		"registerNatives":         nativeRegisterNatives,
 		"getClass":                nativeGetClass,
+		"getPrimitiveClass":       nativeGetPrimitiveClass,
+		"hashCode":                nativeHashCode,
+		"identityHashCode":        nativeIdentityHashCode,
+		"intern":                  nativeIntern,
+		"gc":                      nativeGC,
+		"maxMemory":               nativeMaxMemory,
+		"totalMemory":             nativeTotalMemory,
+		"freeMemory":              nativeFreeMemory,
+		"clear0":                  nativeClearReference,
+		"refersTo0":               nativeRefersTo,
+		"wait":                    nativeWait,
+		"wait0":                   nativeWait,
+		"notify":                  nativeNotify,
+		"notifyAll":               nativeNotify,
 	}
+	vm.constantBootstraps = map[string]func(*VM, bootstrapCall) (javaValue, error){
+		"java/lang/invoke/ConstantBootstraps.nullConstant":   constantNull,
+		"java/lang/invoke/ConstantBootstraps.primitiveClass": constantPrimitiveClass,
+		"java/lang/invoke/ConstantBootstraps.enumConstant":   constantEnum,
+		"java/lang/invoke/ConstantBootstraps.getStaticFinal": constantStaticFinal,
+		"java/lang/invoke/ConstantBootstraps.invoke":         constantInvoke,
+	}
+	vm.intrinsics = map[string](func(*VM, *Frame, io.Writer)){
+		"java/lang/Object.equals":                                nativeEquals,
+		"java/lang/invoke/MethodHandles.lookup":                  nativeLookup,
+		"java/lang/invoke/MethodHandles$Lookup.findStatic":       nativeFindStatic,
+		"java/lang/invoke/MethodHandles$Lookup.findVirtual":      nativeFindVirtual,
+		"java/lang/invoke/MethodHandles$Lookup.findConstructor":  nativeFindConstructor,
+		"java/lang/invoke/MethodHandles$Lookup.findGetter":       nativeFindGetter,
+		"java/lang/invoke/MethodHandles$Lookup.findStaticGetter": nativeFindStaticGetter,
+		"java/lang/invoke/MethodType.methodType":                 nativeMethodType,
+		"java/lang/invoke/MethodType.toString":                   nativeMethodTypeToString,
+		"java/lang/invoke/MethodHandle.type":                     nativeMethodHandleType,
+		"java/lang/invoke/MethodHandle.toString":                 nativeMethodHandleToString,
+	}
+	vm.handleAdapters = make(map[string]*Class)
+	vm.mirrors = make(map[string]javaObject)
+	vm.internedStrings = make(map[string]javaObject)
+	vm.bootstrapLinkers = map[string]func(*VM, bootstrapCall) (*callSite, error){
+		"java/lang/invoke/StringConcatFactory.makeConcat":              linkStringConcat,
+		"java/lang/invoke/StringConcatFactory.makeConcatWithConstants": linkStringConcat,
+		"java/lang/invoke/LambdaMetafactory.metafactory":               linkLambda,
+		"java/lang/invoke/LambdaMetafactory.altMetafactory":            linkLambda,
+	}
+	vm.modules = make(map[string]*module)
+	vm.unnamedModule = &module{}
+	vm.helpfulNullPointers = true
+	vm.accessChecks = true
+	vm.thread = newThread("main")
+	vm.heap.next = minHeap
+	vm.heap.limit = DefaultMaxHeap
+	vm.heap.referentSlot = -1
+	vm.finalization = true
+	vm.heapDumps = &heapDumps{}
 	return vm
 }
 
+// SetHelpfulNullPointers controls whether NullPointerExceptions thrown by the
+// VM describe the null reference. It is on by default.
+func (vm *VM) SetHelpfulNullPointers(on bool) {
+	vm.helpfulNullPointers = on
+}
+
 func (vm *VM) LoadedClasses() []*Class {
 	return vm.classes
 }
@@ -64,34 +177,79 @@ func (vm *VM) AddDirectory(dir string) {
 }
 
 func (vm *VM) LoadClass(path string) error {
-	file, _ := os.Open(path)
-	defer file.Close()
-	class, err := ParseClass(file)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	vm.classes = append(vm.classes, &class)
+	hash := sha256.Sum256(data)
+	if vm.archive != nil {
+		if class, ok := vm.archive.Lookup(path, hash); ok {
+			vm.classes = append(vm.classes, class)
+			return nil
+		}
+	}
+	class, err := ParseClass(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	class.path = path
+	class.hash = hash
+	vm.classes = append(vm.classes, class)
 	return nil
 }
 
+// UseArchive makes the VM take classes from the archive instead of parsing
+// them, as long as the class files they came from are unchanged.
+func (vm *VM) UseArchive(archive *Archive) {
+	vm.archive = archive
+}
+
+// Archive returns a class data archive holding every class loaded so far.
+func (vm *VM) Archive() (*Archive, error) {
+	archive := NewArchive()
+	for _, c := range vm.classes {
+		if c.path != "" {
+			if err := archive.Add(c); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return archive, nil
+}
+
 func newRootFrame() Frame {
 	return Frame{
 		Root: true,
 	}
 }
 
-func (vm *VM) Run() {
-	vm.stdout = os.Stdout
-	frame := newRootFrame()
-	//TODO: push the actual command line arguments onto the stack for the main method.
-	frame.push(nil)
+func (vm *VM) findMain() {
+	if vm.mainClass != "" {
+		vm.activeMethod = vm.resolveClass(vm.mainClass).resolveMethod("main", "([Ljava/lang/String;)V")
+		if vm.activeMethod == nil {
+			log.Fatalf("Class %s does not have a main method\n", vm.mainClass)
+		}
+		return
+	}
 	//TODO: this is obviously completely wrong
 	for _, c := range vm.classes {
 		if c.hasMethodCalled("main") {
 			vm.activeMethod = c.resolveMethod("main", "([Ljava/lang/String;)V")
 		}
 	}
+}
+
+func (vm *VM) Run() {
+	vm.stdout = os.Stdout
+	frame := newRootFrame()
+	//TODO: push the actual command line arguments onto the stack for the main method.
+	frame.push(nil)
+	vm.findMain()
 	vm.execute(vm.activeMethod.class.Name(), vm.activeMethod.Name(), vm.activeMethod.RawSigniture, &frame, false, true)
+	vm.dumpRequestedHeaps()
 }
 
 func (vm *VM) Start() {
@@ -99,35 +257,30 @@ func (vm *VM) Start() {
 	var frame Frame
 	//TODO: push the actual command line arguments onto the stack for the main method.
 	frame.push(nil)
-	//TODO: this is obviously completely wrong
-	for _, c := range vm.classes {
-		if c.hasMethodCalled("main") {
-			vm.activeMethod = c.resolveMethod("main", "([Ljava/lang/String;)V")
-		}
-	}
+	vm.findMain()
 	vm.execute(vm.activeMethod.class.Name(), vm.activeMethod.Name(), vm.activeMethod.RawSigniture, &frame, false, false)
 }
 
 func nativeStringToJavaString(vm *VM, str string) javaObject {
 	c := vm.resolveClass("java/lang/String")
-	ref := newInstance(c)
-	arrLen := len(str)
-	arr := make([]javaValue, arrLen)
-	for i, _ := range arr {
-		arr[i] = javaByte(str[i])
-	}
-	ref.fields["value"] = javaArray{contents: arr}
-	ref.fields["count"] = javaInt(arrLen)
+	ref := vm.newInstance(c)
+	chars := utf16.Encode([]rune(str))
+	arr := make([]javaValue, len(chars))
+	for i, c := range chars {
+		arr[i] = javaChar(c)
+	}
+	ref.setField("value", vm.newArray("C", nil, arr))
+	ref.setField("count", javaInt(len(chars)))
 	return ref
 }
 
 func javaStringToNativeString(str javaObject) string {
-	f := str.getField("value", "[c").(javaArray)
-	bytes := make([]byte, len(f.contents))
-	for i, b := range f.contents {
-		bytes[i] = byte(b.(javaByte))
+	f := str.getField("value", "[C").(javaArray)
+	chars := make([]uint16, len(f.contents))
+	for i, c := range f.contents {
+		chars[i] = uint16(c.(javaChar))
 	}
-	return string(bytes)
+	return string(utf16.Decode(chars))
 }
 
 func nativePrintString(_ *VM, f *Frame, w io.Writer) {
@@ -159,25 +312,119 @@ func nativePrintFloat(_ *VM, f *Frame, w io.Writer) {
 	return
 }
 
+func nativePrintDouble(_ *VM, f *Frame, w io.Writer) {
+	double := f.Variables[0].(javaDouble).unbox()
+	fmt.Fprintln(w, double)
+	return
+}
+
+// formatJavaFloat formats a float or double like Float.toString and
+// Double.toString: plain decimals between 10^-3 and 10^7 and computerized
+// scientific notation outside of that, always with a digit after the point.
+func formatJavaFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0 && math.Signbit(f):
+		return "-0.0"
+	case f == 0:
+		return "0.0"
+	}
+	if abs := math.Abs(f); abs >= 1e-3 && abs < 1e7 {
+		s := strconv.FormatFloat(f, 'f', -1, bitSize)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	}
+	s := strconv.FormatFloat(f, 'E', -1, bitSize)
+	i := strings.IndexByte(s, 'E')
+	mantissa, exponent := s[:i], s[i+1:]
+	if !strings.Contains(mantissa, ".") {
+		mantissa += ".0"
+	}
+	e, _ := strconv.Atoi(exponent)
+	return mantissa + "E" + strconv.Itoa(e)
+}
+
 func nativePrintChar(_ *VM, f *Frame, w io.Writer) {
 	i := f.Variables[0].(javaInt).unbox()
 	fmt.Fprintf(w, "%c", i)
 	return
 }
 
-func nativeArrayCopy(_ *VM, f *Frame, w io.Writer) {
+func nativeArrayCopy(vm *VM, f *Frame, w io.Writer) {
 	// (Object src,  int  srcPos, Object dest, int destPos, int length)
-	src := f.Variables[0].(javaArray).contents
-	i := f.Variables[1].(javaInt).unbox()
-	dst := f.Variables[2].(javaArray).contents
-	j := f.Variables[3].(javaInt).unbox()
-	k := f.Variables[4].(javaInt).unbox()
-
-	for l := int32(0); l < k; l++ {
-		dst[j+l] = src[i+l]
+	srcRef := f.Variables[0].(javaReference)
+	i := int64(f.Variables[1].(javaInt).unbox())
+	dstRef := f.Variables[2].(javaReference)
+	j := int64(f.Variables[3].(javaInt).unbox())
+	k := int64(f.Variables[4].(javaInt).unbox())
+
+	if srcRef.isNull() || dstRef.isNull() {
+		f.thrown = vm.newThrowable("java/lang/NullPointerException", "")
+		return
+	}
+	src, ok := srcRef.(javaArray)
+	if !ok {
+		f.thrown = vm.newThrowable("java/lang/ArrayStoreException", "arraycopy: source type "+javaClassName(srcRef)+" is not an array")
+		return
+	}
+	dst, ok := dstRef.(javaArray)
+	if !ok {
+		f.thrown = vm.newThrowable("java/lang/ArrayStoreException", "arraycopy: destination type "+javaClassName(dstRef)+" is not an array")
+		return
+	}
+	primitive := func(a javaArray) bool {
+		return a.elementType[0] != 'L' && a.elementType[0] != '['
+	}
+	if (primitive(src) || primitive(dst)) && src.elementType != dst.elementType {
+		message := fmt.Sprintf("arraycopy: type mismatch: can not copy %s[] into %s[]", typeName(src.elementType), typeName(dst.elementType))
+		f.thrown = vm.newThrowable("java/lang/ArrayStoreException", message)
+		return
+	}
+	describe := func(a javaArray) string {
+		if primitive(a) {
+			return fmt.Sprintf("%s[%d]", typeName(a.elementType), len(a.contents))
+		}
+		return fmt.Sprintf("object array[%d]", len(a.contents))
+	}
+	message := ""
+	switch {
+	case i < 0:
+		message = fmt.Sprintf("arraycopy: source index %d out of bounds for %s", i, describe(src))
+	case j < 0:
+		message = fmt.Sprintf("arraycopy: destination index %d out of bounds for %s", j, describe(dst))
+	case k < 0:
+		message = fmt.Sprintf("arraycopy: length %d is negative", k)
+	case i+k > int64(len(src.contents)):
+		message = fmt.Sprintf("arraycopy: last source index %d out of bounds for %s", i+k, describe(src))
+	case j+k > int64(len(dst.contents)):
+		message = fmt.Sprintf("arraycopy: last destination index %d out of bounds for %s", j+k, describe(dst))
+	}
+	if message != "" {
+		f.thrown = vm.newThrowable("java/lang/ArrayIndexOutOfBoundsException", message)
+		return
 	}
 
-	return
+	if primitive(src) || vm.isAssignable(descriptorOf(src)[1:], dst.elementType) {
+		copy(dst.contents[j:j+k], src.contents[i:i+k])
+		return
+	}
+	// Each element has to be checked, the ones before a bad one stay copied.
+	for l := int64(0); l < k; l++ {
+		v := src.contents[i+l].(javaReference)
+		if !v.isNull() && !vm.isAssignable(descriptorOf(v), dst.elementType) {
+			message := fmt.Sprintf("arraycopy: element type mismatch: can not cast one of the elements of %s[] to the type of the destination array, %s", typeName(src.elementType), typeName(dst.elementType))
+			f.thrown = vm.newThrowable("java/lang/ArrayStoreException", message)
+			return
+		}
+		dst.contents[j+l] = src.contents[i+l]
+	}
 }
 
 func nativeDesiredAssertionStatus(_ *VM, f *Frame, w io.Writer) {
@@ -188,7 +435,7 @@ func nativeDesiredAssertionStatus(_ *VM, f *Frame, w io.Writer) {
 func nativeFillInStackTrace(_ *VM, f *Frame, w io.Writer) {
 	// (Throwable t, int unused)
 	t := f.Variables[0].(javaObject)
-	t.setField("stackTrace", javaArray{null: true})
+	t.setField("stackTrace", javaArray{})
 	f.PreviousFrame.push(t)
 	return
 }
@@ -204,57 +451,127 @@ func (vm *VM) setupSystemClass() {
 	system.getField("in").value = bufferedInputStream
 }
 
+// call runs the method name of className, or the method of args[0] when
+// virtual is set, from Go. It returns what the method returns, if anything,
+// or the exception it throws instead of stopping the VM.
+func (vm *VM) call(className, name, descriptor string, virtual bool, args ...javaValue) (javaValue, javaObject) {
+	frame := newRootFrame()
+	frame.dropExceptions = true
+	for _, a := range args {
+		frame.push(a)
+	}
+	vm.execute(className, name, descriptor, &frame, virtual, true)
+	if !frame.thrown.isNull() || descriptor[len(descriptor)-1] == 'V' {
+		return nil, frame.thrown
+	}
+	return frame.pop(), javaObject{}
+}
+
 func (vm *VM) construct(className string, arguments ...javaValue) javaObject {
 	frame := newRootFrame()
 	class := vm.resolveClass(className)
-	o := newInstance(class)
+	o := vm.newInstance(class)
 	frame.push(o)
 	var descriptors []string
 	for _, arg := range arguments {
 		frame.push(arg)
 		switch arg := arg.(type) {
 		case javaObject:
-			descriptors = append(descriptors, "L"+arg.class().Name())
+			descriptors = append(descriptors, "L"+arg.class().Name()+";")
 		default:
 			log.Fatalf("Fuck i don't know how to convert a %T to a descriptor\n", arg)
 		}
 	}
-	descriptor := "(" + strings.Join(descriptors, ",") + ")L" + className + ";"
+	descriptor := "(" + strings.Join(descriptors, "") + ")V"
 	vm.execute(className, "<init>", descriptor, &frame, false, true)
 	return o
 }
 
 func nativeGetClass(vm *VM, f *Frame, w io.Writer) {
-	o := f.Variables[0].(javaObject)
-	classObject := newInstance(vm.resolveClass("java/lang/Class"))
-	classObject.setField("name", nativeStringToJavaString(vm, o.class().Name()))
-	f.PreviousFrame.push(classObject)
+	o := f.Variables[0].(javaReference)
+	f.PreviousFrame.push(vm.classMirror(descriptorOf(o)))
 	return
 }
 
+// primitiveDescriptors are the descriptors of the primitive types by name.
+var primitiveDescriptors = map[string]string{
+	"boolean": "Z", "byte": "B", "char": "C", "short": "S",
+	"int": "I", "long": "J", "float": "F", "double": "D", "void": "V",
+}
+
+func nativeGetPrimitiveClass(vm *VM, f *Frame, w io.Writer) {
+	name := javaStringToNativeString(f.Variables[0].(javaObject))
+	descriptor, ok := primitiveDescriptors[name]
+	if !ok {
+		log.Panicf("There is no primitive type %s", name)
+	}
+	f.PreviousFrame.push(vm.classMirror(descriptor))
+}
+
+// classMirror returns the java.lang.Class object for the type described by
+// descriptor. There is one per type, and the VM keeps the descriptor hidden in
+// it.
+func (vm *VM) classMirror(descriptor string) javaObject {
+	if mirror, ok := vm.mirrors[descriptor]; ok {
+		return mirror
+	}
+	mirror := vm.newInstance(vm.resolveClass("java/lang/Class"))
+	mirror.setField("name", nativeStringToJavaString(vm, javaName(descriptor)))
+	if element := strings.TrimLeft(descriptor, "["); element[0] == 'L' {
+		mirror.setField("module", vm.moduleObject(vm.resolveClass(element[1:len(element)-1])))
+	}
+	mirror.hidden = descriptor
+	vm.mirrors[descriptor] = mirror
+	return mirror
+}
+
 func (vm *VM) resolveClass(name string) *Class {
 	if strings.HasPrefix(name, "[L") {
 		l := len(name)
 		name = name[2 : l-1]
 	}
 
+	class := vm.findClass(name)
+	if class != nil {
+		return class
+	}
+	//TODO: raise the appropriate java exception
+	log.Panicf("Could not resolve class %s\n", name)
+	return nil
+}
+
+// resolveClassFrom resolves a class referenced by the code of accessor,
+// checking that accessor may refer to it.
+func (vm *VM) resolveClassFrom(accessor *Class, name string) (*Class, error) {
+	class := vm.resolveClass(name)
+	if err := vm.checkClassAccess(accessor, class); err != nil {
+		return nil, err
+	}
+	return class, nil
+}
+
+// findClass returns the named class, loading it from the module path or the
+// class path if needed, or nil if it can't be found.
+func (vm *VM) findClass(name string) *Class {
 	class := vm.getClass(name)
 	if class != nil {
 		return class
 	}
+	if m := vm.moduleForPackage(packageName(name)); m != nil {
+		err := vm.LoadClass(filepath.Join(m.dir, name) + ".class")
+		if err == nil {
+			class = vm.classes[len(vm.classes)-1]
+			class.definingModule = m
+			return class
+		}
+	}
 	for _, d := range vm.dirs {
 		err := vm.LoadClass(filepath.Join(d, name) + ".class")
 		if err != nil {
 			continue
 		}
 	}
-	class = vm.getClass(name)
-	if class != nil {
-		return class
-	}
-	//TODO: raise the appropriate java exception
-	log.Panicf("Could not resolve class %s\n", name)
-	return nil
+	return vm.getClass(name)
 }
 
 func (vm *VM) getClass(name string) *Class {
@@ -283,25 +600,17 @@ func newFrame(previousFrame *Frame, method *Method, args []javaValue) Frame {
 	var frame Frame
 	var Variables int
 	if method.Native() {
-		Variables = method.numArgs()
-		if !method.Static() {
-			Variables += 1
+		for _, v := range args {
+			Variables += category(v)
 		}
 	} else {
 		Variables = int(method.Code.maxLocals)
 	}
 	frame.Variables = make([]javaValue, Variables)
-	offset := 0
-	for i, v := range args {
-		frame.Variables[i+offset] = v
-		_, isLong := v.(javaLong)
-		if isLong {
-			offset++
-		}
-		_, isDouble := v.(javaDouble)
-		if isDouble {
-			offset++
-		}
+	slot := 0
+	for _, v := range args {
+		frame.Variables[slot] = v
+		slot += category(v)
 	}
 	frame.Class = method.Class()
 	frame.Method = method
@@ -311,53 +620,70 @@ func newFrame(previousFrame *Frame, method *Method, args []javaValue) Frame {
 	return frame
 }
 
+// load pushes the local variable at index.
+func (f *Frame) load(index int) {
+	f.push(f.Variables[index])
+}
+
+// store sets the local variable at index. Longs and doubles also take up the
+// slot after index, so storing over either half of one leaves the other half
+// unusable.
+func (f *Frame) store(index int, v javaValue) {
+	if index > 0 && category(f.Variables[index-1]) == 2 {
+		f.Variables[index-1] = nil
+	}
+	f.Variables[index] = v
+	if category(v) == 2 {
+		f.Variables[index+1] = nil
+	}
+}
+
+// buildFrame returns the frame that runs the method className.methodName,
+// popping its arguments off previousFrame.
 func buildFrame(vm *VM, className, methodName, descriptor string, previousFrame *Frame, virtual bool) *Frame {
 	class := vm.resolveClass(className)
-	method := class.resolveMethod(methodName, descriptor)
+	method := vm.resolveMethod(class, methodName, descriptor)
 	if method == nil {
-		if className == "java/lang/Object" {
-			log.Fatalf("Unable to find method %s\n", methodName)
-		}
-		return buildFrame(vm, class.getSuperName(), methodName, descriptor, previousFrame, false)
-	}
-	args := collectArgs(method, previousFrame)
-	if virtual {
-		o := args[0].(javaObject)
-		for _, v := range args {
-			previousFrame.push(v)
-		}
-		return buildFrame(vm, o.class().Name(), methodName, descriptor, previousFrame, false)
+		return vm.throw(previousFrame, "java/lang/NoSuchMethodError", "'"+methodSignature(className, methodName, descriptor)+"'")
 	}
-
-	frame := newFrame(previousFrame, method, args)
-	return &frame
+	return vm.invoke(method, previousFrame, virtual)
 }
 
 func (vm *VM) execute(className, methodName, descriptor string, previousFrame *Frame, virtual bool, run bool) *Frame {
 	frame := buildFrame(vm, className, methodName, descriptor, previousFrame, virtual)
 
 	if run {
+		vm.heap.stacks = append(vm.heap.stacks, &frame)
+		handles := len(vm.heap.handles)
 		for frame != previousFrame {
+			vm.heap.handles = vm.heap.handles[:handles]
+			if atomic.LoadInt32(&vm.heapDumps.requested) != 0 {
+				vm.dumpRequestedHeaps()
+			}
 			frame = vm.advance(frame)
 		}
+		vm.heap.stacks = vm.heap.stacks[:len(vm.heap.stacks)-1]
 	}
 
 	return frame
 }
 
 func (vm *VM) Step() {
+	vm.heap.handles = vm.heap.handles[:0]
+	if atomic.LoadInt32(&vm.heapDumps.requested) != 0 {
+		vm.dumpRequestedHeaps()
+	}
 	vm.frame = vm.advance(vm.frame)
 }
 
 func (vm *VM) advance(frame *Frame) *Frame {
 	if !frame.Root {
-		if (frame.Method.accessFlags & Native) != 0 {
-			methodName := frame.Method.Name()
-			native := vm.nativeMethods[methodName]
-			if native == nil {
-				log.Panicf("Unknown native method %s", methodName)
-			}
+		if native := vm.implementation(frame.Method); native != nil {
 			native(vm, frame, vm.stdout)
+			vm.exitMethod(frame)
+			if !frame.thrown.isNull() {
+				return handleException(vm, frame.PreviousFrame, frame.thrown)
+			}
 			return frame.PreviousFrame
 		} else {
 			return runByteCode(vm, frame)
@@ -367,12 +693,31 @@ func (vm *VM) advance(frame *Frame) *Frame {
 	}
 }
 
+// implementation returns the Go function that runs m, which native methods
+// and intrinsics have, or nil if m runs its byte code.
+func (vm *VM) implementation(m *Method) func(*VM, *Frame, io.Writer) {
+	if m.implementationResolved {
+		return m.implementation
+	}
+	m.implementation = vm.intrinsics[m.class.Name()+"."+m.Name()]
+	if m.implementation == nil && m.Native() {
+		m.implementation = vm.nativeMethods[m.Name()]
+		if m.implementation == nil {
+			log.Panicf("Unknown native method %s", m.Name())
+		}
+	}
+	m.implementationResolved = true
+	return m.implementation
+}
+
 func runByteCode(vm *VM, frame *Frame) *Frame {
 	op := frame.PC.next()
 	switch op.name {
 	case "nop":
 	case "aconst_null":
-		frame.push(javaObject{null: true})
+		frame.push(javaObject{})
+	case "iconst_m1":
+		frame.pushInt32(-1)
 	case "iconst_0":
 		frame.pushInt32(0)
 	case "iconst_1":
@@ -385,83 +730,178 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 		frame.pushInt32(4)
 	case "iconst_5":
 		frame.pushInt32(5)
+	case "lconst_0":
+		frame.pushInt64(0)
+	case "lconst_1":
+		frame.pushInt64(1)
+	case "fconst_0":
+		frame.pushFloat32(0.0)
+	case "fconst_1":
+		frame.pushFloat32(1.0)
 	case "fconst_2":
 		frame.pushFloat32(2.0)
+	case "dconst_0":
+		frame.pushFloat64(0.0)
 	case "dconst_1":
 		frame.pushFloat64(1.0)
 	case "bipush":
 		frame.pushInt32(int32(op.int8()))
+	case "sipush":
+		frame.pushInt32(int32(op.int16()))
 	case "ldc":
-		index := uint16(op.int8())
-		switch constant := frame.Class.getConstantPoolItemAt(index).(type) {
-		case intConstant:
-			frame.pushInt32(constant.value)
-		case floatConstant:
-			frame.pushFloat32(constant.value)
-		case stringConstant:
-			s := frame.Class.getStringAt(int(index - 1))
-			ref := nativeStringToJavaString(vm, s.contents)
-			frame.push(ref)
-		case classInfo:
-			c := vm.resolveClass("java/lang/Class")
-			ref := newInstance(c)
-			frame.push(ref)
-		default:
-			log.Fatalf("Cannot load unknown constant %v", constant)
-		}
-	case "ldc2_w":
-		index := op.int16()
-		l := frame.Class.getLongAt(int(index - 1))
-		frame.pushInt64(l.value)
-	case "iload", "aload":
-		index := op.int8()
-		frame.push(frame.Variables[index])
-	case "iload_0", "aload_0", "lload_0", "fload_0":
-		frame.push(frame.Variables[0])
-	case "iload_1", "aload_1", "lload_1", "fload_1":
-		frame.push(frame.Variables[1])
-	case "iload_2", "aload_2", "lload_2":
-		frame.push(frame.Variables[2])
-	case "iload_3", "aload_3", "lload_3":
-		frame.push(frame.Variables[3])
-	case "istore", "astore":
-		index := op.int8()
-		frame.Variables[index] = frame.pop()
-	case "istore_1", "astore_1":
-		frame.Variables[1] = frame.pop()
-	case "istore_2", "astore_2":
-		frame.Variables[2] = frame.pop()
-	case "istore_3", "astore_3":
-		frame.Variables[3] = frame.pop()
+		return loadConstant(vm, frame, uint16(op.uint8()))
+	case "ldc_w", "ldc2_w":
+		return loadConstant(vm, frame, op.uint16())
+	case "iload", "lload", "fload", "dload", "aload":
+		frame.load(op.localIndex())
+	case "iload_0", "lload_0", "fload_0", "dload_0", "aload_0":
+		frame.load(0)
+	case "iload_1", "lload_1", "fload_1", "dload_1", "aload_1":
+		frame.load(1)
+	case "iload_2", "lload_2", "fload_2", "dload_2", "aload_2":
+		frame.load(2)
+	case "iload_3", "lload_3", "fload_3", "dload_3", "aload_3":
+		frame.load(3)
+	case "istore", "lstore", "fstore", "dstore", "astore":
+		frame.store(op.localIndex(), frame.pop())
+	case "istore_0", "lstore_0", "fstore_0", "dstore_0", "astore_0":
+		frame.store(0, frame.pop())
+	case "istore_1", "lstore_1", "fstore_1", "dstore_1", "astore_1":
+		frame.store(1, frame.pop())
+	case "istore_2", "lstore_2", "fstore_2", "dstore_2", "astore_2":
+		frame.store(2, frame.pop())
+	case "istore_3", "lstore_3", "fstore_3", "dstore_3", "astore_3":
+		frame.store(3, frame.pop())
+	case "iaload", "laload", "faload", "daload", "aaload":
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		frame.push(a.contents[i])
+	case "baload":
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		switch v := a.contents[i].(type) {
+		case javaBoolean:
+			if v {
+				frame.pushInt32(1)
+			} else {
+				frame.pushInt32(0)
+			}
+		case javaByte:
+			frame.pushInt32(int32(v))
+		}
+	case "caload":
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		frame.pushInt32(int32(a.contents[i].(javaChar)))
+	case "saload":
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		frame.pushInt32(int32(a.contents[i].(javaShort)))
+	case "iastore", "lastore", "fastore", "dastore":
+		v := frame.pop()
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		a.contents[i] = v
+	case "aastore":
+		v := frame.popReference()
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		if !v.isNull() && !vm.isAssignable(descriptorOf(v), a.elementType) {
+			return vm.throw(frame, "java/lang/ArrayStoreException", javaClassName(v))
+		}
+		a.contents[i] = v.(javaValue)
+	case "bastore":
+		v := frame.popInt32()
+		i := frame.popInt32()
+		a := frame.popArray()
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		if a.elementType == "Z" {
+			a.contents[i] = javaBoolean(v&1 != 0)
+		} else {
+			a.contents[i] = javaByte(v)
+		}
 	case "castore":
 		v := frame.popInt32()
 		i := frame.popInt32()
 		a := frame.popArray()
-		a.contents[int(i)] = javaByte(v)
-	case "caload":
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		a.contents[i] = javaChar(v)
+	case "sastore":
+		v := frame.popInt32()
 		i := frame.popInt32()
 		a := frame.popArray()
-		c := byte(a.contents[int(i)].(javaByte))
-		frame.pushInt32(int32(c))
+		if e := vm.checkArrayAccess(frame, a, i); !e.isNull() {
+			return handleException(vm, frame, e)
+		}
+		a.contents[i] = javaShort(v)
 	case "pop":
-		frame.pop()
+		frame.popWords(1)
+	case "pop2":
+		frame.popWords(2)
 	case "dup":
-		tmp := frame.pop()
-		frame.push(tmp)
-		frame.push(tmp)
+		value := frame.popWords(1)
+		frame.pushAll(value)
+		frame.pushAll(value)
 	case "dup_x1":
-		tmp1 := frame.pop()
-		tmp2 := frame.pop()
-		frame.push(tmp1)
-		frame.push(tmp2)
-		frame.push(tmp1)
+		value1 := frame.popWords(1)
+		value2 := frame.popWords(1)
+		frame.pushAll(value1)
+		frame.pushAll(value2)
+		frame.pushAll(value1)
+	case "dup_x2":
+		value1 := frame.popWords(1)
+		value2 := frame.popWords(2)
+		frame.pushAll(value1)
+		frame.pushAll(value2)
+		frame.pushAll(value1)
+	case "dup2":
+		value := frame.popWords(2)
+		frame.pushAll(value)
+		frame.pushAll(value)
+	case "dup2_x1":
+		value1 := frame.popWords(2)
+		value2 := frame.popWords(1)
+		frame.pushAll(value1)
+		frame.pushAll(value2)
+		frame.pushAll(value1)
+	case "dup2_x2":
+		value1 := frame.popWords(2)
+		value2 := frame.popWords(2)
+		frame.pushAll(value1)
+		frame.pushAll(value2)
+		frame.pushAll(value1)
+	case "swap":
+		value1 := frame.popWords(1)
+		value2 := frame.popWords(1)
+		frame.pushAll(value1)
+		frame.pushAll(value2)
 	case "iadd":
-		//TODO: make sure we do overflow correctly
 		x := frame.popInt32()
 		y := frame.popInt32()
 		frame.pushInt32(x + y)
 	case "isub":
-		//TODO: make sure we do underflow correctly
 		x := frame.popInt32()
 		y := frame.popInt32()
 		frame.pushInt32(y - x)
@@ -472,19 +912,44 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 	case "idiv":
 		x := frame.popInt32()
 		y := frame.popInt32()
+		if x == 0 {
+			return vm.throw(frame, "java/lang/ArithmeticException", "/ by zero")
+		}
+		// Go, like Java, gives MIN_VALUE for MIN_VALUE / -1.
 		frame.pushInt32(y / x)
+	case "irem":
+		x := frame.popInt32()
+		y := frame.popInt32()
+		if x == 0 {
+			return vm.throw(frame, "java/lang/ArithmeticException", "/ by zero")
+		}
+		frame.pushInt32(y % x)
+	case "ineg":
+		frame.pushInt32(-frame.popInt32())
+	case "ishl":
+		s := uint32(frame.popInt32()) & 0x1f
+		frame.pushInt32(frame.popInt32() << s)
+	case "ishr":
+		s := uint32(frame.popInt32()) & 0x1f
+		frame.pushInt32(frame.popInt32() >> s)
+	case "iushr":
+		s := uint32(frame.popInt32()) & 0x1f
+		frame.pushInt32(int32(uint32(frame.popInt32()) >> s))
+	case "iand":
+		frame.pushInt32(frame.popInt32() & frame.popInt32())
+	case "ior":
+		frame.pushInt32(frame.popInt32() | frame.popInt32())
+	case "ixor":
+		frame.pushInt32(frame.popInt32() ^ frame.popInt32())
 	case "iinc":
-		index := op.args[0]
-		c := op.args[1]
+		index := op.localIndex()
 		i := frame.Variables[index].(javaInt).unbox()
-		frame.Variables[index] = javaInt(i + int32(c))
+		frame.Variables[index] = javaInt(i + op.incrementConstant())
 	case "ladd":
-		//TODO: make sure we do overflow correctly
 		x := frame.popInt64()
 		y := frame.popInt64()
 		frame.pushInt64(x + y)
 	case "lsub":
-		//TODO: make sure we do underflow correctly
 		x := frame.popInt64()
 		y := frame.popInt64()
 		frame.pushInt64(y - x)
@@ -495,7 +960,34 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 	case "ldiv":
 		x := frame.popInt64()
 		y := frame.popInt64()
+		if x == 0 {
+			return vm.throw(frame, "java/lang/ArithmeticException", "/ by zero")
+		}
 		frame.pushInt64(y / x)
+	case "lrem":
+		x := frame.popInt64()
+		y := frame.popInt64()
+		if x == 0 {
+			return vm.throw(frame, "java/lang/ArithmeticException", "/ by zero")
+		}
+		frame.pushInt64(y % x)
+	case "lneg":
+		frame.pushInt64(-frame.popInt64())
+	case "lshl":
+		s := uint32(frame.popInt32()) & 0x3f
+		frame.pushInt64(frame.popInt64() << s)
+	case "lshr":
+		s := uint32(frame.popInt32()) & 0x3f
+		frame.pushInt64(frame.popInt64() >> s)
+	case "lushr":
+		s := uint32(frame.popInt32()) & 0x3f
+		frame.pushInt64(int64(uint64(frame.popInt64()) >> s))
+	case "land":
+		frame.pushInt64(frame.popInt64() & frame.popInt64())
+	case "lor":
+		frame.pushInt64(frame.popInt64() | frame.popInt64())
+	case "lxor":
+		frame.pushInt64(frame.popInt64() ^ frame.popInt64())
 	case "fadd":
 		x := frame.popFloat32()
 		y := frame.popFloat32()
@@ -512,6 +1004,84 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 		x := frame.popFloat32()
 		y := frame.popFloat32()
 		frame.pushFloat32(y / x)
+	case "frem":
+		x := frame.popFloat32()
+		y := frame.popFloat32()
+		// fmod is exact so working in double precision loses nothing.
+		frame.pushFloat32(float32(math.Mod(float64(y), float64(x))))
+	case "fneg":
+		frame.pushFloat32(-frame.popFloat32())
+	case "dadd":
+		x := frame.popFloat64()
+		y := frame.popFloat64()
+		frame.pushFloat64(x + y)
+	case "dsub":
+		x := frame.popFloat64()
+		y := frame.popFloat64()
+		frame.pushFloat64(y - x)
+	case "dmul":
+		x := frame.popFloat64()
+		y := frame.popFloat64()
+		frame.pushFloat64(x * y)
+	case "ddiv":
+		x := frame.popFloat64()
+		y := frame.popFloat64()
+		frame.pushFloat64(y / x)
+	case "drem":
+		x := frame.popFloat64()
+		y := frame.popFloat64()
+		frame.pushFloat64(math.Mod(y, x))
+	case "dneg":
+		frame.pushFloat64(-frame.popFloat64())
+	case "i2l":
+		frame.pushInt64(int64(frame.popInt32()))
+	case "i2f":
+		frame.pushFloat32(float32(frame.popInt32()))
+	case "i2d":
+		frame.pushFloat64(float64(frame.popInt32()))
+	case "l2i":
+		frame.pushInt32(int32(frame.popInt64()))
+	case "l2f":
+		frame.pushFloat32(float32(frame.popInt64()))
+	case "l2d":
+		frame.pushFloat64(float64(frame.popInt64()))
+	case "f2i":
+		frame.pushInt32(floatToInt32(float64(frame.popFloat32())))
+	case "f2l":
+		frame.pushInt64(floatToInt64(float64(frame.popFloat32())))
+	case "f2d":
+		frame.pushFloat64(float64(frame.popFloat32()))
+	case "d2i":
+		frame.pushInt32(floatToInt32(frame.popFloat64()))
+	case "d2l":
+		frame.pushInt64(floatToInt64(frame.popFloat64()))
+	case "d2f":
+		frame.pushFloat32(float32(frame.popFloat64()))
+	case "i2b":
+		frame.pushInt32(int32(int8(frame.popInt32())))
+	case "i2c":
+		frame.pushInt32(int32(uint16(frame.popInt32())))
+	case "i2s":
+		frame.pushInt32(int32(int16(frame.popInt32())))
+	case "lcmp":
+		x := frame.popInt64()
+		y := frame.popInt64()
+		switch {
+		case y > x:
+			frame.pushInt32(1)
+		case y < x:
+			frame.pushInt32(-1)
+		default:
+			frame.pushInt32(0)
+		}
+	case "fcmpl", "fcmpg":
+		x := float64(frame.popFloat32())
+		y := float64(frame.popFloat32())
+		frame.pushInt32(compareFloats(y, x, op.name == "fcmpg"))
+	case "dcmpl", "dcmpg":
+		x := frame.popFloat64()
+		y := frame.popFloat64()
+		frame.pushInt32(compareFloats(y, x, op.name == "dcmpg"))
 	case "ifeq":
 		c := frame.popInt32()
 		if c == 0 {
@@ -522,6 +1092,11 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 		if c != 0 {
 			frame.PC.jump(int(op.int16()))
 		}
+	case "iflt":
+		c := frame.popInt32()
+		if c < 0 {
+			frame.PC.jump(int(op.int16()))
+		}
 	case "ifge":
 		c := frame.popInt32()
 		if c >= 0 {
@@ -537,12 +1112,24 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 		if c <= 0 {
 			frame.PC.jump(int(op.int16()))
 		}
+	case "if_icmpeq":
+		v2 := frame.popInt32()
+		v1 := frame.popInt32()
+		if v1 == v2 {
+			frame.PC.jump(int(op.int16()))
+		}
 	case "if_icmpne":
 		v2 := frame.popInt32()
 		v1 := frame.popInt32()
 		if v1 != v2 {
 			frame.PC.jump(int(op.int16()))
 		}
+	case "if_icmplt":
+		v2 := frame.popInt32()
+		v1 := frame.popInt32()
+		if v1 < v2 {
+			frame.PC.jump(int(op.int16()))
+		}
 	case "if_icmpge":
 		v2 := frame.popInt32()
 		v1 := frame.popInt32()
@@ -561,101 +1148,205 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 		if v1 <= v2 {
 			frame.PC.jump(int(op.int16()))
 		}
+	case "if_acmpeq":
+		v2 := frame.popReference()
+		v1 := frame.popReference()
+		if sameObject(v1, v2) {
+			frame.PC.jump(int(op.int16()))
+		}
+	case "if_acmpne":
+		v2 := frame.popReference()
+		v1 := frame.popReference()
+		if !sameObject(v1, v2) {
+			frame.PC.jump(int(op.int16()))
+		}
 	case "goto":
 		frame.PC.jump(int(op.int16()))
-	case "ireturn", "lreturn", "areturn", "freturn":
-		frame.PreviousFrame.push(frame.pop())
-		return frame.PreviousFrame
-	case "return":
+	case "goto_w":
+		frame.PC.jump(int(op.int32At(0)))
+	case "jsr":
+		frame.pushReturnAddress(frame.PC.RawByteCodeIndex)
+		frame.PC.jump(int(op.int16()))
+	case "jsr_w":
+		frame.pushReturnAddress(frame.PC.RawByteCodeIndex)
+		frame.PC.jump(int(op.int32At(0)))
+	case "ret":
+		address := frame.Variables[op.localIndex()].(javaReturnAddress)
+		frame.PC.jumpTo(int(address))
+	case "tableswitch", "lookupswitch":
+		key := frame.popInt32()
+		frame.PC.jump(int(op.switchTarget(key)))
+	case "ireturn", "lreturn", "areturn", "freturn", "dreturn", "return":
+		if !vm.exitMethod(frame) {
+			return vm.throw(frame, "java/lang/IllegalMonitorStateException", "current thread is not owner")
+		}
+		if op.name != "return" {
+			frame.PreviousFrame.push(frame.pop())
+		}
 		return frame.PreviousFrame
-	case "getstatic":
-		fieldRef := frame.Class.getFieldRefAt(op.uint16())
-		c := vm.resolveClass(fieldRef.className())
-		vm.initClass(c)
-		f := c.getField(fieldRef.fieldName())
+	case "getstatic", "putstatic":
+		f, err := vm.resolveFieldRef(frame.Class, op.uint16())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if f.accessFlags&Static == 0 {
+			return vm.throw(frame, "java/lang/IncompatibleClassChangeError", fmt.Sprintf("Expected static field %s.%s", javaName("L"+f.class.Name()+";"), f.name()))
+		}
+		vm.initClass(f.class)
+		if op.name == "putstatic" {
+			f.value = frame.pop()
+			break
+		}
 		frame.push(f.value)
-	case "putstatic":
-		fieldRef := frame.Class.getFieldRefAt(op.uint16())
-		c := vm.resolveClass(fieldRef.className())
-		f := c.getField(fieldRef.fieldName())
-		f.value = frame.pop()
-	case "getfield":
-		fieldRef := frame.Class.getFieldRefAt(op.uint16())
-		obj := frame.popObject()
-		f := obj.getField(fieldRef.fieldName(), fieldRef.fieldDescriptor())
-		frame.push(f)
-	case "putfield":
-		fieldRef := frame.Class.getFieldRefAt(op.uint16())
-		f := frame.pop()
+	case "getfield", "putfield":
+		f, err := vm.resolveFieldRef(frame.Class, op.uint16())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if f.accessFlags&Static != 0 {
+			return vm.throw(frame, "java/lang/IncompatibleClassChangeError", fmt.Sprintf("Expected non-static field %s.%s", javaName("L"+f.class.Name()+";"), f.name()))
+		}
+		var value javaValue
+		if op.name == "putfield" {
+			value = frame.pop()
+		}
 		obj := frame.popObject()
-		obj.setField(fieldRef.fieldName(), f)
+		if obj.isNull() {
+			return vm.throwNullPointer(frame)
+		}
+		if err := vm.checkProtectedReceiver(frame.Class, f.class, f.accessFlags, "field "+f.name(), obj); err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if op.name == "putfield" {
+			obj.fields[f.slot] = value
+			break
+		}
+		frame.push(obj.fields[f.slot])
 	case "invokevirtual":
 		methodRef := frame.Class.getMethodRefAt(op.uint16())
-		return buildFrame(vm, methodRef.className(), methodRef.methodName(), methodRef.methodType(), frame, true)
+		c, err := vm.resolveClassFrom(frame.Class, methodRef.className())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if c.signaturePolymorphic(methodRef.methodName()) {
+			return vm.invokeHandle(frame, methodRef.methodName(), methodRef.methodType())
+		}
+		return vm.invokeMethod(frame, refInvokeVirtual, op.uint16())
 	case "invokespecial":
-		methodRef := frame.Class.getMethodRefAt(op.uint16())
-		return buildFrame(vm, methodRef.className(), methodRef.methodName(), methodRef.methodType(), frame, false)
+		return vm.invokeMethod(frame, refInvokeSpecial, op.uint16())
 	case "invokestatic":
-		methodRef := frame.Class.getMethodRefAt(op.uint16())
-		return buildFrame(vm, methodRef.className(), methodRef.methodName(), methodRef.methodType(), frame, false)
+		return vm.invokeMethod(frame, refInvokeStatic, op.uint16())
 	case "invokeinterface":
-		methodRef := frame.Class.getInterfaceMethodRefAt(op.uint16())
-		return buildFrame(vm, methodRef.className(), methodRef.methodName(), methodRef.methodType(), frame, true)
+		return vm.invokeMethod(frame, refInvokeInterface, op.uint16())
+	case "invokedynamic":
+		return vm.invokeDynamic(frame, op.uint16())
 	case "new":
 		classInfo := frame.Class.getClassInfoAt(op.uint16())
-		c := vm.resolveClass(classInfo.className())
-		ref := newInstance(c)
+		c, err := vm.resolveClassFrom(frame.Class, classInfo.className())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if !vm.reserve(vm.instanceSize(c)) {
+			return vm.throwOutOfMemory(frame)
+		}
+		ref := vm.newInstance(c)
 		frame.push(ref)
 	case "newarray":
 		count := frame.popInt32()
-		arr := make([]javaValue, count)
-		for i, _ := range arr {
-			arr[i] = javaByte(67)
+		if count < 0 {
+			return vm.throw(frame, "java/lang/NegativeArraySizeException", fmt.Sprint(count))
 		}
-		frame.pushArray(javaArray{contents: arr})
+		elementType := primitiveArrayTypes[op.uint8()]
+		if !vm.reserve(arraySize(int64(count))) {
+			return vm.throwOutOfMemory(frame)
+		}
+		frame.pushArray(vm.newArray(elementType, nil, make([]javaValue, count)))
 	case "anewarray":
 		classInfo := frame.Class.getClassInfoAt(op.uint16())
+		elementType, err := vm.resolveTypeFrom(frame.Class, classInfo.className())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
 		count := frame.popInt32()
-		arr := make([]javaValue, count)
-		for i, _ := range arr {
-			//TODO: set the class correctly
-			arr[i] = javaObject{null: true}
+		if count < 0 {
+			return vm.throw(frame, "java/lang/NegativeArraySizeException", fmt.Sprint(count))
 		}
-		frame.pushArray(javaArray{_class: vm.resolveClass(classInfo.className()), contents: arr})
+		var elementClass *Class
+		if elementType[0] == 'L' {
+			elementClass = vm.resolveClass(internalName(elementType))
+		}
+		if !vm.reserve(arraySize(int64(count))) {
+			return vm.throwOutOfMemory(frame)
+		}
+		frame.pushArray(vm.newArray(elementType, elementClass, make([]javaValue, count)))
+	case "multianewarray":
+		classInfo := frame.Class.getClassInfoAt(op.uint16())
+		if _, err := vm.resolveTypeFrom(frame.Class, classInfo.className()); err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		dimensions := make([]int32, op.args[2])
+		for i := len(dimensions) - 1; i >= 0; i-- {
+			dimensions[i] = frame.popInt32()
+		}
+		for _, count := range dimensions {
+			if count < 0 {
+				return vm.throw(frame, "java/lang/NegativeArraySizeException", fmt.Sprint(count))
+			}
+		}
+		if !vm.reserve(multiArraySize(dimensions)) {
+			return vm.throwOutOfMemory(frame)
+		}
+		frame.pushArray(vm.newMultiArray(classInfo.className(), dimensions))
 	case "arraylength":
 		a := frame.popArray()
+		if a.isNull() {
+			return vm.throwNullPointer(frame)
+		}
 		frame.pushInt32(int32(len(a.contents)))
 	case "athrow":
-		return handleException(vm, frame, frame.popObject())
+		throwable := frame.popObject()
+		if throwable.isNull() {
+			return vm.throwNullPointer(frame)
+		}
+		return handleException(vm, frame, throwable)
 	case "checkcast":
 		o := frame.popReference()
-		if o.isNull() {
-			frame.pushReference(o)
-		} else {
-			classInfo := frame.Class.getClassInfoAt(op.uint16())
-			c := classInfo.className()
-			targetClass := vm.resolveClass(c)
-			if vm.implements(o.class(), targetClass) {
-				frame.pushReference(o)
-			} else {
-				//TODO: throw ClassCastException
-				log.Fatal("Class Cast Exception should be thrown here")
-			}
+		classInfo := frame.Class.getClassInfoAt(op.uint16())
+		target, err := vm.resolveTypeFrom(frame.Class, classInfo.className())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if !o.isNull() && !vm.isAssignable(descriptorOf(o), target) {
+			message := fmt.Sprintf("class %s cannot be cast to class %s", javaClassName(o), javaName(target))
+			return vm.throw(frame, "java/lang/ClassCastException", message)
 		}
+		frame.pushReference(o)
 	case "instanceof":
-		classInfo := frame.Class.getClassInfoAt(op.uint16())
-		c := classInfo.className()
 		o := frame.popReference()
-		targetClass := vm.resolveClass(c)
-		if vm.implements(o.class(), targetClass) {
+		classInfo := frame.Class.getClassInfoAt(op.uint16())
+		target, err := vm.resolveTypeFrom(frame.Class, classInfo.className())
+		if err != nil {
+			return vm.throwLinkageError(frame, err)
+		}
+		if !o.isNull() && vm.isAssignable(descriptorOf(o), target) {
 			frame.pushInt32(1)
 		} else {
 			frame.pushInt32(0)
 		}
 	case "monitorenter":
-		//TODO: implement when we get to threading
+		o := frame.popReference()
+		if o.isNull() {
+			return vm.throwNullPointer(frame)
+		}
+		vm.enter(vm.monitorOf(o))
 	case "monitorexit":
-		//TODO: implement when we get to threading
+		o := frame.popReference()
+		if o.isNull() {
+			return vm.throwNullPointer(frame)
+		}
+		if !vm.monitorOf(o).exit(vm.thread) {
+			return vm.throw(frame, "java/lang/IllegalMonitorStateException", "current thread is not owner")
+		}
 	case "ifnull":
 		o := frame.popReference()
 		if o.isNull() {
@@ -672,13 +1363,156 @@ func runByteCode(vm *VM, frame *Frame) *Frame {
 	return frame
 }
 
+// throw creates an exception of the named class and unwinds to its handler.
+func (vm *VM) throw(f *Frame, className, message string) *Frame {
+	return handleException(vm, f, vm.newThrowable(className, message))
+}
+
+// newThrowable creates an exception of the named class. An empty message
+// leaves the detail message null.
+func (vm *VM) newThrowable(className, message string) javaObject {
+	if message == "" {
+		return vm.construct(className)
+	}
+	return vm.construct(className, nativeStringToJavaString(vm, message))
+}
+
+// throwNullPointer throws a NullPointerException from the instruction
+// executing in f.
+func (vm *VM) throwNullPointer(f *Frame) *Frame {
+	return vm.throw(f, "java/lang/NullPointerException", vm.nullPointerMessage(f))
+}
+
+// checkArrayAccess returns the exception that loading or storing a[i] throws,
+// or null if the access is fine.
+func (vm *VM) checkArrayAccess(f *Frame, a javaArray, i int32) javaObject {
+	if a.isNull() {
+		return vm.newThrowable("java/lang/NullPointerException", vm.nullPointerMessage(f))
+	}
+	if i < 0 || int(i) >= len(a.contents) {
+		message := fmt.Sprintf("Index %d out of bounds for length %d", i, len(a.contents))
+		return vm.newThrowable("java/lang/ArrayIndexOutOfBoundsException", message)
+	}
+	return javaObject{}
+}
+
+// floatToInt32 converts like f2i and d2i: NaN becomes zero, values outside
+// the range of an int saturate and everything else is rounded towards zero.
+// Go leaves the out of range cases up to the platform so they are done here.
+func floatToInt32(f float64) int32 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f >= math.MaxInt32:
+		return math.MaxInt32
+	case f <= math.MinInt32:
+		return math.MinInt32
+	}
+	return int32(f)
+}
+
+// floatToInt64 converts like f2l and d2l.
+func floatToInt64(f float64) int64 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+// compareFloats implements the fcmp and dcmp instructions. When either value
+// is NaN the result is 1 for the g variants and -1 for the l variants.
+func compareFloats(v1, v2 float64, nanIsGreater bool) int32 {
+	switch {
+	case v1 > v2:
+		return 1
+	case v1 == v2:
+		return 0
+	case v1 < v2:
+		return -1
+	case nanIsGreater:
+		return 1
+	}
+	return -1
+}
+
+// loadConstant pushes the constant pool item at index for ldc, ldc_w and ldc2_w.
+func loadConstant(vm *VM, frame *Frame, index uint16) *Frame {
+	v, err := vm.constantValue(frame.Class, index)
+	if _, ok := err.(linkageError); ok {
+		return vm.throwLinkageError(frame, err)
+	}
+	// Errors thrown by a bootstrap method are rethrown, other exceptions are
+	// wrapped in a BootstrapMethodError.
+	if e, ok := err.(thrownError); ok {
+		if vm.implements(e.throwable.class(), vm.resolveClass("java/lang/Error")) {
+			return handleException(vm, frame, e.throwable)
+		}
+		return vm.throw(frame, "java/lang/BootstrapMethodError", "bootstrap method initialization exception: "+e.Error())
+	}
+	if err != nil {
+		return vm.throw(frame, "java/lang/BootstrapMethodError", err.Error())
+	}
+	frame.push(v)
+	return frame
+}
+
+// constantValue resolves the loadable constant at index of c to a value.
+func (vm *VM) constantValue(c *Class, index uint16) (javaValue, error) {
+	switch constant := c.getConstantPoolItemAt(index).(type) {
+	case intConstant:
+		return javaInt(constant.value), nil
+	case floatConstant:
+		return javaFloat(constant.value), nil
+	case longConstant:
+		return javaLong(constant.value), nil
+	case doubleConstant:
+		return javaDouble(constant.value), nil
+	case stringConstant:
+		return vm.intern(c.getUTF8At(constant.utf8Index)), nil
+	case classInfo:
+		descriptor, err := vm.resolveTypeFrom(c, constant.className())
+		if err != nil {
+			return nil, err
+		}
+		return vm.classMirror(descriptor), nil
+	case methodType:
+		return c.resolveConstant(index, func() (javaValue, error) {
+			return vm.methodTypeObject(c.getUTF8At(constant.descriptorIndex)), nil
+		})
+	case methodHandle:
+		return c.resolveConstant(index, func() (javaValue, error) {
+			return vm.methodHandleObject(handleTargetOf(constant)), nil
+		})
+	case dynamicConstant:
+		return c.resolveConstant(index, func() (javaValue, error) {
+			return vm.resolveDynamicConstant(constant)
+		})
+	default:
+		log.Fatalf("Cannot load unknown constant %v", constant)
+	}
+	return nil, nil
+}
+
 func handleException(vm *VM, f *Frame, throwable javaObject) *Frame {
+	if f.Root && f.dropExceptions {
+		f.thrown = throwable
+		return f
+	}
 	if f.Root {
 		f.push(throwable)
 		vm.execute(throwable.class().Name(), "toString", "()Ljava/lang/String;", f, false, true)
 		str := f.popObject()
 		log.Fatalf("Unhandled exception %s\n", javaStringToNativeString(str))
 	}
+	if f.Method.Native() {
+		vm.exitMethod(f)
+		return handleException(vm, f.PreviousFrame, throwable)
+	}
 	index := f.PC.CurrentByteCodeIndex()
 	match := false
 	for _, handler := range f.Method.Code.ExceptionHandlers {
@@ -691,31 +1525,150 @@ func handleException(vm *VM, f *Frame, throwable javaObject) *Frame {
 		}
 	}
 	if match {
+		// The handler starts with nothing but the exception on the stack.
+		f.stack = stack{}
 		f.push(throwable)
 		return f
-	} else {
-		f = f.PreviousFrame
 	}
-	return handleException(vm, f, throwable)
+	// Unwinding out of a synchronized method exits its monitor, unless the
+	// thread has already let go of it.
+	if !vm.exitMethod(f) {
+		throwable = vm.newThrowable("java/lang/IllegalMonitorStateException", "current thread is not owner")
+	}
+	return handleException(vm, f.PreviousFrame, throwable)
 }
 
+// implements reports whether child is parent, extends it or implements it.
 func (vm *VM) implements(child *Class, parent *Class) bool {
 	if child.Name() == parent.Name() {
 		return true
 	}
-
-	for child.Name() != "java/lang/Object" {
-		child = vm.resolveClass(child.getSuperName())
-		if child.Name() == parent.Name() {
+	for _, i := range child.interfaces {
+		if vm.implements(vm.resolveClass(child.getClassInfoAt(i).className()), parent) {
 			return true
 		}
 	}
+	if child.Name() == "java/lang/Object" {
+		return false
+	}
+	return vm.implements(vm.resolveClass(child.getSuperName()), parent)
+}
+
+// resolveTypeFrom turns the name in a CONSTANT_Class used by the code of
+// accessor into a descriptor, resolving the class it names.
+func (vm *VM) resolveTypeFrom(accessor *Class, name string) (string, error) {
+	descriptor := name
+	if name[0] != '[' {
+		descriptor = "L" + name + ";"
+	}
+	element := strings.TrimLeft(descriptor, "[")
+	if element[0] == 'L' {
+		if _, err := vm.resolveClassFrom(accessor, element[1:len(element)-1]); err != nil {
+			return "", err
+		}
+	}
+	return descriptor, nil
+}
 
+// descriptorOf is the descriptor of the type of the non-null reference o.
+func descriptorOf(o javaReference) string {
+	switch o := o.(type) {
+	case javaArray:
+		return "[" + o.elementType
+	case javaObject:
+		return "L" + o.class().Name() + ";"
+	}
+	log.Panicf("Unknown reference type %T", o)
+	return ""
+}
+
+// javaClassName is what Class.getName returns for the type of the non-null
+// reference o.
+func javaClassName(o javaReference) string {
+	return javaName(descriptorOf(o))
+}
+
+// javaName is what Class.getName returns for the reference type described by
+// descriptor.
+func javaName(descriptor string) string {
+	if descriptor[0] == '[' {
+		return strings.Replace(descriptor, "/", ".", -1)
+	}
+	return typeName(descriptor)
+}
+
+// isAssignable reports whether a value of the type described by from can be
+// stored in a variable of the type described by to. Both must be reference
+// types, which are assumed to be loaded already.
+func (vm *VM) isAssignable(from, to string) bool {
+	switch {
+	case from == to:
+		return true
+	case from[0] == 'L' && to[0] == 'L':
+		return vm.implements(vm.resolveClass(from[1:len(from)-1]), vm.resolveClass(to[1:len(to)-1]))
+	case from[0] == '[' && to[0] == 'L':
+		switch to {
+		case "Ljava/lang/Object;", "Ljava/lang/Cloneable;", "Ljava/io/Serializable;":
+			return true
+		}
+	case from[0] == '[' && to[0] == '[':
+		isReference := func(d string) bool { return d[0] == 'L' || d[0] == '[' }
+		return isReference(from[1:]) && isReference(to[1:]) && vm.isAssignable(from[1:], to[1:])
+	}
 	return false
 }
 
-func newInstance(c *Class) javaObject {
-	return javaObject{_class: c, fields: make(map[string]javaValue)}
+// newInstance makes an object of class c with each of its fields set to the
+// default value for its type.
+func (vm *VM) newInstance(c *Class) javaObject {
+	layout := vm.fieldLayout(c)
+	fields := make([]javaValue, len(layout))
+	for i, f := range layout {
+		fields[i] = fieldDefaultValue(f.descriptor())
+	}
+	o := javaObject{&object{_class: c, fields: fields}}
+	vm.allocate(o, c.instanceSize)
+	if vm.finalization && vm.hasFinalizer(c) {
+		vm.heap.finalizable = append(vm.heap.finalizable, o)
+	}
+	return o
+}
+
+// instanceSize is how many bytes an object of class c takes up.
+func (vm *VM) instanceSize(c *Class) int64 {
+	vm.fieldLayout(c)
+	return c.instanceSize
+}
+
+// fieldLayout returns the instance fields of c and its superclasses in the
+// order their values are kept in objects of c. The fields of a superclass
+// come first, so each field has the same slot in all its subclasses.
+func (vm *VM) fieldLayout(c *Class) []*field {
+	if c.laidOut {
+		return c.layout
+	}
+	if super := vm.superclass(c); super != nil {
+		c.layout = append(c.layout, vm.fieldLayout(super)...)
+		c.reference = super.reference
+	}
+	if kind, ok := referenceKinds[c.Name()]; ok {
+		c.reference = kind
+	}
+	for i := range c.fields {
+		f := &c.fields[i]
+		if f.accessFlags&Static == 0 {
+			f.slot = len(c.layout)
+			c.layout = append(c.layout, f)
+		}
+	}
+	c.instanceSize = align(objectHeaderSize + int64(len(c.layout))*valueSize)
+	c.laidOut = true
+	if c.Name() == "java/lang/ref/Reference" {
+		if f := c.findField("referent", "Ljava/lang/Object;"); f != nil {
+			vm.heap.referentSlot = f.slot
+		}
+	}
+	return c.layout
 }
 
 func (vm *VM) initClass(c *Class) {
@@ -723,6 +1676,25 @@ func (vm *VM) initClass(c *Class) {
 		return
 	}
 	c.initialised = true
+	// Preparing the class gives its static fields their default values, or
+	// the constants their ConstantValue attributes name.
+	for i := range c.fields {
+		f := &c.fields[i]
+		if f.accessFlags&Static == 0 || f.value != nil {
+			continue
+		}
+		f.value = fieldDefaultValue(f.descriptor())
+		if index, ok := f.constantValue(); ok {
+			v, err := vm.constantValue(c, index)
+			if err != nil {
+				log.Panicf("Bad ConstantValue of %s.%s: %v", c.Name(), f.name(), err)
+			}
+			f.value = v
+		}
+	}
+	if c.resolveMethod("<clinit>", "()V") == nil {
+		return
+	}
 	frame := newRootFrame()
 	vm.execute(c.Name(), "<clinit>", "()V", &frame, false, true)
 }
@@ -752,6 +1724,51 @@ func (s *stack) pop() javaValue {
 	return e
 }
 
+// category is the number of local variable slots or operand stack words
+// taken up by v. Longs and doubles are category 2, everything else is 1.
+func category(v javaValue) int {
+	switch v.(type) {
+	case javaLong, javaDouble:
+		return 2
+	}
+	return 1
+}
+
+// popWords pops values totalling n words off the stack and returns them
+// bottom first. It panics if that would split a category 2 value.
+func (s *stack) popWords(n int) []javaValue {
+	var values []javaValue
+	for n > 0 {
+		v := s.pop()
+		n -= category(v)
+		values = append([]javaValue{v}, values...)
+	}
+	if n < 0 {
+		log.Panicf("Cannot split category 2 value %v", values[0])
+	}
+	return values
+}
+
+func (s *stack) pushAll(values []javaValue) {
+	for _, v := range values {
+		s.push(v)
+	}
+}
+
+// javaReturnAddress is the byte code index after a jsr or jsr_w, which ret
+// jumps back to.
+type javaReturnAddress int
+
+func (_ javaReturnAddress) isJavaValue() {}
+
+func (v javaReturnAddress) String() string {
+	return fmt.Sprintf("returnAddress(%d)", int(v))
+}
+
+func (s *stack) pushReturnAddress(index int) {
+	s.push(javaReturnAddress(index))
+}
+
 type javaInt int32
 
 func (_ javaInt) isJavaValue() {}
@@ -832,7 +1849,17 @@ func (f javaDouble) unbox() float64 {
 	return float64(f)
 }
 
-type javaByte byte
+// javaBoolean, javaByte, javaChar and javaShort only live in arrays. Loading
+// them from an array widens them to a javaInt on the operand stack.
+type javaBoolean bool
+
+func (_ javaBoolean) isJavaValue() {}
+
+func (v javaBoolean) String() string {
+	return fmt.Sprintf("boolean(%v)", bool(v))
+}
+
+type javaByte int8
 
 func (_ javaByte) isJavaValue() {}
 
@@ -840,16 +1867,24 @@ func (v javaByte) String() string {
 	return fmt.Sprintf("byte(%v)", v.unbox())
 }
 
-func (s *stack) pushByte(i byte) {
-	s.push(javaByte(i))
+func (b javaByte) unbox() int8 {
+	return int8(b)
 }
 
-func (s *stack) popByte() byte {
-	return byte(s.pop().(javaByte))
+type javaChar uint16
+
+func (_ javaChar) isJavaValue() {}
+
+func (v javaChar) String() string {
+	return fmt.Sprintf("char(%q)", rune(v))
 }
 
-func (b javaByte) unbox() byte {
-	return byte(b)
+type javaShort int16
+
+func (_ javaShort) isJavaValue() {}
+
+func (v javaShort) String() string {
+	return fmt.Sprintf("short(%v)", int16(v))
 }
 
 type javaReference interface {
@@ -865,17 +1900,171 @@ func (s *stack) pushReference(ref javaReference) {
 	s.push(ref.(javaValue))
 }
 
+// sameObject reports whether two references point at the same object. The
+// references only hold a pointer so comparing them compares identity.
+func sameObject(a, b javaReference) bool {
+	if a.isNull() || b.isNull() {
+		return a.isNull() && b.isNull()
+	}
+	return a == b
+}
+
+// javaArray is a reference to an array. Copies of it refer to the same array
+// and the zero value is the null reference.
 type javaArray struct {
-	_class   *Class
-	contents []javaValue
-	null     bool
+	*array
+}
+
+// array holds the elements of an array along with the descriptor of their
+// type. For arrays of objects _class is the class of the elements.
+type array struct {
+	header
+	_class      *Class
+	elementType string
+	contents    []javaValue
+}
+
+// header is what the VM keeps in every object and array besides its fields
+// or elements.
+type header struct {
+	// monitor is the lock of the object, made when it is first used.
+	monitor *monitor
+	// hash is the identity hash code, or 0 until one is asked for.
+	hash int32
+	// marked is set while the collector finds the object reachable.
+	marked bool
+}
+
+// newArray makes an array of elementType on the heap. Any nil elements are
+// set to the default value for that type.
+func (vm *VM) newArray(elementType string, c *Class, contents []javaValue) javaArray {
+	for i, v := range contents {
+		if v == nil {
+			contents[i] = defaultValue(elementType)
+		}
+	}
+	a := javaArray{&array{_class: c, elementType: elementType, contents: contents}}
+	vm.allocate(a, arraySize(int64(len(contents))))
+	return a
+}
+
+// primitiveArrayTypes maps the atype operand of newarray to a descriptor.
+var primitiveArrayTypes = map[uint8]string{
+	4:  "Z",
+	5:  "C",
+	6:  "F",
+	7:  "D",
+	8:  "B",
+	9:  "S",
+	10: "I",
+	11: "J",
+}
+
+// defaultValue is the value array elements of the given type start with.
+func defaultValue(descriptor string) javaValue {
+	switch descriptor[0] {
+	case 'Z':
+		return javaBoolean(false)
+	case 'B':
+		return javaByte(0)
+	case 'C':
+		return javaChar(0)
+	case 'S':
+		return javaShort(0)
+	case 'I':
+		return javaInt(0)
+	case 'J':
+		return javaLong(0)
+	case 'F':
+		return javaFloat(0)
+	case 'D':
+		return javaDouble(0)
+	case '[':
+		return javaArray{}
+	}
+	return javaObject{}
+}
+
+// fieldDefaultValue is the value a field of the given type starts with.
+// Unlike array elements, fields hold booleans, bytes, chars and shorts as ints
+// just like the operand stack does.
+func fieldDefaultValue(descriptor string) javaValue {
+	switch descriptor[0] {
+	case 'Z', 'B', 'C', 'S':
+		return javaInt(0)
+	}
+	return defaultValue(descriptor)
+}
+
+// typeName turns a field descriptor into the name Java source would use.
+func typeName(descriptor string) string {
+	switch descriptor[0] {
+	case 'Z':
+		return "boolean"
+	case 'B':
+		return "byte"
+	case 'C':
+		return "char"
+	case 'S':
+		return "short"
+	case 'I':
+		return "int"
+	case 'J':
+		return "long"
+	case 'F':
+		return "float"
+	case 'D':
+		return "double"
+	case 'V':
+		return "void"
+	case '[':
+		return typeName(descriptor[1:]) + "[]"
+	case 'L':
+		return strings.Replace(descriptor[1:len(descriptor)-1], "/", ".", -1)
+	}
+	return descriptor
+}
+
+// newMultiArray implements multianewarray for the array class named by
+// descriptor. Only the first len(dimensions) levels are created, any deeper
+// ones are left null.
+func (vm *VM) newMultiArray(descriptor string, dimensions []int32) javaArray {
+	elementType := descriptor[1:]
+	var elementClass *Class
+	if elementType[0] == 'L' {
+		elementClass = vm.resolveClass(elementType[1 : len(elementType)-1])
+	}
+	contents := make([]javaValue, dimensions[0])
+	if len(dimensions) > 1 {
+		for i := range contents {
+			contents[i] = vm.newMultiArray(elementType, dimensions[1:])
+		}
+	}
+	return vm.newArray(elementType, elementClass, contents)
+}
+
+// multiArraySize is how many bytes newMultiArray takes to make an array of
+// the given dimensions.
+func multiArraySize(dimensions []int32) int64 {
+	size := arraySize(int64(dimensions[0]))
+	if len(dimensions) > 1 && dimensions[0] > 0 {
+		inner := multiArraySize(dimensions[1:])
+		if inner > (math.MaxInt64-size)/int64(dimensions[0]) {
+			return math.MaxInt64
+		}
+		size += int64(dimensions[0]) * inner
+	}
+	return size
 }
 
 func (a javaArray) isNull() bool {
-	return a.null
+	return a.array == nil
 }
 
 func (a javaArray) class() *Class {
+	if a.isNull() {
+		return nil
+	}
 	return a._class
 }
 
@@ -885,54 +2074,108 @@ func (a javaArray) String() string {
 	if a.isNull() {
 		return fmt.Sprintf("Array(<null>)")
 	}
-	if a.class() != nil {
-		return fmt.Sprintf("Array(%d,%s)", len(a.contents), a.class().Name())
-	}
-	return fmt.Sprintf("Array(%d,%T)", len(a.contents), a.contents)
+	return fmt.Sprintf("Array(%d,%s)", len(a.contents), typeName(a.elementType))
 }
 
 func (s *stack) pushArray(a javaArray) {
 	s.push(javaArray(a))
 }
 
+// popArray pops an array. A null pushed by aconst_null doesn't know it's
+// meant to be an array so any null reference is accepted.
 func (s *stack) popArray() javaArray {
-	return s.pop().(javaArray)
+	v := s.pop()
+	if r, ok := v.(javaReference); ok && r.isNull() {
+		return javaArray{}
+	}
+	return v.(javaArray)
 }
 
+// javaObject is a reference to an instance of a class. Copies of it refer to
+// the same instance and the zero value is the null reference.
 type javaObject struct {
-	null   bool
+	*object
+}
+
+type object struct {
+	header
 	_class *Class
-	fields map[string]javaValue
+	// fields holds the values of the instance fields, in the slots given by
+	// the field layout of the class.
+	fields []javaValue
+	// extraFields holds the values of the extraFieldNames the class doesn't
+	// declare.
+	extraFields map[string]javaValue
+	// hidden is what the VM keeps about objects of the classes it implements
+	// itself, like the type a Class or a MethodType stands for.
+	hidden interface{}
 }
 
 func (o javaObject) isNull() bool {
-	return o.null
+	return o.object == nil
 }
 
 func (o javaObject) class() *Class {
+	if o.isNull() {
+		return nil
+	}
 	return o._class
 }
 
-func (o *javaObject) getField(name, descriptor string) javaValue {
-	_, ok := o.fields[name]
-	if !ok {
-		switch descriptor[0] {
-		case 'I', 'Z':
-			o.fields[name] = javaInt(0)
-		case 'L':
-			o.fields[name] = javaObject{null: true}
-		case '[':
-			o.fields[name] = javaArray{null: true}
-		default:
-			log.Fatalf("I don't know how to initialize field %v with type %v in %v\n", name, descriptor, o.class().Name())
+// fieldSlot returns the slot of the instance field called name, the one
+// declared furthest down the class hierarchy if several are, or -1.
+func (o javaObject) fieldSlot(name string) int {
+	layout := o._class.layout
+	for i := len(layout) - 1; i >= 0; i-- {
+		if layout[i].name() == name {
+			return i
 		}
 	}
-	result := o.fields[name]
-	return result
+	return -1
+}
+
+// extraFieldNames are the fields, by class, that the VM sets for its own use
+// whether or not the class library declares them. Class mirrors know their
+// module and strings their length even in class libraries from before those
+// had fields for them.
+var extraFieldNames = map[string]map[string]bool{
+	"java/lang/Class":  {"module": true},
+	"java/lang/String": {"count": true},
+}
+
+// checkExtraField panics unless the VM may keep the field called name on o
+// without its class declaring it.
+func (o javaObject) checkExtraField(name string) {
+	if !extraFieldNames[o.class().Name()][name] {
+		log.Panicf("%s has no field called %s", o.class().Name(), name)
+	}
+}
+
+// getField reads the instance field called name for the VM's own use.
+func (o javaObject) getField(name, descriptor string) javaValue {
+	if slot := o.fieldSlot(name); slot >= 0 {
+		return o.fields[slot]
+	}
+	o.checkExtraField(name)
+	if v, ok := o.extraFields[name]; ok {
+		return v
+	}
+	return fieldDefaultValue(descriptor)
 }
 
-func (o *javaObject) setField(name string, f javaValue) {
-	o.fields[name] = f
+// setField sets the instance field called name for the VM's own use. The
+// values of the extra fields the class library doesn't declare are kept on
+// the side.
+func (o javaObject) setField(name string, f javaValue) {
+	if slot := o.fieldSlot(name); slot >= 0 {
+		o.fields[slot] = f
+		return
+	}
+	o.checkExtraField(name)
+	if o.extraFields == nil {
+		o.extraFields = make(map[string]javaValue)
+	}
+	o.extraFields[name] = f
 }
 
 func (_ javaObject) isJavaValue() {}
@@ -945,7 +2188,11 @@ func (o javaObject) String() string {
 }
 
 func (s *stack) popObject() javaObject {
-	return s.pop().(javaObject)
+	v := s.pop()
+	if r, ok := v.(javaReference); ok && r.isNull() {
+		return javaObject{}
+	}
+	return v.(javaObject)
 }
 
 func (f *Frame) DebugOut() {
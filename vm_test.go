@@ -0,0 +1,136 @@
+package java
+
+import (
+	"testing"
+)
+
+func TestSubroutines(t *testing.T) {
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	print := func(a *assembler, s string) {
+		a.ldc(s)
+		a.invoke("invokestatic", "Main", "print", "(Ljava/lang/String;)V")
+	}
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 301, func(a *assembler) {
+		print(a, "start\n")
+		a.branch("jsr", "subroutine")
+		print(a, "after jsr\n")
+		a.branch("jsr_w", "subroutine")
+		print(a, "after jsr_w\n")
+		a.branch("jsr", "wide")
+		print(a, "after wide ret\n")
+		a.branch("goto_w", "count")
+		print(a, "skipped\n")
+
+		a.label("subroutine")
+		a.op("astore_1")
+		print(a, "in subroutine\n")
+		a.op("ret", 1)
+
+		a.label("wide")
+		a.c.op(0, wideOpCode, opcodes["astore"], 1, 44)
+		print(a, "in wide subroutine\n")
+		a.c.op(0, wideOpCode, opcodes["ret"], 1, 44)
+
+		// Counts down with a backwards goto_w.
+		a.label("count")
+		a.op("iconst_3")
+		a.op("istore_2")
+		a.label("loop")
+		a.op("iload_2")
+		a.branch("ifeq", "done")
+		a.op("iload_2")
+		a.invoke("invokestatic", "Main", "printInt", "(I)V")
+		a.op("iinc", 2, 0xff)
+		a.branch("goto_w", "loop")
+		a.label("done")
+		a.op("return")
+	})
+
+	got := run(newTestVM(t, main), "Main")
+	want := "start\nin subroutine\nafter jsr\nin subroutine\nafter jsr_w\nin wide subroutine\nafter wide ret\n3\n2\n1\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnknownFieldPanics(t *testing.T) {
+	vm := newTestVM(t)
+	o := vm.newInstance(vm.resolveClass("java/lang/Throwable"))
+	o.setField("detailMessage", nativeStringToJavaString(vm, "set"))
+	if s := javaStringToNativeString(o.getField("detailMessage", "Ljava/lang/String;").(javaObject)); s != "set" {
+		t.Errorf("detailMessage is %q", s)
+	}
+	for _, access := range []func(){
+		func() { o.setField("module", javaObject{}) },
+		func() { o.getField("cause", "Ljava/lang/Throwable;") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("using a field Throwable doesn't have didn't panic")
+				}
+			}()
+			access()
+		}()
+	}
+}
+
+func TestDefaultMaxHeap(t *testing.T) {
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 1, func(a *assembler) {
+		a.printThrows(func() {
+			a.index("ldc_w", a.w.integer(1<<31-1))
+			a.op("newarray", 10)
+		})
+		a.op("return")
+	})
+
+	vm := newTestVM(t, main)
+	got := run(vm, "Main")
+	if want := "java.lang.OutOfMemoryError: Java heap space\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if limit := vm.HeapStats().Limit; limit != DefaultMaxHeap {
+		t.Errorf("the heap is limited to %d bytes, not %d", limit, DefaultMaxHeap)
+	}
+}
+
+// A null read from an array typed field is a null array, which checkcast
+// lets through to instructions that take objects.
+func TestNullArrayAsObject(t *testing.T) {
+	point := newTestClass(Public|Super, "Point", "java/lang/Object")
+	point.field(Public, "x", "I")
+	main := printer(newTestClass(Public|Super, "Main", "java/lang/Object"))
+	main.field(Static, "none", "[I")
+	main.code(Public|Static, "main", "([Ljava/lang/String;)V", 1, func(a *assembler) {
+		none := func(class string) {
+			a.field("getstatic", "Main", "none", "[I")
+			a.class("checkcast", class)
+		}
+		a.printThrows(
+			func() {
+				none("Point")
+				a.field("getfield", "Point", "x", "I")
+				a.invoke("invokestatic", "Main", "printInt", "(I)V")
+			},
+			func() {
+				none("Point")
+				a.op("iconst_1")
+				a.field("putfield", "Point", "x", "I")
+			},
+			func() {
+				none("java/lang/Throwable")
+				a.op("athrow")
+			},
+		)
+		a.op("return")
+	})
+
+	got := run(newTestVM(t, point, main), "Main")
+	want := "java.lang.NullPointerException: Cannot read field \"x\" because \"Main.none\" is null\n" +
+		"java.lang.NullPointerException: Cannot assign field \"x\" because \"Main.none\" is null\n" +
+		"java.lang.NullPointerException: Cannot throw exception because \"Main.none\" is null\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}